@@ -0,0 +1,474 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// adminUser (ADMIN_USER) and its password protect /admin/ routes, through
+// the login form at /admin/login or basic auth for scripts. The password is
+// given as a bcrypt hash (ADMIN_PASSWORD_HASH) or in plain text
+// (ADMIN_PASSWORD), which is hashed at startup so both are checked alike.
+// Leaving them unset keeps the routes open, which is fine behind a private
+// network or a proxy that does its own auth.
+type adminSettings struct {
+	adminUser         string
+	adminPasswordHash []byte
+}
+
+// loadAdminConfig reads the admin credentials; a user without a password,
+// or a password without a user, is fatal since that almost certainly means
+// a broken deploy
+func (cfg *config) loadAdminConfig() {
+	cfg.adminUser = os.Getenv("ADMIN_USER")
+	password, hash := os.Getenv("ADMIN_PASSWORD"), os.Getenv("ADMIN_PASSWORD_HASH")
+	if password != "" && hash != "" {
+		log.Fatalf("set ADMIN_PASSWORD or ADMIN_PASSWORD_HASH, not both")
+	}
+	if (cfg.adminUser == "") != (password == "" && hash == "") {
+		log.Fatalf("ADMIN_USER and ADMIN_PASSWORD (or ADMIN_PASSWORD_HASH) must be set together")
+	}
+	cfg.adminPasswordHash = nil
+	switch {
+	case hash != "":
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			log.Fatalf("invalid ADMIN_PASSWORD_HASH: %v", err)
+		}
+		cfg.adminPasswordHash = []byte(hash)
+	case password != "":
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatalf("invalid ADMIN_PASSWORD: %v", err)
+		}
+		cfg.adminPasswordHash = h
+	}
+}
+
+// adminAuthEnabled reports whether admin credentials are configured
+func (cfg *config) adminAuthEnabled() bool {
+	return cfg.adminUser != ""
+}
+
+// adminAuth requires an admin session or the admin credentials when they
+// are configured. Browsers opening a page are sent to the login form;
+// everything else gets a basic auth challenge. Requests that change
+// something must come from the site's own pages whatever the credentials,
+// as browsers also resend remembered basic auth to cross-site forms.
+func (s *Server) adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !safeMethod(r.Method) && !s.sameOrigin(r) {
+			http.Error(w, "cross-site request refused", http.StatusForbidden)
+			return
+		}
+		if s.cfg.adminAuthEnabled() {
+			ok, wait := s.adminAuthorized(r)
+			switch {
+			case wait > 0:
+				adminLoginLimited(w, wait)
+				return
+			case !ok && wantsLoginPage(r):
+				// RequestURI as sent, with any catalog prefix StripPrefix took off
+				next := r.RequestURI
+				if next == "" {
+					next = r.URL.RequestURI()
+				}
+				http.Redirect(w, r, "/admin/login?"+url.Values{"next": {next}}.Encode(), http.StatusSeeOther)
+				return
+			case !ok:
+				adminChallenge(w)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// adminAuthorized reports whether r belongs to a live admin session or
+// carries the admin credentials. Basic auth counts against the login
+// limit like the form does: wait is set, and ok false, when r's IP has
+// used up its attempts.
+func (s *Server) adminAuthorized(r *http.Request) (ok bool, wait time.Duration) {
+	if _, ok := s.adminSessionFor(r); ok {
+		return true, 0
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false, 0
+	}
+	return s.adminLoginAttempt(s.cfg.clientIP(r), user, pass)
+}
+
+// checkAdminCredentials reports whether user and pass are the admin's. The
+// bcrypt comparison runs even for a wrong user, so timing doesn't tell.
+func (cfg *config) checkAdminCredentials(user, pass string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(cfg.adminUser)) == 1
+	passOK := bcrypt.CompareHashAndPassword(cfg.adminPasswordHash, []byte(pass)) == nil
+	return cfg.adminAuthEnabled() && userOK && passOK
+}
+
+// adminChallenge answers 401 so the browser asks for the admin credentials
+func adminChallenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// refreshResponse is the JSON shape served by /admin/refresh
+type refreshResponse struct {
+	Invalidated int `json:"invalidated"`
+}
+
+// adminRefreshHandler clears the listing caches of every catalog so newly
+// synced files show up at once. Each cache is cleared under its own lock,
+// so concurrent calls are safe.
+func (s *Server) adminRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := clearListingCaches()
+	for _, c := range s.Catalogs {
+		c.statsMu.Lock()
+		if c.stats != nil {
+			c.stats = nil
+			n++
+		}
+		c.statsMu.Unlock()
+		c.rebuildIndex()
+	}
+	requestIndexing()
+	slog.Info("admin refresh", "invalidated", n)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, refreshResponse{Invalidated: n})
+}
+
+// clearListingCaches empties the per-folder and per-file listing caches and
+// returns how many entries were dropped
+func clearListingCaches() int {
+	folderNewest.Lock()
+	n := len(folderNewest.m)
+	folderNewest.m = map[string]folderNewestEntry{}
+	folderNewest.Unlock()
+
+	imageVerdicts.Lock()
+	n += len(imageVerdicts.m)
+	imageVerdicts.m = map[string]imageVerdict{}
+	imageVerdicts.Unlock()
+	return n + clearDirIndex()
+}
+
+// folderRenameMu serializes folder renames so two requests can't both pass
+// the existence checks and race for the same target
+var folderRenameMu sync.Mutex
+
+// renameResponse is the JSON shape served by /admin/folders/rename
+type renameResponse struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Path string `json:"path"` // new src prefix, images/daily/<to>
+	URL  string `json:"url"`  // new partial URL within the catalog
+}
+
+// validRenameFolder is safeFolderRe without the names it lets through that
+// must never be renamed to or from: "." and "..", and dot-prefixed names
+// that would turn a folder into a hidden file
+func validRenameFolder(name string) bool {
+	return safeFolderRe.MatchString(name) && !strings.HasPrefix(name, ".")
+}
+
+// adminRenameFolderHandler renames a daily folder of one catalog, chosen by
+// its prefix in the catalog parameter (empty for the root catalog). Since it
+// writes to disk it refuses to run unless admin auth is configured.
+func (s *Server) adminRenameFolderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.cfg.adminAuthEnabled() {
+		http.Error(w, "folder rename requires ADMIN_USER and ADMIN_PASSWORD", http.StatusForbidden)
+		return
+	}
+	c := s.adminCatalog(r)
+	if c == nil {
+		http.Error(w, "unknown catalog", http.StatusNotFound)
+		return
+	}
+	from, to := r.FormValue("from"), r.FormValue("to")
+	if !validRenameFolder(from) || !validRenameFolder(to) {
+		http.Error(w, "invalid folder name", http.StatusBadRequest)
+		return
+	}
+	if from == to {
+		http.Error(w, "from and to are the same", http.StatusBadRequest)
+		return
+	}
+
+	folderRenameMu.Lock()
+	defer folderRenameMu.Unlock()
+	src, dst := c.dir("daily", from), c.dir("daily", to)
+	srcInfo, err := os.Lstat(src)
+	if err != nil || !srcInfo.IsDir() {
+		http.Error(w, "source folder not found", http.StatusNotFound)
+		return
+	}
+	// On case-insensitive filesystems a case-only rename finds the source
+	// itself at the target name; anything else there is a conflict
+	if dstInfo, err := os.Lstat(dst); err == nil && !os.SameFile(srcInfo, dstInfo) {
+		http.Error(w, "target folder already exists", http.StatusConflict)
+		return
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("admin rename", "path", dst, "err", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(src, dst); err != nil {
+		slog.Error("admin rename", "from", src, "to", dst, "err", err)
+		http.Error(w, "rename failed", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin rename", "catalog", c.Prefix, "from", from, "to", to)
+
+	clearListingCaches()
+	c.statsMu.Lock()
+	c.stats = nil
+	c.statsMu.Unlock()
+	c.rebuildIndex()
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, renameResponse{
+		From: from,
+		To:   to,
+		Path: "images/daily/" + to,
+		URL:  c.Prefix + "/daily/" + to,
+	})
+}
+
+// adminCatalog returns the catalog named by its prefix in the catalog
+// parameter (empty for the root catalog), or nil
+func (s *Server) adminCatalog(r *http.Request) *catalog {
+	prefix := strings.TrimSuffix(r.FormValue("catalog"), "/")
+	for _, c := range s.Catalogs {
+		if c.Prefix == prefix {
+			return c
+		}
+	}
+	return nil
+}
+
+// folderCoverMu serializes cover changes so two of them can't interleave
+// their read and write of the same folder.json
+var folderCoverMu sync.Mutex
+
+// coverResponse is the JSON shape served by /admin/folders/cover
+type coverResponse struct {
+	Folder string `json:"folder"`
+	Cover  string `json:"cover"` // the cover now shown, images/daily/<folder>/<file>
+}
+
+// adminFolderCoverHandler sets the cover image of a daily folder (form
+// fields folder and cover, a file name in it), or clears the setting when
+// cover is empty so the first image is shown again. It edits the folder's
+// config file in place, keeping its other fields, and creates folder.json
+// when there is none. Like rename it requires admin auth to be configured.
+func (s *Server) adminFolderCoverHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.cfg.adminAuthEnabled() {
+		http.Error(w, "setting covers requires ADMIN_USER and ADMIN_PASSWORD", http.StatusForbidden)
+		return
+	}
+	c := s.adminCatalog(r)
+	if c == nil {
+		http.Error(w, "unknown catalog", http.StatusNotFound)
+		return
+	}
+	folder, cover := r.FormValue("folder"), r.FormValue("cover")
+	if !validRenameFolder(folder) {
+		http.Error(w, "invalid folder name", http.StatusBadRequest)
+		return
+	}
+	dir := c.dir("daily", folder)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		http.Error(w, "folder not found", http.StatusNotFound)
+		return
+	}
+	if cover != "" {
+		if filepath.Base(cover) != cover || !isMediaName(cover) {
+			http.Error(w, errInvalidCover.Error(), http.StatusBadRequest)
+			return
+		}
+		if info, err := os.Stat(filepath.Join(dir, cover)); err != nil || !info.Mode().IsRegular() {
+			http.Error(w, "cover image not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	folderCoverMu.Lock()
+	defer folderCoverMu.Unlock()
+	if err := setFolderConfigField(dir, "cover", cover); err != nil {
+		slog.Error("admin cover", "dir", dir, "err", err)
+		http.Error(w, "writing folder config failed", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin cover", "catalog", c.Prefix, "folder", folder, "cover", cover)
+	// Don't wait for the watcher: the folder list must show the new cover
+	invalidateDir(fsnotify.Event{Name: filepath.Join(dir, folderConfigNames[0]), Op: fsnotify.Write})
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, coverResponse{Folder: folder, Cover: c.dailyFolderInfo(folder).Cover})
+}
+
+// setFolderConfigField sets one field of dir's config file, or removes it
+// when value is empty, leaving the other fields as they were. The file is
+// the one readFolderConfig would read, or a new folder.json.
+func setFolderConfigField(dir, field, value string) error {
+	p := filepath.Join(dir, folderConfigNames[0])
+	fields := map[string]any{}
+	for _, name := range folderConfigNames {
+		raw, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		p = filepath.Join(dir, name)
+		break
+	}
+	if value == "" {
+		delete(fields, field)
+	} else {
+		fields[field] = value
+	}
+	raw, err := json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p, append(raw, '\n'))
+}
+
+// orderResponse is the JSON shape served by /admin/folders/order
+type orderResponse struct {
+	Order  []string `json:"order"` // file names in the order now shown
+	Pinned []string `json:"pinned"`
+}
+
+// adminFolderOrderHandler saves the display order of a daily folder (form
+// field folder) or category (category) as its order.txt. Each order value
+// is a file name, in the order wanted, as sent by a drag-reorder UI; pinned
+// values mark the ones to keep on top whatever the sort. Images left out
+// follow alphabetically. An order.txt written by hand is replaced whole.
+func (s *Server) adminFolderOrderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.cfg.adminAuthEnabled() {
+		http.Error(w, "ordering images requires ADMIN_USER and ADMIN_PASSWORD", http.StatusForbidden)
+		return
+	}
+	c := s.adminCatalog(r)
+	if c == nil {
+		http.Error(w, "unknown catalog", http.StatusNotFound)
+		return
+	}
+	var dir string
+	switch folder, cat := r.FormValue("folder"), r.FormValue("category"); {
+	case folder != "" && cat == "":
+		if !validRenameFolder(folder) {
+			http.Error(w, "invalid folder name", http.StatusBadRequest)
+			return
+		}
+		dir = c.dir("daily", folder)
+	case cat != "" && folder == "":
+		if _, ok := c.category(cat); !ok {
+			http.Error(w, "unknown category", http.StatusNotFound)
+			return
+		}
+		dir = c.dir(cat)
+	default:
+		http.Error(w, "give either folder or category", http.StatusBadRequest)
+		return
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		http.Error(w, "folder not found", http.StatusNotFound)
+		return
+	}
+
+	order, pins := r.Form["order"], r.Form["pinned"]
+	listed := map[string]bool{}
+	for _, name := range order {
+		if filepath.Base(name) != name || !isMediaName(name) || listed[name] {
+			http.Error(w, fmt.Sprintf("invalid or repeated image %q", name), http.StatusBadRequest)
+			return
+		}
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || !info.Mode().IsRegular() {
+			http.Error(w, fmt.Sprintf("image %q not found", name), http.StatusNotFound)
+			return
+		}
+		listed[name] = true
+	}
+	pinned := map[string]bool{}
+	for _, name := range pins {
+		if !listed[name] {
+			http.Error(w, fmt.Sprintf("pinned image %q is not in order", name), http.StatusBadRequest)
+			return
+		}
+		pinned[name] = true
+	}
+
+	var b strings.Builder
+	b.WriteString("# written by /admin/folders/order; \"* name\" pins an image\n")
+	for _, name := range order {
+		if pinned[name] {
+			b.WriteString("* ")
+		}
+		b.WriteString(name + "\n")
+	}
+	p := filepath.Join(dir, orderFileName)
+	if err := writeFileAtomic(p, []byte(b.String())); err != nil {
+		slog.Error("admin order", "dir", dir, "err", err)
+		http.Error(w, "writing order.txt failed", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin order", "catalog", c.Prefix, "dir", dir, "images", len(order), "pinned", len(pinned))
+	// Don't wait for the watcher: the response lists the new order
+	invalidateDir(fsnotify.Event{Name: p, Op: fsnotify.Write})
+
+	resp := orderResponse{Order: []string{}, Pinned: []string{}}
+	for _, img := range c.listImages(r.Context(), dir) {
+		resp.Order = append(resp.Order, path.Base(img))
+	}
+	_, pinnedNow := c.readOrderFile(dir)
+	for _, name := range resp.Order {
+		if pinnedNow[name] {
+			resp.Pinned = append(resp.Pinned, name)
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, resp)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signing in at /admin/login starts a server-side session: the browser only
+// holds a random token in adminSessionCookie, and the session behind it
+// lives in memory until it expires, its owner logs out or the server
+// restarts. The cookie is HttpOnly, SameSite=Lax and, over HTTPS (or behind
+// a TRUST_PROXY proxy that reports https), Secure.
+const (
+	adminSessionCookie = "admin_session"
+	adminSessionTTL    = 12 * time.Hour
+)
+
+// adminLoginFailuresPerHour is how many wrong passwords each client IP may
+// send an hour, through the login form or basic auth, before it gets 429
+const adminLoginFailuresPerHour = 10
+
+// adminSession is one signed-in browser
+type adminSession struct {
+	user    string
+	expires time.Time
+}
+
+// adminSessions holds a server's live sessions by token
+type adminSessions struct {
+	sync.Mutex
+	m map[string]adminSession
+}
+
+// newAdminSession starts a session for user and returns its token, dropping
+// expired sessions on the way
+func (s *Server) newAdminSession(user string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+	for t, sess := range s.sessions.m {
+		if now.After(sess.expires) {
+			delete(s.sessions.m, t)
+		}
+	}
+	s.sessions.m[token] = adminSession{user: user, expires: now.Add(adminSessionTTL)}
+	return token, nil
+}
+
+// adminSessionFor returns the live session r's cookie names. Whether r may
+// use it to change something is adminAuth's call (see sameOrigin).
+func (s *Server) adminSessionFor(r *http.Request) (adminSession, bool) {
+	cookie, err := r.Cookie(adminSessionCookie)
+	if err != nil || cookie.Value == "" {
+		return adminSession{}, false
+	}
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+	sess, ok := s.sessions.m[cookie.Value]
+	if !ok {
+		return adminSession{}, false
+	}
+	if time.Now().After(sess.expires) {
+		delete(s.sessions.m, cookie.Value)
+		return adminSession{}, false
+	}
+	return sess, true
+}
+
+// endAdminSession drops the session r's cookie names, if any
+func (s *Server) endAdminSession(r *http.Request) {
+	if cookie, err := r.Cookie(adminSessionCookie); err == nil {
+		s.sessions.Lock()
+		delete(s.sessions.m, cookie.Value)
+		s.sessions.Unlock()
+	}
+}
+
+// setAdminSessionCookie sets (or, with maxAge < 0, clears) the session
+// cookie
+func (s *Server) setAdminSessionCookie(w http.ResponseWriter, r *http.Request, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminSessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   s.cfg.requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// adminLoginAttempt checks user and pass, from the client at ip, against the
+// admin credentials. Every attempt takes a token of the server's
+// loginLimiter up front, in the same locked step that checks there is one,
+// and gets it back when it succeeds, so failures always count. A positive
+// wait means ip has no attempts left; the credentials weren't checked.
+func (s *Server) adminLoginAttempt(ip, user, pass string) (ok bool, wait time.Duration) {
+	if ok, wait := s.loginLimiter.take(ip, 1, 1); !ok {
+		metrics.Lock()
+		metrics.rateLimited["admin_login"]++
+		metrics.Unlock()
+		return false, max(wait, time.Second)
+	}
+	if !s.cfg.checkAdminCredentials(user, pass) {
+		slog.Warn("admin login failed", "user", user, "ip", ip)
+		return false, 0
+	}
+	s.loginLimiter.charge(ip, -1) // a negative charge refunds
+	return true, 0
+}
+
+// adminLoginLimited answers 429 to a client out of login attempts
+func adminLoginLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+}
+
+// safeMethod reports whether method only reads
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// sameOrigin reports whether r was sent by a page of this site, going by
+// its Origin header or, in browsers that leave that out, Sec-Fetch-Site.
+// Requests with neither come from scripts, not other sites' pages.
+func (s *Server) sameOrigin(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return strings.EqualFold(origin, s.cfg.requestScheme(r)+"://"+r.Host)
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+		return true
+	}
+	return false
+}
+
+// wantsLoginPage reports whether r is a browser opening an admin page, which
+// is better sent to the login form than answered with a basic auth prompt
+func wantsLoginPage(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.Header.Get("Authorization") == "" && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// loginNext returns where to go after signing in: next when it is a path on
+// this site, /admin otherwise
+func loginNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/admin"
+	}
+	return next
+}
+
+// adminLoginHandler shows the login form and, on POST, checks the
+// credentials, starts a session and sends the browser on to next
+func (s *Server) adminLoginHandler(w http.ResponseWriter, r *http.Request) {
+	next := loginNext(r.FormValue("next"))
+	if !s.cfg.adminAuthEnabled() {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	data := struct {
+		SiteName string
+		Next     string
+		User     string
+		Error    string
+	}{s.siteName(), next, "", ""}
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if _, ok := s.adminSessionFor(r); ok {
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+	case http.MethodPost:
+		if !s.sameOrigin(r) {
+			http.Error(w, "cross-site login refused", http.StatusForbidden)
+			return
+		}
+		ip, user := s.cfg.clientIP(r), r.PostFormValue("user")
+		ok, wait := s.adminLoginAttempt(ip, user, r.PostFormValue("password"))
+		if wait > 0 {
+			adminLoginLimited(w, wait)
+			return
+		}
+		if !ok {
+			data.User, data.Error = user, "Wrong user name or password."
+			status = http.StatusUnauthorized
+			break
+		}
+		token, err := s.newAdminSession(user)
+		if err != nil {
+			httpError(w, r, "could not start a session", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("admin login", "user", user, "ip", ip)
+		s.setAdminSessionCookie(w, r, token, int(adminSessionTTL.Seconds()))
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	s.render(w, status, "login.gohtml", data)
+}
+
+// adminLogoutHandler ends the browser's session and returns to the login
+// form
+func (s *Server) adminLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.sameOrigin(r) {
+		http.Error(w, "cross-site logout refused", http.StatusForbidden)
+		return
+	}
+	s.endAdminSession(r)
+	s.setAdminSessionCookie(w, r, "", -1)
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
+
+// adminCatalogLink is one catalog on the admin home page
+type adminCatalogLink struct {
+	SiteName string
+	Prefix   string
+}
+
+// adminHomeHandler renders /admin, the starting point of the management
+// pages, with the reports of every catalog
+func (s *Server) adminHomeHandler(w http.ResponseWriter, r *http.Request) {
+	catalogs := make([]adminCatalogLink, len(s.Catalogs))
+	for i, c := range s.Catalogs {
+		catalogs[i] = adminCatalogLink{c.siteName(), c.Prefix}
+	}
+	data := struct {
+		SiteName  string
+		User      string
+		Catalogs  []adminCatalogLink
+		LoggedIn  bool
+		AuthOn    bool
+		ExpiresAt time.Time
+	}{SiteName: s.siteName(), Catalogs: catalogs, AuthOn: s.cfg.adminAuthEnabled()}
+	if sess, ok := s.adminSessionFor(r); ok {
+		data.User, data.LoggedIn, data.ExpiresAt = sess.user, true, sess.expires
+	} else if user, _, ok := r.BasicAuth(); ok {
+		data.User = user
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	s.render(w, http.StatusOK, "admin.gohtml", data)
+}
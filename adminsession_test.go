@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// withAdmin configures admin credentials a/secret
+func withAdmin(cfg *config) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	cfg.adminUser, cfg.adminPasswordHash = "a", hash
+}
+
+// adminRequest serves one request to srv from the same client IP
+func adminRequest(srv http.Handler, method, target string, form url.Values, setup func(*http.Request)) *httptest.ResponseRecorder {
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	if setup != nil {
+		setup(req)
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminLoginSession(t *testing.T) {
+	srv, _ := newTestServer(t, withAdmin)
+
+	page := adminRequest(srv, http.MethodGet, "/admin/broken", nil, func(r *http.Request) { r.Header.Set("Accept", "text/html") })
+	if page.Code != http.StatusSeeOther || !strings.HasPrefix(page.Header().Get("Location"), "/admin/login?next=") {
+		t.Fatalf("page without session: %d to %q, want a redirect to the login form", page.Code, page.Header().Get("Location"))
+	}
+	bad := adminRequest(srv, http.MethodPost, "/admin/login", url.Values{"user": {"a"}, "password": {"wrong"}}, nil)
+	if bad.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: %d, want 401", bad.Code)
+	}
+	good := adminRequest(srv, http.MethodPost, "/admin/login", url.Values{"user": {"a"}, "password": {"secret"}, "next": {"/admin/broken"}}, nil)
+	if good.Code != http.StatusSeeOther || good.Header().Get("Location") != "/admin/broken" {
+		t.Fatalf("login: %d to %q, want 303 to /admin/broken", good.Code, good.Header().Get("Location"))
+	}
+	cookies := good.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != adminSessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("login cookies %v, want one HttpOnly %s", cookies, adminSessionCookie)
+	}
+	withCookie := func(r *http.Request) { r.AddCookie(cookies[0]) }
+
+	if rec := adminRequest(srv, http.MethodGet, "/admin/broken", nil, withCookie); rec.Code != http.StatusOK {
+		t.Errorf("page with session: %d, want 200", rec.Code)
+	}
+	crossSite := func(r *http.Request) {
+		r.AddCookie(cookies[0])
+		r.Header.Set("Origin", "https://evil.example")
+	}
+	if rec := adminRequest(srv, http.MethodPost, "/admin/refresh", nil, crossSite); rec.Code != http.StatusForbidden {
+		t.Errorf("cross-site POST with session: %d, want 403", rec.Code)
+	}
+	if rec := adminRequest(srv, http.MethodPost, "/admin/refresh", nil, withCookie); rec.Code != http.StatusOK {
+		t.Errorf("POST with session: %d, want 200", rec.Code)
+	}
+	if rec := adminRequest(srv, http.MethodPost, "/admin/logout", nil, withCookie); rec.Code != http.StatusSeeOther {
+		t.Errorf("logout: %d, want 303", rec.Code)
+	}
+	if rec := adminRequest(srv, http.MethodGet, "/admin/broken", nil, withCookie); rec.Code != http.StatusUnauthorized {
+		t.Errorf("page after logout: %d, want 401", rec.Code)
+	}
+}
+
+func TestAdminBasicAuthIsLimitedAndSameOrigin(t *testing.T) {
+	srv, _ := newTestServer(t, withAdmin)
+	basic := func(pass string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth("a", pass) }
+	}
+
+	if rec := adminRequest(srv, http.MethodPost, "/admin/refresh", nil, func(r *http.Request) {
+		r.SetBasicAuth("a", "secret")
+		r.Header.Set("Origin", "https://evil.example")
+	}); rec.Code != http.StatusForbidden {
+		t.Errorf("cross-site POST with basic auth: %d, want 403", rec.Code)
+	}
+	// Successes don't use up attempts
+	for i := 0; i < adminLoginFailuresPerHour+2; i++ {
+		if rec := adminRequest(srv, http.MethodGet, "/admin/broken", nil, basic("secret")); rec.Code != http.StatusOK {
+			t.Fatalf("right password, request %d: %d, want 200", i+1, rec.Code)
+		}
+	}
+	for i := 0; i < adminLoginFailuresPerHour; i++ {
+		if rec := adminRequest(srv, http.MethodGet, "/metrics", nil, basic("wrong")); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password, attempt %d: %d, want 401", i+1, rec.Code)
+		}
+	}
+	for _, pass := range []string{"wrong", "secret"} {
+		rec := adminRequest(srv, http.MethodGet, "/admin/broken", nil, basic(pass))
+		if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s password once out of attempts: %d, want 429 with Retry-After", pass, rec.Code)
+		}
+	}
+	// The form shares the limit
+	if rec := adminRequest(srv, http.MethodPost, "/admin/login", url.Values{"user": {"a"}, "password": {"secret"}}, nil); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("login form once out of attempts: %d, want 429", rec.Code)
+	}
+}
+
+func TestAdminOnlyCatalogRoutes(t *testing.T) {
+	srv, _ := newTestServer(t, withAdmin)
+	for _, path := range []string{"/stats", "/api/duplicates"} {
+		if rec := adminRequest(srv, http.MethodGet, path, nil, nil); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s without credentials: %d, want 401", path, rec.Code)
+		}
+		if rec := adminRequest(srv, http.MethodGet, path, nil, func(r *http.Request) { r.SetBasicAuth("a", "secret") }); rec.Code != http.StatusOK {
+			t.Errorf("%s with credentials: %d, want 200", path, rec.Code)
+		}
+	}
+}
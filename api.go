@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// folderStatus is one entry of /api/folders/status. Newest is null for
+// folders without images.
+type folderStatus struct {
+	Name   string  `json:"name"`
+	Count  int     `json:"count"`
+	Newest *string `json:"newest"`
+}
+
+// folderStatusAPIHandler reports every daily folder with its image count and
+// newest image modtime, freshest first, so stale sets are easy to spot
+func (c *catalog) folderStatusAPIHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	folders := c.listDailyFolders(ctx)
+	statuses := make([]folderStatus, 0, len(folders))
+	newest := make(map[string]time.Time, len(folders))
+	for _, f := range folders {
+		dir := c.dir("daily", f.Name)
+		st := folderStatus{Name: f.Name, Count: len(c.listImages(ctx, dir))}
+		if t := c.newestImageTime(dir); !t.IsZero() {
+			ts := t.UTC().Format(time.RFC3339)
+			st.Newest = &ts
+			newest[f.Name] = t
+		}
+		statuses = append(statuses, st)
+	}
+	// Newest first; folders without images sink to the bottom and keep
+	// their alphabetical order from listDailyFolders
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return newest[statuses[i].Name].After(newest[statuses[j].Name])
+	})
+	if ctx.Err() != nil {
+		return // client went away; the listing may be incomplete
+	}
+	writeJSON(w, statuses)
+}
+
+// writeJSON encodes v as the response body, keeping a Content-Type the
+// caller already set
+func writeJSON(w http.ResponseWriter, v any) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("encoding JSON response", "err", err)
+	}
+}
+
+// apiError is the JSON shape of error responses on /api/ routes
+type apiError struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// httpError replies like http.Error, except that /api/ routes get a JSON
+// body so clients can handle every error the same way
+func httpError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if !isAPIPath(r.URL.Path) {
+		http.Error(w, msg, code)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(apiError{Error: msg, Status: code}); err != nil {
+		slog.Error("encoding JSON error", "err", err)
+	}
+}
+
+// notFound is http.NotFound with JSON bodies on /api/ routes
+func notFound(w http.ResponseWriter, r *http.Request) {
+	if !isAPIPath(r.URL.Path) {
+		http.NotFound(w, r)
+		return
+	}
+	httpError(w, r, "not found", http.StatusNotFound)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// folderNameDateRe finds a year and month in a folder name like
+// 2024-06-01a, 20240601 or 2024_06
+var folderNameDateRe = regexp.MustCompile(`(20\d{2})[-_.]?(0[1-9]|1[0-2])`)
+
+// folderMonth returns the month a daily folder belongs to: its folder.json
+// date, else the date in its name, else when its newest image (or, when it
+// has none, the folder itself) was modified
+func (c *catalog) folderMonth(f DailyFolder) time.Time {
+	t := f.Date
+	if t.IsZero() {
+		if m := folderNameDateRe.FindStringSubmatch(f.Name); m != nil {
+			year, _ := strconv.Atoi(m[1])
+			month, _ := strconv.Atoi(m[2])
+			t = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+		}
+	}
+	if t.IsZero() {
+		t = c.newestImageTime(c.dir("daily", f.Name))
+	}
+	if t.IsZero() {
+		if info, err := c.fs.Stat(c.dir("daily", f.Name)); err == nil {
+			t = info.ModTime()
+		}
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// archiveMonth is one section of the archive page
+type archiveMonth struct {
+	Month   time.Time
+	Folders []archiveFolder
+	Images  int
+}
+
+type archiveFolder struct {
+	DailyFolder
+	Images int
+}
+
+// archiveHandler lists every daily folder grouped by month, newest first,
+// with image counts, so older folders stay reachable once the folder list
+// on the daily tab gets long
+func (c *catalog) archiveHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	folders := c.listDailyFolders(ctx)
+	byMonth := map[time.Time]*archiveMonth{}
+	var months []*archiveMonth
+	for _, f := range folders {
+		key := c.folderMonth(f)
+		m := byMonth[key]
+		if m == nil {
+			m = &archiveMonth{Month: key}
+			byMonth[key] = m
+			months = append(months, m)
+		}
+		n := len(c.listImages(ctx, c.dir("daily", f.Name)))
+		m.Folders = append(m.Folders, archiveFolder{DailyFolder: f, Images: n})
+		m.Images += n
+	}
+	if ctx.Err() != nil {
+		return // client went away; the listing may be incomplete
+	}
+	sort.Slice(months, func(i, j int) bool { return months[i].Month.After(months[j].Month) })
+
+	data := PageData{
+		Prefix:       c.Prefix,
+		ActiveTab:    "archive",
+		DailyFolders: folders,
+		RecentImages: c.recentFromRequest(r),
+		SiteName:     c.siteName(),
+	}
+	for _, m := range months {
+		data.Archive = append(data.Archive, *m)
+	}
+	data.Lang = detectLang(r)
+	data.T = translations[data.Lang]
+	data.Theme = themeFromRequest(r)
+	w.Header().Set("Vary", "Accept-Language, Cookie")
+	c.srv.render(w, http.StatusOK, "index.gohtml", data)
+}
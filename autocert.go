@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// autocertHosts splits the AutocertHosts setting into hostnames
+func (cfg config) autocertHosts() []string {
+	var hosts []string
+	for _, h := range strings.Split(cfg.AutocertHosts, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// autocertServers returns the servers of the built-in HTTPS mode: handler
+// on :443 with certificates obtained and renewed from Let's Encrypt for the
+// configured hosts, and :80 answering ACME challenges and redirecting
+// everything else to HTTPS. Certificates are kept in cfg.AutocertCache so
+// restarts don't hit the issuance rate limits.
+func autocertServers(cfg config, handler http.Handler) (https, redirect *http.Server) {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.autocertHosts()...),
+		Cache:      autocert.DirCache(cfg.AutocertCache),
+		Email:      cfg.AutocertEmail,
+	}
+	https = cfg.applyTimeouts(&http.Server{
+		Addr:      ":443",
+		Handler:   handler,
+		TLSConfig: &tls.Config{GetCertificate: m.GetCertificate, NextProtos: []string{"h2", "http/1.1", "acme-tls/1"}},
+	})
+	redirect = &http.Server{
+		Addr:              ":80",
+		Handler:           m.HTTPHandler(nil), // nil redirects to https://
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return https, redirect
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// brokenImage is one entry of the unreadable-images report
+type brokenImage struct {
+	Src    string // images/...
+	Folder string
+	Name   string
+	Size   int64
+	Mod    time.Time
+	Reason string
+	Listed bool // still shown in the gallery, as a broken thumbnail
+}
+
+// brokenImages lists c's images that can't be decoded: listed ones the
+// indexer failed to read, and files IMAGE_CHECK keeps out of the listings
+// (zero-byte ones by default). Images the indexer hasn't reached yet are
+// left out.
+func (c *catalog) brokenImages(ctx context.Context) []brokenImage {
+	var broken []brokenImage
+	add := func(img string, size int64, mod time.Time, reason string, listed bool) {
+		broken = append(broken, brokenImage{
+			Src:    c.srcFor(img),
+			Folder: filepath.Base(filepath.Dir(img)),
+			Name:   filepath.Base(img),
+			Size:   size,
+			Mod:    mod,
+			Reason: reason,
+			Listed: listed,
+		})
+	}
+	for _, img := range c.visibleImages(ctx) {
+		if f, ok := cachedFacts(img); ok && f.broken != "" {
+			add(img, f.size, f.mod, f.broken, true)
+		}
+	}
+
+	root := filepath.Clean(c.Root) + string(filepath.Separator)
+	imageVerdicts.Lock()
+	skipped := map[string]imageVerdict{}
+	for p, v := range imageVerdicts.m {
+		if !v.ok && strings.HasPrefix(filepath.Clean(p), root) {
+			skipped[p] = v
+		}
+	}
+	imageVerdicts.Unlock()
+	for p, v := range skipped {
+		// Verdicts outlive deleted and fixed files
+		if info, err := c.fs.Stat(p); err == nil && info.Size() == v.size && info.ModTime().Equal(v.mod) {
+			add(filepath.ToSlash(p), v.size, v.mod, v.reason, false)
+		}
+	}
+	sort.Slice(broken, func(i, j int) bool { return broken[i].Src < broken[j].Src })
+	return broken
+}
+
+// adminBrokenHandler renders the unreadable-images report of one catalog
+// (catalog param, empty for the root one)
+func (s *Server) adminBrokenHandler(w http.ResponseWriter, r *http.Request) {
+	c := s.adminCatalog(r)
+	if c == nil {
+		http.Error(w, "unknown catalog", http.StatusNotFound)
+		return
+	}
+	images := c.brokenImages(r.Context())
+	if r.Context().Err() != nil {
+		return
+	}
+	data := struct {
+		SiteName  string
+		Prefix    string
+		Images    []brokenImage
+		CanRemove bool
+	}{c.siteName(), c.Prefix, images, s.cfg.adminAuthEnabled()}
+	w.Header().Set("Cache-Control", "no-store")
+	s.render(w, http.StatusOK, "broken.gohtml", data)
+}
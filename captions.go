@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Captions and tags come from sidecar files next to the images: card.jpg
+// takes its caption from card.json ({"caption": "...", "tags": [...]}) or,
+// failing that, card.txt, and its tags from card.json. The folder's own
+// config files never count as sidecars.
+var sidecarExts = []string{".json", ".txt"}
+
+// maxCaptionLen caps a caption in runes; longer ones are cut
+const maxCaptionLen = 500
+
+// sidecar is what the sidecar files of one image say
+type sidecar struct {
+	paths   []string // the files read
+	caption string
+	tags    []string
+}
+
+// reservedSidecar reports whether name is a folder file rather than a
+// caption, e.g. order.txt next to an order.jpg
+func reservedSidecar(name string) bool {
+	return name == orderFileName || slices.Contains(folderConfigNames, name)
+}
+
+// dirSidecars returns the captions and tags of the images directly inside
+// dir by file name. Like listings, watched directories are served from dirIndex
+// until they change.
+func (c *catalog) dirSidecars(dir string) map[string]sidecar {
+	cached, ok, gen := cachedSidecars(dir)
+	if ok {
+		return cached
+	}
+	entries, err := c.fs.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	sidecars := map[string]sidecar{}
+	for _, e := range entries {
+		if e.IsDir() || !isMediaName(e.Name()) {
+			continue
+		}
+		stem := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		var s sidecar
+		for _, ext := range sidecarExts {
+			name := stem + ext
+			if !names[name] || reservedSidecar(name) {
+				continue
+			}
+			p := filepath.Join(dir, name)
+			s.paths = append(s.paths, p)
+			caption, tags := c.readSidecar(p)
+			if s.caption == "" {
+				s.caption = caption
+			}
+			s.tags = append(s.tags, tags...)
+		}
+		if len(s.paths) > 0 {
+			sidecars[e.Name()] = s
+		}
+	}
+	storeSidecars(dir, sidecars, gen)
+	return sidecars
+}
+
+// readSidecar reads one sidecar file; unreadable or malformed ones are
+// logged and yield nothing. Only .json files carry tags.
+func (c *catalog) readSidecar(p string) (caption string, tags []string) {
+	raw, err := c.fs.ReadFile(p)
+	if err != nil {
+		slog.Warn("reading caption failed", "path", p, "err", err)
+		return "", nil
+	}
+	caption = string(raw)
+	if filepath.Ext(p) == ".json" {
+		var v struct {
+			Caption string   `json:"caption"`
+			Tags    []string `json:"tags"`
+		}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			slog.Warn("ignoring malformed caption file", "path", p, "err", err)
+			return "", nil
+		}
+		caption = v.Caption
+		for _, t := range v.Tags {
+			tag, ok := normalizeTag(t)
+			if !ok {
+				slog.Warn("ignoring invalid tag", "path", p, "tag", t)
+				continue
+			}
+			if !containsTag(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return cleanCaption(caption), tags
+}
+
+// cleanCaption collapses whitespace and cuts caption to maxCaptionLen
+func cleanCaption(caption string) string {
+	caption = strings.Join(strings.Fields(caption), " ")
+	if utf8.RuneCountInString(caption) > maxCaptionLen {
+		caption = string([]rune(caption)[:maxCaptionLen])
+	}
+	return caption
+}
+
+// captionFor returns the caption of the image at path, or ""
+func (c *catalog) captionFor(path string) string {
+	return c.dirSidecars(filepath.Dir(path))[filepath.Base(path)].caption
+}
+
+// tagsFor returns the tags of the image at path, or nil
+func (c *catalog) tagsFor(path string) []string {
+	return c.dirSidecars(filepath.Dir(path))[filepath.Base(path)].tags
+}
+
+// sidecarPaths returns the sidecar files in dir, for Last-Modified and
+// ETags: editing one changes what pages show without touching the images
+func (c *catalog) sidecarPaths(dir string) []string {
+	var paths []string
+	for _, s := range c.dirSidecars(dir) {
+		paths = append(paths, s.paths...)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// srcCaption returns the caption of the image named by src (images/...)
+func (c *catalog) srcCaption(src string) string {
+	return c.captionFor(c.dir(filepath.FromSlash(strings.TrimPrefix(src, "images/"))))
+}
+
+// srcTags returns the tags of the image named by src (images/...)
+func (c *catalog) srcTags(src string) []string {
+	return c.tagsFor(c.dir(filepath.FromSlash(strings.TrimPrefix(src, "images/"))))
+}
+
+// captionsBySrc returns the captions of those srcs that have one, for the
+// imageGrid template
+func (c *catalog) captionsBySrc(srcs []string) map[string]string {
+	captions := map[string]string{}
+	for _, src := range srcs {
+		if caption := c.srcCaption(src); caption != "" {
+			captions[src] = caption
+		}
+	}
+	return captions
+}
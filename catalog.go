@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// catalog is one image collection served under a URL prefix. Src values
+// stay in the images/daily/<folder>/file form within every catalog; only the
+// on-disk root and the URL prefix differ.
+type catalog struct {
+	Prefix   string `json:"prefix"`    // like "/a"; empty serves at the site root
+	Root     string `json:"root"`      // on-disk image directory
+	SiteName string `json:"site_name"` // shown in titles and the app bar; empty follows the site
+
+	srv     *Server // set when the catalog is mounted
+	cfg     *config // the server's; set with srv
+	fs      storage // reads the image tree; osStorage unless set before mounting
+	statsMu sync.Mutex
+	stats   *catalogStats
+	index   searchIndex
+}
+
+// siteName is the catalog's own site name, or the site's current one
+func (c *catalog) siteName() string {
+	if c.SiteName != "" {
+		return c.SiteName
+	}
+	return c.srv.siteName()
+}
+
+// loadCatalogs reads the catalog list from the JSON file named by
+// CATALOGS_FILE, e.g. [{"prefix":"/a","root":"store-a","site_name":"Store A"}].
+// Without it a single catalog serves cfg.ImagesRoot at the root.
+func loadCatalogs(cfg config) []*catalog {
+	file := os.Getenv("CATALOGS_FILE")
+	if file == "" {
+		return []*catalog{{Root: cfg.ImagesRoot}}
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatalf("error reading CATALOGS_FILE: %v", err)
+	}
+	var catalogs []*catalog
+	if err := json.Unmarshal(raw, &catalogs); err != nil {
+		log.Fatalf("error parsing CATALOGS_FILE %s: %v", file, err)
+	}
+	if len(catalogs) == 0 {
+		log.Fatalf("CATALOGS_FILE %s lists no catalogs", file)
+	}
+	seen := map[string]bool{}
+	for _, c := range catalogs {
+		c.Prefix = strings.TrimSuffix(c.Prefix, "/")
+		if c.Prefix != "" && (!strings.HasPrefix(c.Prefix, "/") || strings.Count(c.Prefix, "/") != 1) {
+			log.Fatalf("catalog prefix %q must be a single path segment like /a", c.Prefix)
+		}
+		if seen[c.Prefix] {
+			log.Fatalf("duplicate catalog prefix %q", c.Prefix)
+		}
+		seen[c.Prefix] = true
+		if c.Root == "" {
+			log.Fatalf("catalog %q has no root", c.Prefix)
+		}
+		if _, err := os.Stat(c.Root); err != nil {
+			slog.Warn("catalog root unavailable", "catalog", c.Prefix, "root", c.Root, "err", err)
+		}
+	}
+	return catalogs
+}
+
+// routes returns the handlers of one catalog, with paths relative to its
+// prefix
+func (c *catalog) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	images := http.FS(rootFS{c.fs, c.Root})
+	mux.Handle("/images/", http.StripPrefix("/images/", c.hideHidden(c.watermarkOriginals(webpVariants(images, c.formatVariants(c.stripOriginals(http.FileServer(images))))))))
+	mux.HandleFunc("/", c.galleryHandler)
+	mux.HandleFunc("/daily/", c.dailyFolderHandler)
+	mux.HandleFunc("/category/", c.categoryHandler)
+	mux.HandleFunc("/view", c.imageViewHandler)
+	mux.HandleFunc("/view/partial", c.imagePartialHandler)
+	mux.HandleFunc("/download", c.downloadHandler)
+	mux.HandleFunc("/download/selection", c.selectionZipHandler)
+	mux.HandleFunc("/download/daily/", c.folderZipHandler)
+	mux.HandleFunc("/api/related", c.relatedAPIHandler)
+	mux.HandleFunc("/api/folders/status", c.folderStatusAPIHandler)
+	mux.HandleFunc("/api/duplicates", c.srv.adminAuth(c.duplicatesAPIHandler))
+	mux.HandleFunc("/api/metadata", c.metadataAPIHandler)
+	mux.HandleFunc("/api/scroll", c.scrollAPIHandler)
+	mux.HandleFunc("/api/", notFound)
+	mux.HandleFunc("/thumb", c.thumbHandler)
+	mux.HandleFunc("/og", c.ogImageHandler)
+	mux.HandleFunc("/qr", c.qrHandler)
+	mux.HandleFunc("/img", c.imgHandler)
+	mux.HandleFunc("/img/", c.imgPathHandler)
+	mux.HandleFunc("/stats", c.srv.adminAuth(c.statsHandler))
+	mux.HandleFunc("/picks", c.picksHandler)
+	mux.HandleFunc("/search", c.searchHandler)
+	mux.HandleFunc("/tag/", c.tagHandler)
+	mux.HandleFunc("/archive", c.archiveHandler)
+	mux.HandleFunc("/manifest.json", c.manifestHandler)
+	return mux
+}
+
+// mount registers the catalog's routes under its prefix
+func (c *catalog) mount(mux *http.ServeMux) {
+	if c.Prefix == "" {
+		mux.Handle("/", c.routes())
+		return
+	}
+	mux.Handle(c.Prefix+"/", http.StripPrefix(c.Prefix, c.routes()))
+}
+
+// dir joins path elements onto the catalog's image root
+func (c *catalog) dir(elem ...string) string {
+	return filepath.Join(append([]string{c.Root}, elem...)...)
+}
+
+// srcFor converts an on-disk path below the root into its src form
+// (images/...)
+func (c *catalog) srcFor(diskPath string) string {
+	rel, err := filepath.Rel(c.Root, diskPath)
+	if err != nil {
+		return filepath.ToSlash(diskPath)
+	}
+	return "images/" + filepath.ToSlash(rel)
+}
+
+// srcsFor converts a list of on-disk paths with srcFor
+func (c *catalog) srcsFor(diskPaths []string) []string {
+	srcs := make([]string, 0, len(diskPaths))
+	for _, p := range diskPaths {
+		srcs = append(srcs, c.srcFor(p))
+	}
+	return srcs
+}
+
+// imageURL returns the URL path serving the image at diskPath
+func (c *catalog) imageURL(diskPath string) string {
+	return c.Prefix + "/" + c.srcFor(diskPath)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// categorySettings: categoryNames (CATEGORIES, comma-separated directory
+// names like "weekly,monthly,special") are the flat image sets shown besides
+// the daily folders, in tab order. Unset, every visible top-level directory
+// of a catalog other than daily/ is one, in name order.
+type categorySettings struct {
+	categoryNames []string
+}
+
+func (cfg *config) loadCategoryConfig() {
+	v := os.Getenv("CATEGORIES")
+	if v == "" {
+		return
+	}
+	seen := map[string]bool{}
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if !safeFolderRe.MatchString(name) || name == "daily" || strings.HasPrefix(name, ".") || seen[name] {
+			log.Fatalf("invalid CATEGORIES %q: want distinct directory names other than daily", v)
+		}
+		seen[name] = true
+		cfg.categoryNames = append(cfg.categoryNames, name)
+	}
+}
+
+// category is a flat image set directly below the image root, like
+// weekly/: one directory of images with its own tab, partial and carousel.
+// A folder.json in it sets the title, description and default order as for
+// daily folders.
+type category struct {
+	Name        string // directory name, used in URLs and as the src kind
+	Title       string // folder.json title; "" uses Label's fallbacks
+	Description string
+	Sort        string
+}
+
+// Label is the tab and heading text: the folder.json title, else the UI
+// string named like the directory (weekly has one), else the name itself
+func (cat category) Label(t map[string]string) string {
+	if cat.Title != "" {
+		return cat.Title
+	}
+	if s := t[cat.Name]; s != "" {
+		return s
+	}
+	return cat.Name
+}
+
+// categories returns c's categories. Hidden ones (see hiddenMarker) are
+// left out either way.
+func (c *catalog) categories() []category {
+	names := c.cfg.categoryNames
+	if names == nil {
+		entries, _ := c.fs.ReadDir(c.Root)
+		for _, e := range entries {
+			if e.IsDir() && e.Name() != "daily" && safeFolderRe.MatchString(e.Name()) && !strings.HasPrefix(e.Name(), ".") {
+				names = append(names, e.Name())
+			}
+		}
+	}
+	var cats []category
+	for _, name := range names {
+		dir := c.dir(name)
+		if c.folderHidden(dir) {
+			continue
+		}
+		cfg := c.readFolderConfig(dir)
+		cats = append(cats, category{Name: name, Title: cfg.Title, Description: cfg.Description, Sort: cfg.Sort})
+	}
+	return cats
+}
+
+// category looks up one of c's categories by directory name
+func (c *catalog) category(name string) (category, bool) {
+	for _, cat := range c.categories() {
+		if cat.Name == name {
+			return cat, true
+		}
+	}
+	return category{}, false
+}
+
+// imageCategory returns the category of an image given its src split on
+// "/", when it lies directly inside one
+func (c *catalog) imageCategory(parts []string) (category, bool) {
+	if len(parts) != 3 || parts[0] != "images" {
+		return category{}, false
+	}
+	return c.category(parts[1])
+}
+
+// visibleImages lists what the galleries show for c: the images of each
+// visible daily folder and of every category
+func (c *catalog) visibleImages(ctx context.Context) []string {
+	var imgs []string
+	for _, f := range c.listDailyFolders(ctx) {
+		imgs = append(imgs, c.listImages(ctx, c.dir("daily", f.Name))...)
+	}
+	for _, cat := range c.categories() {
+		imgs = append(imgs, c.listImages(ctx, c.dir(cat.Name))...)
+	}
+	return imgs
+}
+
+// categoryHandler serves the images of a category as an HTMX partial, like
+// /daily/<folder> does for a folder
+func (c *catalog) categoryHandler(w http.ResponseWriter, r *http.Request) {
+	name, slash := folderFromPath(r.URL.Path, "/category/")
+	if slash && c.cfg.trailingSlashRedirect {
+		redirectQuery(w, r, c.Prefix+"/category/"+name, nil)
+		return
+	}
+	cat, ok := c.category(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	c.serveImagesPartial(w, r, imagesPartial{
+		dir:         c.dir(cat.Name),
+		defaultSort: cat.Sort,
+		path:        "/category/" + cat.Name,
+		tab:         galleryQuery(cat.Name, "", r.URL.Query().Get("sort")),
+		target:      "categoryImages",
+		anchor:      "categoryView",
+	})
+}
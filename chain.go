@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+)
+
+// middleware wraps a handler with cross-cutting behaviour
+type middleware func(http.Handler) http.Handler
+
+// chain applies mws to h so that the first one listed sees the request
+// first
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Use adds middlewares to the end of the server's stack, innermost, so they
+// run after request IDs, logging, recovery and the host/CORS checks and
+// right before routing. Auth or rate limiting slot in here.
+func (s *Server) Use(mws ...middleware) {
+	s.middlewares = append(s.middlewares, mws...)
+	s.handler = chain(s.mux, s.middlewares...)
+}
+
+type requestIDKey struct{}
+
+// requestIDRe accepts incoming X-Request-ID values that are safe to log
+// and echo: short, no spaces or control characters
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID gives every request an ID, kept from a proxy's X-Request-ID
+// when it looks sane and generated otherwise. It is stored in the context
+// and echoed in the X-Request-ID response header so a report can be matched
+// to the log line.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRe.MatchString(id) {
+			var b [8]byte
+			rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestIDFrom returns the ID requestID stored in ctx, or ""
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// recoverPanics turns a handler panic into a logged stack trace and a 500:
+// the styled error page for pages, a JSON error on /api/ routes. When the
+// handler had already started the response there is nothing to replace, so
+// the connection is just closed.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(v)
+			}
+			slog.Error("panic serving request", "path", r.URL.Path, "request_id", requestIDFrom(r.Context()),
+				"panic", v, "stack", string(debug.Stack()))
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			// Drop whatever the handler prepared for its own response
+			for _, h := range []string{"Content-Disposition", "Content-Encoding", "Content-Length", "ETag", "Last-Modified"} {
+				w.Header().Del(h)
+			}
+			if isAPIPath(r.URL.Path) {
+				httpError(w, r, "internal server error", http.StatusInternalServerError)
+				return
+			}
+			lang := detectLang(r)
+			data := struct {
+				SiteName  string
+				Lang      string
+				T         map[string]string
+				RequestID string
+			}{s.siteName(), lang, translations[lang], requestIDFrom(r.Context())}
+			w.Header().Set("Cache-Control", "no-store")
+			s.render(w, http.StatusInternalServerError, "error.gohtml", data)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
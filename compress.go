@@ -0,0 +1,194 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressEnabled (COMPRESS=0 turns it off, e.g. behind a proxy that
+// already compresses) gzips or brotli-encodes text responses for clients
+// that accept it. Images and ZIPs are already compressed and pass through.
+type compressSettings struct {
+	compressEnabled bool
+}
+
+// compressMinBytes is the size below which a response with a known length
+// isn't worth compressing
+const compressMinBytes = 1024
+
+func (cfg *config) loadCompressConfig() {
+	switch v := os.Getenv("COMPRESS"); v {
+	case "", "1":
+	case "0":
+		cfg.compressEnabled = false
+	default:
+		log.Fatalf("invalid COMPRESS %q: want 0 or 1", v)
+	}
+}
+
+var (
+	gzipPool   = sync.Pool{New: func() any { w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression); return w }}
+	brotliPool = sync.Pool{New: func() any { return brotli.NewWriterLevel(nil, 5) }}
+)
+
+// compressible reports whether a response of the given Content-Type is
+// text worth compressing
+func compressible(contentType string) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mt, "text/"):
+		return true
+	case mt == "application/json", mt == "application/manifest+json", mt == "application/javascript",
+		mt == "application/xml", mt == "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// negotiateEncoding picks "br" or "gzip" from an Accept-Encoding header,
+// preferring brotli when both are equally acceptable, or "" for neither
+func negotiateEncoding(accept string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		q[name] = weight
+	}
+	for _, enc := range []string{"br", "gzip"} {
+		if _, ok := q[enc]; !ok {
+			if star, ok := q["*"]; ok {
+				q[enc] = star
+			}
+		}
+	}
+	switch {
+	case q["br"] > 0 && q["br"] >= q["gzip"]:
+		return "br"
+	case q["gzip"] > 0:
+		return "gzip"
+	}
+	return ""
+}
+
+// compressResponses encodes HTML, JSON and other text responses with the
+// best encoding the client accepts. The decision waits for the handler's
+// headers, so responses that set their own Content-Encoding, partial
+// content and non-text types are left alone.
+func (s *Server) compressResponses(next http.Handler) http.Handler {
+	if !s.cfg.compressEnabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: negotiateEncoding(r.Header.Get("Accept-Encoding"))}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter decides on the first WriteHeader or Write whether to
+// encode the body, then streams it through a pooled gzip or brotli writer
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string // negotiated, "" when the client accepts neither
+	wroteHeader bool
+	enc         io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.wroteHeader = true
+	h := cw.Header()
+	if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified ||
+		code == http.StatusPartialContent || h.Get("Content-Encoding") != "" || !compressible(h.Get("Content-Type")) {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if cw.encoding == "" {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < compressMinBytes {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+	// The encoded body is a different representation, so a strong ETag
+	// must not claim byte equality; checkETag ignores the W/ prefix
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	switch cw.encoding {
+	case "br":
+		bw := brotliPool.Get().(*brotli.Writer)
+		bw.Reset(cw.ResponseWriter)
+		cw.enc = bw
+	case "gzip":
+		gw := gzipPool.Get().(*gzip.Writer)
+		gw.Reset(cw.ResponseWriter)
+		cw.enc = gw
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush pushes buffered compressed data to the client
+func (cw *compressWriter) Flush() {
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Close finishes the encoded stream and returns the encoder to its pool
+func (cw *compressWriter) Close() {
+	switch enc := cw.enc.(type) {
+	case *brotli.Writer:
+		enc.Close()
+		brotliPool.Put(enc)
+	case *gzip.Writer:
+		enc.Close()
+		gzipPool.Put(enc)
+	}
+	cw.enc = nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// config is the instance-level setup: where to listen, the brand, and where
+// images, templates and assets live. Each value comes from, in increasing
+// precedence, the defaults, a TOML or JSON file (-config or CONFIG_FILE),
+// environment variables and command-line flags, so several instances can run
+// from one binary.
+type config struct {
+	Addr        string `json:"addr" toml:"addr"`                 // LISTEN_ADDR, -addr
+	SiteName    string `json:"site_name" toml:"site_name"`       // SITE_NAME, -site-name
+	ImagesRoot  string `json:"images_root" toml:"images_root"`   // IMAGES_ROOT, -images
+	TemplateDir string `json:"template_dir" toml:"template_dir"` // TEMPLATE_DIR, -templates; empty uses the embedded templates
+	AssetDir    string `json:"asset_dir" toml:"asset_dir"`       // ASSET_DIR, -assets; empty uses the embedded assets
+	CacheDir    string `json:"cache_dir" toml:"cache_dir"`       // CACHE_DIR, -cache-dir; thumbnails, variants, view counts and the like
+
+	// ShutdownTimeout (SHUTDOWN_TIMEOUT, -shutdown-timeout) is how long
+	// in-flight requests get to finish after SIGINT/SIGTERM, like "15s"
+	ShutdownTimeout string `json:"shutdown_timeout" toml:"shutdown_timeout"`
+	shutdownTimeout time.Duration
+
+	// ReadTimeout, WriteTimeout and IdleTimeout (READ_TIMEOUT, WRITE_TIMEOUT,
+	// IDLE_TIMEOUT, -read-timeout, -write-timeout, -idle-timeout) bound how
+	// long a connection may take to send its request, to receive the
+	// response, and to sit idle between requests. WriteTimeout must leave
+	// room for ZIP downloads over slow links.
+	ReadTimeout  string `json:"read_timeout" toml:"read_timeout"`
+	WriteTimeout string `json:"write_timeout" toml:"write_timeout"`
+	IdleTimeout  string `json:"idle_timeout" toml:"idle_timeout"`
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+
+	// AutocertHosts (AUTOCERT_HOSTS, -autocert-hosts) turns on built-in
+	// HTTPS: comma-separated hostnames to get Let's Encrypt certificates
+	// for. Addr is then unused; the server takes :443 and :80.
+	AutocertHosts string `json:"autocert_hosts" toml:"autocert_hosts"`
+	AutocertCache string `json:"autocert_cache" toml:"autocert_cache"` // AUTOCERT_CACHE, -autocert-cache
+	AutocertEmail string `json:"autocert_email" toml:"autocert_email"` // AUTOCERT_EMAIL, -autocert-email
+
+	envSettings
+}
+
+// envSettings are the feature settings read from the environment only,
+// once at startup (see loadEnv). Each feature file defines its part.
+type envSettings struct {
+	thumbSettings
+	formatSettings
+	watermarkSettings
+	stripSettings
+	photoInfoSettings
+	ogSettings
+	folderZipSettings
+	folderPDFSettings
+	heicSettings
+	videoSettings
+	ocrSettings
+	optimizeSettings
+	imageCheckSettings
+	hostSettings
+	scanSettings
+	adminSettings
+	corsSettings
+	compressSettings
+	securitySettings
+	rateLimitSettings
+	dirCacheSettings
+	metadataSettings
+	indexerSettings
+	similarSettings
+	trailingSlashSettings
+	timezoneSettings
+	prewarmSettings
+	paginationSettings
+	categorySettings
+	relatedSettings
+	trendingSettings
+}
+
+func defaultConfig() config {
+	return config{
+		Addr:       ":1250",
+		SiteName:   "Thai Card Store",
+		ImagesRoot: "images",
+
+		ShutdownTimeout: "15s",
+		ReadTimeout:     "15s",
+		WriteTimeout:    "2m",
+		IdleTimeout:     "60s",
+		AutocertCache:   "autocert-cache",
+		CacheDir:        "cache",
+
+		envSettings: envSettings{
+			thumbSettings:      thumbSettings{thumbMaxWidth: 400, thumbQuality: 80, thumbMemoryMB: 32},
+			formatSettings:     formatSettings{imageFormats: []string{"avif", "webp"}},
+			stripSettings:      stripSettings{stripMetadata: true},
+			ogSettings:         defaultOGSettings(),
+			folderZipSettings:  folderZipSettings{folderZipMaxMB: 200, folderZipPerHour: 20},
+			folderPDFSettings:  folderPDFSettings{folderPDFPerHour: 10},
+			heicSettings:       heicSettings{heicConvert: "jpeg"},
+			optimizeSettings:   optimizeSettings{optimizeMaxSide: 4096, optimizeQuality: 85},
+			imageCheckSettings: imageCheckSettings{imageCheckMode: imageCheckSize},
+			scanSettings:       scanSettings{scanMaxDepth: 8, scanMaxFiles: 100000},
+			corsSettings: corsSettings{
+				corsMethods:       []string{"GET", "HEAD", "OPTIONS"},
+				corsExposeHeaders: []string{"X-Request-ID"},
+				corsMaxAge:        10 * time.Minute,
+			},
+			compressSettings: compressSettings{compressEnabled: true},
+			securitySettings: securitySettings{
+				contentSecurityPolicy: fmt.Sprintf(defaultCSP, "'none'"),
+				referrerPolicy:        "strict-origin-when-cross-origin",
+				frameOptions:          "DENY",
+			},
+			dirCacheSettings:      dirCacheSettings{dirCacheEnabled: true},
+			indexerSettings:       indexerSettings{indexWorkers: max(runtime.NumCPU()/2, 1), indexInterval: 10 * time.Minute},
+			similarSettings:       similarSettings{similarDistance: 6},
+			trailingSlashSettings: trailingSlashSettings{trailingSlashRedirect: true},
+			timezoneSettings:      timezoneSettings{siteLocation: defaultLocation()},
+			prewarmSettings:       prewarmSettings{prewarmWorkers: max(runtime.NumCPU()/2, 1)},
+			paginationSettings:    paginationSettings{pageSize: 60},
+			relatedSettings:       relatedSettings{relatedStrategy: "folder"},
+			trendingSettings:      trendingSettings{trendingSize: 12},
+		},
+	}
+}
+
+// cachePath is the path of elem inside the cache directory
+func (cfg *config) cachePath(elem ...string) string {
+	return filepath.Join(append([]string{cfg.CacheDir}, elem...)...)
+}
+
+// merge overrides cfg with the non-empty fields of o
+func (cfg *config) merge(o config) {
+	set := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	set(&cfg.Addr, o.Addr)
+	set(&cfg.SiteName, o.SiteName)
+	set(&cfg.ImagesRoot, o.ImagesRoot)
+	set(&cfg.TemplateDir, o.TemplateDir)
+	set(&cfg.AssetDir, o.AssetDir)
+	set(&cfg.CacheDir, o.CacheDir)
+	set(&cfg.ShutdownTimeout, o.ShutdownTimeout)
+	set(&cfg.ReadTimeout, o.ReadTimeout)
+	set(&cfg.WriteTimeout, o.WriteTimeout)
+	set(&cfg.IdleTimeout, o.IdleTimeout)
+	set(&cfg.AutocertHosts, o.AutocertHosts)
+	set(&cfg.AutocertCache, o.AutocertCache)
+	set(&cfg.AutocertEmail, o.AutocertEmail)
+}
+
+// loadConfig builds the config from args (without the program name) and the
+// environment, feature settings included. Bad flags, an unreadable config
+// file or an invalid value are fatal.
+func loadConfig(args []string) config {
+	cfg, err := readConfig(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.loadEnv()
+	return cfg
+}
+
+// loadEnv reads the feature settings from the environment. They are read
+// once: a reload re-reads only the rest of the config (see startupEnv).
+func (cfg *config) loadEnv() {
+	cfg.loadThumbConfig()
+	cfg.loadFormatConfig()
+	cfg.loadWatermarkConfig()
+	cfg.loadStripConfig()
+	cfg.loadPhotoInfoConfig()
+	cfg.loadOGConfig()
+	cfg.loadFolderZipConfig()
+	cfg.loadFolderPDFConfig()
+	cfg.loadHEICConfig()
+	cfg.loadVideoConfig()
+	cfg.loadOCRConfig()
+	cfg.loadOptimizeConfig()
+	cfg.loadImageCheckConfig()
+	cfg.loadHostConfig()
+	cfg.loadScanConfig()
+	cfg.loadAdminConfig()
+	cfg.loadCORSConfig()
+	cfg.loadCompressConfig()
+	cfg.loadSecurityConfig()
+	cfg.loadRateLimitConfig()
+	cfg.loadDirCacheConfig()
+	cfg.loadMetadataConfig()
+	cfg.loadIndexerConfig()
+	cfg.loadSimilarConfig()
+	cfg.loadTrailingSlashConfig()
+	cfg.loadTimezoneConfig()
+	cfg.loadPrewarmConfig()
+	cfg.loadPaginationConfig()
+	cfg.loadCategoryConfig()
+	cfg.loadRelatedConfig()
+	cfg.loadTrendingConfig()
+}
+
+// readConfig is loadConfig returning errors, for reloads that must keep the
+// running config when the new one is bad. Bad flags still exit, but they
+// can't change between a start and a reload.
+func readConfig(args []string) (config, error) {
+	var flags config
+	var file string
+	fs := flag.NewFlagSet("thaicard", flag.ExitOnError)
+	fs.StringVar(&file, "config", "", "TOML or JSON config file, by extension (env CONFIG_FILE)")
+	fs.StringVar(&flags.Addr, "addr", "", "listen address (env LISTEN_ADDR, default :1250)")
+	fs.StringVar(&flags.SiteName, "site-name", "", "site name shown in titles (env SITE_NAME)")
+	fs.StringVar(&flags.ImagesRoot, "images", "", "image root of the default catalog (env IMAGES_ROOT, default images)")
+	fs.StringVar(&flags.TemplateDir, "templates", "", "template directory overriding the built-in templates (env TEMPLATE_DIR)")
+	fs.StringVar(&flags.AssetDir, "assets", "", "directory holding static/ and the app icons, overriding the built-in icons (env ASSET_DIR)")
+	fs.StringVar(&flags.CacheDir, "cache-dir", "", "directory for generated files: thumbnails, variants, view counts (env CACHE_DIR, default cache)")
+	fs.StringVar(&flags.ShutdownTimeout, "shutdown-timeout", "", "how long to drain requests on shutdown (env SHUTDOWN_TIMEOUT, default 15s)")
+	fs.StringVar(&flags.ReadTimeout, "read-timeout", "", "limit for reading a request (env READ_TIMEOUT, default 15s)")
+	fs.StringVar(&flags.WriteTimeout, "write-timeout", "", "limit for writing a response (env WRITE_TIMEOUT, default 2m)")
+	fs.StringVar(&flags.IdleTimeout, "idle-timeout", "", "how long idle keep-alive connections stay open (env IDLE_TIMEOUT, default 60s)")
+	fs.StringVar(&flags.AutocertHosts, "autocert-hosts", "", "serve HTTPS with Let's Encrypt certificates for these comma-separated hosts (env AUTOCERT_HOSTS)")
+	fs.StringVar(&flags.AutocertCache, "autocert-cache", "", "certificate cache directory (env AUTOCERT_CACHE, default autocert-cache)")
+	fs.StringVar(&flags.AutocertEmail, "autocert-email", "", "contact email for Let's Encrypt (env AUTOCERT_EMAIL)")
+	fs.Parse(args)
+
+	cfg := defaultConfig()
+	if file == "" {
+		file = os.Getenv("CONFIG_FILE")
+	}
+	if file != "" {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return config{}, fmt.Errorf("error reading config file: %w", err)
+		}
+		fromFile, err := parseConfigFile(file, raw)
+		if err != nil {
+			return config{}, fmt.Errorf("error parsing config file %s: %w", file, err)
+		}
+		cfg.merge(fromFile)
+	}
+	cfg.merge(config{
+		Addr:        os.Getenv("LISTEN_ADDR"),
+		SiteName:    os.Getenv("SITE_NAME"),
+		ImagesRoot:  os.Getenv("IMAGES_ROOT"),
+		TemplateDir: os.Getenv("TEMPLATE_DIR"),
+		AssetDir:    os.Getenv("ASSET_DIR"),
+		CacheDir:    os.Getenv("CACHE_DIR"),
+
+		ShutdownTimeout: os.Getenv("SHUTDOWN_TIMEOUT"),
+		ReadTimeout:     os.Getenv("READ_TIMEOUT"),
+		WriteTimeout:    os.Getenv("WRITE_TIMEOUT"),
+		IdleTimeout:     os.Getenv("IDLE_TIMEOUT"),
+		AutocertHosts:   os.Getenv("AUTOCERT_HOSTS"),
+		AutocertCache:   os.Getenv("AUTOCERT_CACHE"),
+		AutocertEmail:   os.Getenv("AUTOCERT_EMAIL"),
+	})
+	cfg.merge(flags)
+
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		return config{}, fmt.Errorf("invalid listen address %q: want host:port or :port", cfg.Addr)
+	}
+	for _, d := range []struct {
+		name string
+		v    string
+		dst  *time.Duration
+	}{
+		{"shutdown timeout", cfg.ShutdownTimeout, &cfg.shutdownTimeout},
+		{"read timeout", cfg.ReadTimeout, &cfg.readTimeout},
+		{"write timeout", cfg.WriteTimeout, &cfg.writeTimeout},
+		{"idle timeout", cfg.IdleTimeout, &cfg.idleTimeout},
+	} {
+		v, err := time.ParseDuration(d.v)
+		if err != nil || v < 0 {
+			return config{}, fmt.Errorf("invalid %s %q: want a duration like 15s", d.name, d.v)
+		}
+		*d.dst = v
+	}
+	return cfg, nil
+}
+
+// parseConfigFile decodes a config file: TOML when its name ends in .toml,
+// JSON otherwise. Unknown keys are errors in both, so typos don't go
+// unnoticed.
+func parseConfigFile(name string, raw []byte) (config, error) {
+	var cfg config
+	if strings.EqualFold(filepath.Ext(name), ".toml") {
+		md, err := toml.Decode(string(raw), &cfg)
+		if err != nil {
+			return config{}, err
+		}
+		if keys := md.Undecoded(); len(keys) > 0 {
+			return config{}, fmt.Errorf("unknown key %q", keys[0].String())
+		}
+		return cfg, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return config{}, err
+	}
+	return cfg, nil
+}
+
+// applyTimeouts sets the configured connection timeouts on s. Zero turns a
+// limit off. Headers always get 10s so a stalled client can't hold a
+// connection even with the read timeout off.
+func (cfg config) applyTimeouts(s *http.Server) *http.Server {
+	s.ReadHeaderTimeout = 10 * time.Second
+	s.ReadTimeout = cfg.readTimeout
+	s.WriteTimeout = cfg.writeTimeout
+	s.IdleTimeout = cfg.idleTimeout
+	return s
+}
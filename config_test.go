@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestParseConfigFile(t *testing.T) {
+	for _, tc := range []struct {
+		name, raw string
+		site      string
+		ok        bool
+	}{
+		{"b.toml", "addr = \":8081\"\nsite_name = \"Store B\"\n", "Store B", true},
+		{"b.TOML", "site_name = 'Store B'", "Store B", true},
+		{"b.json", `{"addr": ":8081", "site_name": "Store B"}`, "Store B", true},
+		{"b.toml", "sitename = \"Store B\"\n", "", false},
+		{"b.json", `{"sitename": "Store B"}`, "", false},
+		{"b.toml", `{"site_name": "Store B"}`, "", false},
+	} {
+		cfg, err := parseConfigFile(tc.name, []byte(tc.raw))
+		if (err == nil) != tc.ok {
+			t.Errorf("%s %q: err %v, want ok %v", tc.name, tc.raw, err, tc.ok)
+			continue
+		}
+		if cfg.SiteName != tc.site {
+			t.Errorf("%s %q: site name %q, want %q", tc.name, tc.raw, cfg.SiteName, tc.site)
+		}
+	}
+}
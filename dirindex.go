@@ -0,0 +1,306 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// dirCacheSettings: dirCacheEnabled (DIR_CACHE=0 turns it off, e.g. for
+// network mounts that don't deliver change notifications) keeps folder and
+// image listings in memory and drops them when fsnotify reports a change.
+type dirCacheSettings struct {
+	dirCacheEnabled bool
+}
+
+func (cfg *config) loadDirCacheConfig() {
+	switch v := os.Getenv("DIR_CACHE"); v {
+	case "", "1":
+	case "0":
+		cfg.dirCacheEnabled = false
+	default:
+		log.Fatalf("invalid DIR_CACHE %q: want 0 or 1", v)
+	}
+}
+
+// dirIndex holds the listings of listImages and listDailyFolders by
+// directory, and the background indexer's facts about each image file.
+// Only watched directories are served from it, so nothing is used after a
+// change the watcher can't see. gen counts invalidations: a scan that
+// overlapped one is not stored, since it may predate the change.
+var dirIndex = struct {
+	sync.Mutex
+	watcher    *fsnotify.Watcher
+	watched    map[string]bool
+	containers map[string]bool // catalog roots and daily bases, whose new subdirectories get watched too
+	images     map[string][]string
+	folders    map[string][]DailyFolder
+	sidecars   map[string]map[string]sidecar // captions by dir, then image name
+	facts      map[string]imageFacts         // by image path
+	gen        uint64
+}{
+	watched:    map[string]bool{},
+	containers: map[string]bool{},
+	images:     map[string][]string{},
+	folders:    map[string][]DailyFolder{},
+	sidecars:   map[string]map[string]sidecar{},
+	facts:      map[string]imageFacts{},
+}
+
+// imageFacts is what the indexer records about one image file
+type imageFacts struct {
+	size          int64
+	mod           time.Time
+	width, height int       // as displayed, after the EXIF orientation
+	taken         time.Time // EXIF capture time; zero when unknown
+	sum           string    // hex SHA-256
+	phash         uint64    // perceptualHash, when hashed
+	hashed        bool
+	preview       string // previewDataURI, when decoded and opaque
+	broken        string // why the image failed to decode; "" when it didn't
+	numbers       string // read by ocr, space separated
+}
+
+// indexGen returns the invalidation count to pass to storeFacts
+func indexGen() uint64 {
+	dirIndex.Lock()
+	defer dirIndex.Unlock()
+	return dirIndex.gen
+}
+
+// storeFacts records facts about path gathered since generation gen
+func storeFacts(path string, f imageFacts, gen uint64) {
+	dirIndex.Lock()
+	defer dirIndex.Unlock()
+	if dirIndex.gen == gen {
+		dirIndex.facts[path] = f
+	}
+}
+
+// cachedFacts returns the indexed facts about path, which may be stale when
+// its directory isn't watched
+func cachedFacts(path string) (imageFacts, bool) {
+	dirIndex.Lock()
+	defer dirIndex.Unlock()
+	f, ok := dirIndex.facts[path]
+	return f, ok
+}
+
+// pruneFacts drops the facts of images not in keep
+func pruneFacts(keep map[string]bool) {
+	dirIndex.Lock()
+	defer dirIndex.Unlock()
+	for p := range dirIndex.facts {
+		if !keep[p] {
+			delete(dirIndex.facts, p)
+		}
+	}
+}
+
+// imageStat returns the size and modtime of an image, from the index when
+// its directory is watched and from the file otherwise, so request
+// handlers sorting or totalling a folder don't stat every file
+func (c *catalog) imageStat(path string) (size int64, mod time.Time, err error) {
+	dirIndex.Lock()
+	f, ok := dirIndex.facts[path]
+	ok = ok && dirIndex.watched[filepath.Dir(path)]
+	dirIndex.Unlock()
+	if ok {
+		return f.size, f.mod, nil
+	}
+	info, err := c.fs.Stat(path)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return info.Size(), info.ModTime(), nil
+}
+
+// cachedImages returns a copy of the cached listImages result for dir and
+// the generation to pass to storeImages after a miss
+func cachedImages(dir string) ([]string, bool, uint64) {
+	dirIndex.Lock()
+	defer dirIndex.Unlock()
+	imgs, ok := dirIndex.images[filepath.Clean(dir)]
+	return slices.Clone(imgs), ok, dirIndex.gen
+}
+
+// storeImages caches a complete listing of dir scanned at generation gen
+func storeImages(dir string, imgs []string, gen uint64) {
+	dir = filepath.Clean(dir)
+	dirIndex.Lock()
+	defer dirIndex.Unlock()
+	if dirIndex.watched[dir] && dirIndex.gen == gen {
+		dirIndex.images[dir] = slices.Clone(imgs)
+	}
+}
+
+// cachedFolders and storeFolders are cachedImages and storeImages for the
+// folder list of a daily base
+func cachedFolders(base string) ([]DailyFolder, bool, uint64) {
+	dirIndex.Lock()
+	defer dirIndex.Unlock()
+	folders, ok := dirIndex.folders[filepath.Clean(base)]
+	return slices.Clone(folders), ok, dirIndex.gen
+}
+
+func storeFolders(base string, folders []DailyFolder, gen uint64) {
+	base = filepath.Clean(base)
+	dirIndex.Lock()
+	defer dirIndex.Unlock()
+	if dirIndex.watched[base] && dirIndex.gen == gen {
+		dirIndex.folders[base] = slices.Clone(folders)
+	}
+}
+
+// cachedSidecars returns the cached captions of dir, if any
+func cachedSidecars(dir string) (map[string]sidecar, bool, uint64) {
+	dirIndex.Lock()
+	defer dirIndex.Unlock()
+	s, ok := dirIndex.sidecars[filepath.Clean(dir)]
+	return s, ok, dirIndex.gen
+}
+
+// storeSidecars caches the captions of dir read at generation gen. The
+// map is shared, so callers must not modify it.
+func storeSidecars(dir string, s map[string]sidecar, gen uint64) {
+	dir = filepath.Clean(dir)
+	dirIndex.Lock()
+	defer dirIndex.Unlock()
+	if dirIndex.watched[dir] && dirIndex.gen == gen {
+		dirIndex.sidecars[dir] = s
+	}
+}
+
+// clearDirIndex drops every cached listing and indexed image and returns
+// how many listings there were
+func clearDirIndex() int {
+	dirIndex.Lock()
+	defer dirIndex.Unlock()
+	n := len(dirIndex.images) + len(dirIndex.folders)
+	dirIndex.images = map[string][]string{}
+	dirIndex.folders = map[string][]DailyFolder{}
+	dirIndex.sidecars = map[string]map[string]sidecar{}
+	dirIndex.facts = map[string]imageFacts{}
+	dirIndex.gen++
+	return n
+}
+
+// watchCatalog starts watching the directories c's listings read: the
+// root, daily/ with each folder in it, and the categories. New top-level
+// directories are watched as they appear, so categories added later are
+// cached too. Errors, such as running out of inotify watches, only mean
+// those directories aren't cached.
+func (c *catalog) watchCatalog() {
+	if !c.cfg.dirCacheEnabled {
+		return
+	}
+	dirIndex.Lock()
+	defer dirIndex.Unlock()
+	if dirIndex.watcher == nil {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			slog.Warn("directory cache disabled: no file watcher", "err", err)
+			return
+		}
+		dirIndex.watcher = w
+		go watchLoop(w)
+	}
+	root := filepath.Clean(c.Root)
+	daily := filepath.Clean(c.dir("daily"))
+	dirIndex.containers[root] = true
+	dirIndex.containers[daily] = true
+	addWatchLocked(root)
+	addWatchLocked(daily)
+	for _, cat := range c.categories() {
+		addWatchLocked(c.dir(cat.Name))
+	}
+	entries, _ := os.ReadDir(daily)
+	for _, e := range entries {
+		if e.IsDir() {
+			addWatchLocked(filepath.Join(daily, e.Name()))
+		}
+	}
+}
+
+func addWatchLocked(dir string) {
+	dir = filepath.Clean(dir)
+	if dirIndex.watched[dir] {
+		return
+	}
+	if err := dirIndex.watcher.Add(dir); err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("not caching directory: watch failed", "dir", dir, "err", err)
+		}
+		return
+	}
+	dirIndex.watched[dir] = true
+}
+
+// watchLoop applies change events to the cache until the watcher closes
+func watchLoop(w *fsnotify.Watcher) {
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			invalidateDir(ev)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been dropped, so nothing cached can be trusted
+			slog.Warn("file watcher error, clearing directory cache", "err", err)
+			clearDirIndex()
+		}
+	}
+}
+
+// watchIndexDelay is how long changes seen by the watcher settle, so a
+// sync of many files asks for one index round rather than one each
+const watchIndexDelay = 2 * time.Second
+
+// watchIndexTimer requests that round; guarded by dirIndex's lock
+var watchIndexTimer *time.Timer
+
+// invalidateDir drops the listings an event can affect: the changed path
+// itself when it is a directory, the directory it is in, and that
+// directory's parent, whose folder list carries titles and hidden markers
+// read from inside each folder. New folders in a container get watched;
+// removed or renamed ones stop being cached. An index round follows once
+// changes settle, which refreshes the search index too.
+func invalidateDir(ev fsnotify.Event) {
+	path := filepath.Clean(ev.Name)
+	parent := filepath.Dir(path)
+	dirIndex.Lock()
+	defer dirIndex.Unlock()
+	dirIndex.gen++
+	if watchIndexTimer == nil {
+		watchIndexTimer = time.AfterFunc(watchIndexDelay, requestIndexing)
+	} else {
+		watchIndexTimer.Reset(watchIndexDelay)
+	}
+	delete(dirIndex.facts, path)
+	for _, p := range []string{path, parent, filepath.Dir(parent)} {
+		delete(dirIndex.images, p)
+		delete(dirIndex.folders, p)
+		delete(dirIndex.sidecars, p)
+	}
+	switch {
+	case ev.Has(fsnotify.Create) && dirIndex.containers[parent]:
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			addWatchLocked(path)
+		}
+	case ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename):
+		if dirIndex.watched[path] {
+			dirIndex.watcher.Remove(path)
+			delete(dirIndex.watched, path)
+		}
+	}
+}
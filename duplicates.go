@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// contentHashes caches the SHA-256 of each image's bytes. Like
+// imageVerdicts, entries are revalidated when size or modtime change, so
+// only new or edited files are read again.
+var contentHashes = struct {
+	sync.Mutex
+	m map[string]contentHash
+}{m: map[string]contentHash{}}
+
+type contentHash struct {
+	size int64
+	mod  time.Time
+	sum  string
+}
+
+// hashImage returns the hex SHA-256 of the file at path in fsys, from the
+// cache when the file is unchanged
+func hashImage(fsys storage, path string, info os.FileInfo) (string, error) {
+	contentHashes.Lock()
+	h, ok := contentHashes.m[path]
+	contentHashes.Unlock()
+	if ok && h.size == info.Size() && h.mod.Equal(info.ModTime()) {
+		return h.sum, nil
+	}
+
+	f, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sha := sha256.New()
+	if _, err := io.Copy(sha, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(sha.Sum(nil))
+	contentHashes.Lock()
+	contentHashes.m[path] = contentHash{size: info.Size(), mod: info.ModTime(), sum: sum}
+	contentHashes.Unlock()
+	return sum, nil
+}
+
+// duplicateGroup is one set of files with identical bytes
+type duplicateGroup struct {
+	Hash  string   `json:"hash"`
+	Size  int64    `json:"size"`
+	Files []string `json:"files"`
+}
+
+// duplicatesAPIHandler reports groups of images in the catalog that share a
+// content hash. The first run reads every file; later runs only hash what
+// changed.
+func (c *catalog) duplicatesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method == http.MethodHead {
+		// Hashing the whole catalog is far too much work for a HEAD
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		return
+	}
+	byHash := map[string]*duplicateGroup{}
+	for _, img := range c.getAllImagesRecursive(ctx, c.Root) {
+		if ctx.Err() != nil {
+			return // client went away; stop hashing
+		}
+		info, err := c.fs.Stat(img)
+		if err != nil {
+			continue
+		}
+		sum, err := hashImage(c.fs, img, info)
+		if err != nil {
+			slog.Warn("duplicates: hashing failed", "path", img, "err", err)
+			continue
+		}
+		g := byHash[sum]
+		if g == nil {
+			g = &duplicateGroup{Hash: sum, Size: info.Size()}
+			byHash[sum] = g
+		}
+		g.Files = append(g.Files, c.imageURL(img))
+	}
+
+	groups := []duplicateGroup{}
+	for _, g := range byHash {
+		if len(g.Files) > 1 {
+			groups = append(groups, *g)
+		}
+	}
+	// Biggest wasted space first
+	sort.Slice(groups, func(i, j int) bool {
+		wi := groups[i].Size * int64(len(groups[i].Files)-1)
+		wj := groups[j].Size * int64(len(groups[j].Files)-1)
+		if wi != wj {
+			return wi > wj
+		}
+		return groups[i].Files[0] < groups[j].Files[0]
+	})
+	writeJSON(w, groups)
+}
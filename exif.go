@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"strings"
+	"time"
+)
+
+// exifOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 when r
+// isn't a JPEG or carries no orientation tag
+func exifOrientation(r io.Reader) int {
+	return readExif(r, time.UTC).orientation
+}
+
+// orientedSize returns the dimensions of cfg as displayed: orientations 5-8
+// turn the image a quarter
+func orientedSize(cfg image.Config, orientation int) (width, height int) {
+	if orientation >= 5 {
+		return cfg.Height, cfg.Width
+	}
+	return cfg.Width, cfg.Height
+}
+
+// exifInfo is what the site uses of a JPEG's EXIF data. GPS position and
+// camera details are deliberately not read.
+type exifInfo struct {
+	orientation int       // 1-8
+	taken       time.Time // DateTimeOriginal in the site's location; zero when absent
+}
+
+// readExifFile reads the EXIF data of the image at path in fsys, taking its
+// times to be in loc
+func readExifFile(fsys storage, path string, loc *time.Location) exifInfo {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return exifInfo{orientation: 1}
+	}
+	defer f.Close()
+	return readExif(f, loc)
+}
+
+// readExif reads the EXIF data of a JPEG, whose times carry no zone and are
+// taken to be in loc. Only the APP1 segment is read, never the image data.
+func readExif(r io.Reader, loc *time.Location) exifInfo {
+	none := exifInfo{orientation: 1}
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return none
+	}
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(br, marker[:]); err != nil || marker[0] != 0xFF {
+			return none
+		}
+		size := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if size < 0 {
+			return none
+		}
+		switch marker[1] {
+		case 0xE1: // APP1
+			seg := make([]byte, size)
+			if _, err := io.ReadFull(br, seg); err != nil {
+				return none
+			}
+			if bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+				return parseTIFF(seg[6:], loc)
+			}
+		case 0xDA, 0xD9: // start of scan or end of image: no EXIF ahead
+			return none
+		default:
+			if _, err := br.Discard(size); err != nil {
+				return none
+			}
+		}
+	}
+}
+
+// EXIF tags read by parseTIFF
+const (
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+)
+
+// exifTime is the layout of EXIF date tags
+const exifTime = "2006:01:02 15:04:05"
+
+// parseTIFF reads the orientation from IFD0 and the capture time from the
+// Exif IFD of a TIFF header, falling back to IFD0's modification time,
+// both in loc
+func parseTIFF(b []byte, loc *time.Location) exifInfo {
+	info := exifInfo{orientation: 1}
+	if len(b) < 8 {
+		return info
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return info
+	}
+	ifd0 := tiffIFD(b, order, int(order.Uint32(b[4:])))
+	if e, ok := ifd0[tagOrientation]; ok {
+		if o := int(order.Uint16(e[8:])); o >= 1 && o <= 8 {
+			info.orientation = o
+		}
+	}
+	date := tiffString(b, order, ifd0[tagDateTime])
+	if e, ok := ifd0[tagExifIFD]; ok {
+		if s := tiffString(b, order, tiffIFD(b, order, int(order.Uint32(e[8:])))[tagDateTimeOriginal]); s != "" {
+			date = s
+		}
+	}
+	if t, err := time.ParseInLocation(exifTime, date, loc); err == nil && t.Year() > 1900 {
+		info.taken = t
+	}
+	return info
+}
+
+// tiffIFD returns the 12-byte entries of the IFD at offset by tag
+func tiffIFD(b []byte, order binary.ByteOrder, offset int) map[uint16][]byte {
+	if offset < 8 || offset+2 > len(b) {
+		return nil
+	}
+	entries := map[uint16][]byte{}
+	n := int(order.Uint16(b[offset:]))
+	for i := 0; i < n; i++ {
+		e := offset + 2 + i*12
+		if e+12 > len(b) {
+			break
+		}
+		entries[order.Uint16(b[e:])] = b[e : e+12]
+	}
+	return entries
+}
+
+// tiffString returns the value of an ASCII entry, without its NUL
+func tiffString(b []byte, order binary.ByteOrder, e []byte) string {
+	if e == nil || order.Uint16(e[2:]) != 2 { // type 2 is ASCII
+		return ""
+	}
+	n := int(order.Uint32(e[4:]))
+	value := e[8:12]
+	if n > 4 {
+		offset := int(order.Uint32(e[8:]))
+		if offset < 0 || offset+n > len(b) {
+			return ""
+		}
+		value = b[offset : offset+n]
+	} else {
+		value = value[:n]
+	}
+	return strings.TrimRight(string(value), "\x00 ")
+}
+
+// applyOrientation rotates and flips img so it displays upright for the
+// given EXIF orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Orientations 5-8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirror horizontal
+				dx, dy = w-1-x, y
+			case 3: // rotate 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirror vertical
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// folderConfigNames are the optional per-folder settings files, e.g.
+// {"title": "January draws", "description": "...", "sort": "newest"}, in
+// order of preference. meta.json is the same file under the name some
+// upload tools write.
+var folderConfigNames = []string{"folder.json", "meta.json"}
+
+// folderConfig holds the display settings of one folder. Zero values keep
+// today's behaviour: the directory name as title and name order.
+type folderConfig struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Sort        string `json:"sort"`
+	Date        string `json:"date"`  // display date, YYYY-MM-DD
+	Cover       string `json:"cover"` // file name of an image in the folder
+}
+
+// Image sort modes. sortName is alphabetical with order.txt applied;
+// sortSize puts the largest files first. Images pinned in order.txt lead
+// in every mode.
+const (
+	sortName   = "name"
+	sortNewest = "newest"
+	sortOldest = "oldest"
+	sortSize   = "size"
+)
+
+var sortModes = map[string]bool{sortName: true, sortNewest: true, sortOldest: true, sortSize: true}
+
+// folderConfigWarned remembers broken folder.json files by path and modtime
+// so each bad version is logged once, not on every listing
+var folderConfigWarned sync.Map
+
+// readFolderConfig loads the first of folderConfigNames found in dir. A
+// missing file yields the zero config; a malformed one is logged and
+// ignored.
+func (c *catalog) readFolderConfig(dir string) folderConfig {
+	var p string
+	var raw []byte
+	for _, name := range folderConfigNames {
+		var err error
+		p = filepath.Join(dir, name)
+		if raw, err = c.fs.ReadFile(p); err == nil {
+			break
+		}
+	}
+	if raw == nil {
+		return folderConfig{}
+	}
+	var cfg folderConfig
+	err := json.Unmarshal(raw, &cfg)
+	switch {
+	case err != nil:
+	case cfg.Sort != "" && !sortModes[cfg.Sort]:
+		err = errInvalidSort
+	case cfg.Date != "":
+		if _, dateErr := time.Parse(time.DateOnly, cfg.Date); dateErr != nil {
+			err = errInvalidDate
+		}
+	}
+	if err == nil && cfg.Cover != "" && (filepath.Base(cfg.Cover) != cfg.Cover || !isMediaName(cfg.Cover)) {
+		err = errInvalidCover
+	}
+	if err != nil {
+		key := p
+		if info, statErr := c.fs.Stat(p); statErr == nil {
+			key += "|" + info.ModTime().String()
+		}
+		if _, loaded := folderConfigWarned.LoadOrStore(key, true); !loaded {
+			slog.Warn("ignoring folder config", "path", p, "err", err)
+		}
+		return folderConfig{}
+	}
+	return cfg
+}
+
+var (
+	errInvalidSort  = errors.New("sort must be name, newest, oldest or size")
+	errInvalidDate  = errors.New("date must look like 2024-06-01")
+	errInvalidCover = errors.New("cover must be the file name of an image in the folder")
+)
+
+// requestSort returns the sort param of r, or def (the folder's configured
+// order) when there is none
+func requestSort(r *http.Request, def string) (string, error) {
+	mode := r.URL.Query().Get("sort")
+	if mode == "" {
+		return def, nil
+	}
+	if !sortModes[mode] {
+		return "", errInvalidSort
+	}
+	return mode, nil
+}
+
+// sortImages orders imgs (as returned by listImages) by mode. Name order is
+// what listImages already produced; the other orders are stable so ties
+// keep that order, and they keep pinned images in front.
+func (c *catalog) sortImages(imgs []string, mode string) []string {
+	if mode != sortNewest && mode != sortOldest && mode != sortSize {
+		return imgs
+	}
+	pinned := map[string]bool{}
+	pinsRead := map[string]bool{}
+	for _, img := range imgs {
+		dir := path.Dir(img)
+		if !pinsRead[dir] {
+			pinsRead[dir] = true
+			_, pins := c.readOrderFile(filepath.FromSlash(dir))
+			for name := range pins {
+				pinned[path.Join(dir, name)] = true
+			}
+		}
+	}
+	mod := make(map[string]time.Time, len(imgs))
+	size := make(map[string]int64, len(imgs))
+	for _, img := range imgs {
+		if n, mt, err := c.imageStat(img); err == nil {
+			mod[img], size[img] = mt, n
+		}
+	}
+	sort.SliceStable(imgs, func(i, j int) bool {
+		if pinned[imgs[i]] != pinned[imgs[j]] {
+			return pinned[imgs[i]]
+		}
+		switch mode {
+		case sortNewest:
+			return mod[imgs[i]].After(mod[imgs[j]])
+		case sortOldest:
+			return mod[imgs[i]].Before(mod[imgs[j]])
+		}
+		return size[imgs[i]] > size[imgs[j]]
+	})
+	return imgs
+}
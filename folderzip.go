@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// /download/daily/<folder>.zip archives a whole daily folder. Archives are
+// capped at folderZipMaxMB (FOLDER_ZIP_MAX_MB, default 200; 0 turns folder
+// ZIPs off) and maxFolderZipFiles images, and each client IP may start
+// folderZipPerHour (FOLDER_ZIP_PER_HOUR, default 20; 0 for no limit) of
+// them an hour, counted by the server's folderZips limiter.
+type folderZipSettings struct {
+	folderZipMaxMB   int
+	folderZipPerHour float64
+}
+
+// maxFolderZipFiles caps how many images one folder ZIP may contain
+const maxFolderZipFiles = 1000
+
+func (cfg *config) loadFolderZipConfig() {
+	if v := os.Getenv("FOLDER_ZIP_MAX_MB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 10240 {
+			log.Fatalf("invalid FOLDER_ZIP_MAX_MB %q: want 0-10240, 0 to turn folder ZIPs off", v)
+		}
+		cfg.folderZipMaxMB = n
+	}
+	if v := os.Getenv("FOLDER_ZIP_PER_HOUR"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || math.IsInf(f, 0) {
+			log.Fatalf("invalid FOLDER_ZIP_PER_HOUR %q: want a non-negative number, 0 for no limit", v)
+		}
+		cfg.folderZipPerHour = f
+	}
+}
+
+// folderZipEnabled reports whether folder pages offer a ZIP of the folder
+func (cfg *config) folderZipEnabled() bool {
+	return cfg.folderZipMaxMB > 0
+}
+
+// folderZipHandler streams a ZIP of every image of a visible daily folder,
+// named <folder>/<file> inside the archive. It also routes the folder's
+// PDF.
+func (c *catalog) folderZipHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, ".pdf") {
+		c.folderPDFHandler(w, r)
+		return
+	}
+	folder, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/download/daily/"), ".zip")
+	if !ok || !c.cfg.folderZipEnabled() || !safeFolderRe.MatchString(folder) {
+		http.NotFound(w, r)
+		return
+	}
+	dir := c.dir("daily", folder)
+	if info, err := c.fs.Stat(dir); err != nil || !info.IsDir() || c.folderHidden(dir) {
+		http.NotFound(w, r)
+		return
+	}
+	imgs := c.listImages(r.Context(), dir)
+	if len(imgs) == 0 {
+		http.Error(w, "folder has no images", http.StatusNotFound)
+		return
+	}
+	if len(imgs) > maxFolderZipFiles {
+		http.Error(w, fmt.Sprintf("folder too large to download at once: max %d files", maxFolderZipFiles), http.StatusRequestEntityTooLarge)
+		return
+	}
+	maxBytes := int64(c.cfg.folderZipMaxMB) << 20
+	// The originals' sizes are a close enough first check, before any
+	// stamped or stripped copies are made
+	var total int64
+	files := make([]zipFile, 0, len(imgs))
+	for _, img := range imgs {
+		info, err := c.fs.Stat(img)
+		if err != nil {
+			continue // gone since listing
+		}
+		total += info.Size()
+		files = append(files, zipFile{FS: c.fs, Path: img, Name: folder + "/" + filepath.Base(img)})
+	}
+	if total > maxBytes {
+		http.Error(w, fmt.Sprintf("folder too large to download at once: max %d MB", c.cfg.folderZipMaxMB), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if l := c.srv.folderZips; l != nil {
+		if ok, wait := l.take(c.cfg.clientIP(r), 1, 1); !ok {
+			metrics.Lock()
+			metrics.rateLimited["folder_zip"]++
+			metrics.Unlock()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			httpError(w, r, "too many folder downloads, try again later", http.StatusTooManyRequests)
+			return
+		}
+	}
+	if err := c.usePublicCopies(files); err != nil {
+		slog.Warn("folder zip: public copy failed", "folder", folder, "err", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	serveZip(w, files, folder+".zip")
+}
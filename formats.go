@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/webp"
+)
+
+// formatSettings holds imageFormats (IMAGE_FORMATS, default avif,webp): the
+// formats originals and thumbnails are also served in, most preferred first,
+// to clients whose Accept header lists them; none turns this off. Variants
+// are encoded once in the background and cached next to the thumbnails:
+// until one is ready, and when it turns out no smaller, the original format
+// is served.
+type formatSettings struct {
+	imageFormats []string
+}
+
+func (cfg *config) loadFormatConfig() {
+	v := os.Getenv("IMAGE_FORMATS")
+	switch v {
+	case "":
+		return
+	case "none":
+		cfg.imageFormats = nil
+		return
+	}
+	cfg.imageFormats = nil
+	for _, f := range strings.Split(v, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if (f != "avif" && f != "webp") || slices.Contains(cfg.imageFormats, f) {
+			log.Fatalf("invalid IMAGE_FORMATS %q: want a list of avif and webp, or none", v)
+		}
+		cfg.imageFormats = append(cfg.imageFormats, f)
+	}
+}
+
+// Encoder qualities, chosen to look about like a JPEG at THUMB_QUALITY 80
+// while being 30-50% smaller
+const (
+	avifQuality = 50
+	webpQuality = 75
+)
+
+// negotiateFormat returns the first of imageFormats the request accepts,
+// or "" for the original format. The response varies on Accept either way.
+func (c *catalog) negotiateFormat(w http.ResponseWriter, r *http.Request) string {
+	if len(c.cfg.imageFormats) == 0 {
+		return ""
+	}
+	varyAccept(w.Header())
+	for _, f := range c.cfg.imageFormats {
+		if accepts(r, "image/"+f) {
+			return f
+		}
+	}
+	return ""
+}
+
+// varyAccept adds Accept to the Vary header unless it is already there
+func varyAccept(h http.Header) {
+	if !slices.Contains(h.Values("Vary"), "Accept") {
+		h.Add("Vary", "Accept")
+	}
+}
+
+// variantName is the cache file name of the format variant of the image
+// whose thumbnail cache key is base
+func variantName(base, format string) string {
+	return base + "." + format
+}
+
+// cachedVariant returns the cached variant name. ok is false when there is
+// none yet; data is empty when the variant was tried and isn't worth
+// serving.
+func (c *catalog) cachedVariant(name string) (data []byte, ok bool) {
+	if data, ok := c.srv.thumbs.Get(name); ok {
+		return data, true
+	}
+	data, err := os.ReadFile(c.cfg.cachePath(thumbCacheDir, name))
+	if err != nil {
+		return nil, false
+	}
+	if len(data) > 0 {
+		c.srv.thumbs.Add(name, data)
+	}
+	return data, true
+}
+
+// serveVariant writes the cached variant name. It is validated by an ETag
+// rather than the source's modtime: a client holding the original format
+// under that modtime must get the variant, not a 304.
+func serveVariant(w http.ResponseWriter, r *http.Request, name, format string, data []byte) {
+	w.Header().Set("Content-Type", "image/"+format)
+	w.Header().Set("ETag", `"`+name[:32]+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// variantJob is one variant waiting to be encoded
+type variantJob struct {
+	c                   *catalog // the image's catalog, whose settings it is rendered with
+	name                string   // cache file name
+	fullPath            string
+	maxWidth, maxHeight int // 0 and 0 for the original size
+	fit                 string
+	format              string
+	fallbackSize        int // bytes of what is served instead; a variant must beat it
+}
+
+// variantQueue feeds a server's variantLoop; pending keeps an image that is
+// requested again before its turn from being queued twice
+type variantQueue struct {
+	jobs    chan variantJob
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func newVariantQueue() *variantQueue {
+	return &variantQueue{jobs: make(chan variantJob, 1024), pending: map[string]bool{}}
+}
+
+// queueVariant asks for job to be encoded. A full queue drops it; the next
+// request for the image queues it again.
+func (c *catalog) queueVariant(job variantJob) {
+	q := c.srv.variants
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending[job.name] {
+		return
+	}
+	select {
+	case q.jobs <- job:
+		q.pending[job.name] = true
+	default:
+	}
+}
+
+// variantLoop encodes queued variants one at a time, AVIF and WebP encoding
+// being slow and CPU-heavy, until ctx is cancelled
+func (s *Server) variantLoop(ctx context.Context) {
+	q := s.variants
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-q.jobs:
+			encodeVariantJob(job)
+			q.mu.Lock()
+			delete(q.pending, job.name)
+			q.mu.Unlock()
+		}
+	}
+}
+
+// encodeVariantJob encodes and caches one variant. A failure or a variant
+// no smaller than the fallback is cached as an empty file, so the image
+// isn't tried again until it changes.
+func encodeVariantJob(job variantJob) {
+	img, err := job.c.renderImage(job.fullPath, job.maxWidth, job.maxHeight, job.fit)
+	var data []byte
+	if err == nil {
+		data, err = encodeVariant(img, job.format)
+	}
+	if err != nil {
+		slog.Warn("image variant failed", "path", job.fullPath, "format", job.format, "err", err)
+		data = nil
+	} else if len(data) >= job.fallbackSize {
+		slog.Debug("image variant not smaller", "path", job.fullPath, "format", job.format, "size", len(data), "fallback", job.fallbackSize)
+		data = nil
+	}
+	cachePath := job.c.cfg.cachePath(thumbCacheDir, job.name)
+	if err := writeFileAtomic(cachePath, data); err != nil {
+		slog.Warn("image variant cache write", "path", cachePath, "err", err)
+	}
+}
+
+// encodeVariant encodes img in format
+func encodeVariant(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "avif":
+		err = avif.Encode(&buf, img, avif.Options{Quality: avifQuality, Speed: 8})
+	case "webp":
+		err = webp.Encode(&buf, img, webp.Options{Quality: webpQuality, Method: 4})
+	default:
+		err = fmt.Errorf("unknown image format %q", format)
+	}
+	return buf.Bytes(), err
+}
+
+// formatVariants wraps the /images/ file server of c so JPEG and PNG
+// originals are answered with a cached AVIF or WebP variant to clients that
+// accept one. Other files, and originals whose variant isn't ready, go to
+// next.
+func (c *catalog) formatVariants(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.ToLower(path.Ext(r.URL.Path)) {
+		case ".jpg", ".jpeg", ".png":
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		fullPath := filepath.Join(c.Root, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		info, err := c.fs.Stat(fullPath)
+		if err != nil || !info.Mode().IsRegular() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		format := c.negotiateFormat(w, r)
+		if format == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := variantName(c.thumbCacheKey(fullPath, info, 0, 0, fitContain), format)
+		data, ok := c.cachedVariant(name)
+		if !ok {
+			c.queueVariant(variantJob{c: c, name: name, fullPath: fullPath, fit: fitContain, format: format, fallbackSize: int(info.Size())})
+		}
+		if len(data) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		serveVariant(w, r, name, format, data)
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gen2brain/heic"
+	"github.com/gen2brain/webp"
+)
+
+// heicConvert (HEIC_CONVERT) is what HEIC/HEIF photos, which browsers
+// can't show, are converted to when the indexer finds them in an image
+// folder: jpeg (the default), webp, or off. The converted copy is written
+// next to the original with the format's extension added
+// (IMG_0001.HEIC.jpg), upright and with the original's modtime, and is
+// listed like any other image; the HEIC file stays as it is and is never
+// listed. An existing file of that name is never replaced, so deleting the
+// copy is how to convert a changed original again.
+type heicSettings struct {
+	heicConvert string
+}
+
+func (cfg *config) loadHEICConfig() {
+	switch v := os.Getenv("HEIC_CONVERT"); v {
+	case "":
+	case "jpeg", "webp", "off":
+		cfg.heicConvert = v
+	default:
+		log.Fatalf("invalid HEIC_CONVERT %q: want jpeg, webp or off", v)
+	}
+}
+
+// heicQuality is the JPEG or WebP quality of converted photos, high enough
+// that they stand in for the original
+const heicQuality = 90
+
+// isHEICName reports whether name has a HEIC/HEIF extension
+func isHEICName(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".heic", ".heif":
+		return true
+	}
+	return false
+}
+
+// heicFailed remembers HEIC files that failed to convert, by path and
+// modtime, so they are logged and retried only once they change
+var heicFailed = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: map[string]time.Time{}}
+
+// convertHEICs converts the HEIC files of every ingest directory and
+// returns how many it converted
+func (c *catalog) convertHEICs(ctx context.Context) int {
+	if c.cfg.heicConvert == "off" {
+		return 0
+	}
+	converted := 0
+	for _, dir := range c.ingestDirs() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if ctx.Err() != nil {
+				return converted
+			}
+			if e.Type().IsRegular() && isHEICName(e.Name()) && c.convertHEIC(filepath.Join(dir, e.Name())) {
+				converted++
+			}
+		}
+	}
+	return converted
+}
+
+// convertHEIC writes the converted copy of the HEIC file src unless its
+// name is taken, and reports whether it wrote one
+func (c *catalog) convertHEIC(src string) bool {
+	info, err := os.Stat(src)
+	if err != nil {
+		return false
+	}
+	ext := ".jpg"
+	if c.cfg.heicConvert == "webp" {
+		ext = ".webp"
+	}
+	dst := src + ext
+	if _, err := os.Lstat(dst); !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	heicFailed.Lock()
+	failedAt, failed := heicFailed.m[src]
+	heicFailed.Unlock()
+	if failed && failedAt.Equal(info.ModTime()) {
+		return false
+	}
+	start := time.Now()
+	if err := writeHEICCopy(src, dst, c.cfg.heicConvert, info.ModTime()); err != nil {
+		slog.Warn("heic conversion failed", "path", src, "err", err)
+		heicFailed.Lock()
+		heicFailed.m[src] = info.ModTime()
+		heicFailed.Unlock()
+		return false
+	}
+	slog.Info("heic converted", "path", src, "to", filepath.Base(dst), "duration", time.Since(start).Round(time.Millisecond).String())
+	return true
+}
+
+// writeHEICCopy decodes src, which libheif returns already rotated, and
+// writes it to dst in format (jpeg or webp) with src's modtime, so sorting
+// by date and upload times are unaffected. It fails rather than replace a
+// file that appeared at dst in the meantime.
+func writeHEICCopy(src, dst, format string, mod time.Time) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	cfg, err := heic.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxSourcePixels {
+		return fmt.Errorf("source is %dx%d, over the %d pixel limit", cfg.Width, cfg.Height, maxSourcePixels)
+	}
+	img, err := heic.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if format == "webp" {
+		err = webp.Encode(&buf, img, webp.Options{Quality: heicQuality, Method: 4})
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: heicQuality})
+	}
+	if err != nil {
+		return err
+	}
+	// Written aside and linked into place, which unlike a rename refuses an
+	// existing name, so the lister never sees a half-written copy
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp's files are private
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), mod, mod); err != nil {
+		return err
+	}
+	return os.Link(tmp.Name(), dst)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultLang is used when neither the lang param nor Accept-Language
+// matches a supported language
+const defaultLang = "th"
+
+// translations holds the UI string tables keyed by language then string key.
+// Templates read them through the T field, e.g. {{.T.save}}.
+var translations = map[string]map[string]string{
+	"th": {
+		"daily":              "รายวัน",
+		"weekly":             "รายสัปดาห์",
+		"monthly":            "รายเดือน",
+		"special":            "พิเศษ",
+		"daily_folders":      "โฟลเดอร์รายวัน",
+		"no_daily_folders":   "ยังไม่มีโฟลเดอร์รายวัน",
+		"no_images_folder":   "ไม่มีรูปภาพในโฟลเดอร์นี้",
+		"save":               "บันทึก",
+		"copy":               "คัดลอก",
+		"copied":             "คัดลอกแล้ว",
+		"refresh":            "รีเฟรช",
+		"loading":            "กำลังโหลด...",
+		"images":             "รูป",
+		"load_failed":        "โหลดโฟลเดอร์ไม่สำเร็จ",
+		"toggle_theme":       "สลับธีม",
+		"back":               "ย้อนกลับ",
+		"download_original":  "ดาวน์โหลดไฟล์ต้นฉบับ",
+		"download_all":       "ดาวน์โหลดทั้งหมด (ZIP)",
+		"print_pdf":          "พิมพ์ (PDF)",
+		"photo_info":         "ข้อมูลภาพ",
+		"video":              "วิดีโอ",
+		"qr_code":            "คิวอาร์โค้ด",
+		"scan_to_open":       "สแกนเพื่อเปิดการ์ดนี้บนมือถือ",
+		"taken":              "ถ่ายเมื่อ",
+		"copy_link":          "คัดลอกลิงก์",
+		"close":              "ปิด",
+		"previous":           "ก่อนหน้า",
+		"next":               "ถัดไป",
+		"open_full":          "เปิดแบบเต็มหน้า",
+		"recently_viewed":    "ดูล่าสุด",
+		"todays_picks":       "คัดมาให้วันนี้",
+		"no_picks":           "ยังไม่มีรูปภาพ",
+		"maintenance_title":  "ปิดปรับปรุงชั่วคราว",
+		"maintenance_body":   "เรากำลังจัดระเบียบรูปภาพ กรุณากลับมาใหม่ในอีกสักครู่",
+		"not_found_title":    "ไม่พบรูปภาพ",
+		"not_found_body":     "รูปภาพนี้อาจถูกย้ายหรือลบไปแล้ว",
+		"back_to_gallery":    "กลับไปที่แกลเลอรี",
+		"error_title":        "เกิดข้อผิดพลาด",
+		"error_body":         "ขออภัย มีบางอย่างผิดพลาด กรุณาลองใหม่อีกครั้ง",
+		"request_id":         "รหัสคำขอ",
+		"sort_by":            "เรียงตาม",
+		"sort_default":       "ค่าเริ่มต้น",
+		"sort_name":          "ชื่อไฟล์",
+		"sort_newest":        "ใหม่สุด",
+		"sort_oldest":        "เก่าสุด",
+		"sort_size":          "ขนาดไฟล์",
+		"apply":              "ใช้",
+		"search":             "ค้นหา",
+		"search_placeholder": "ค้นหาชื่อไฟล์ เช่น 789",
+		"search_truncated":   "แสดงเฉพาะผลลัพธ์แรก ๆ ลองระบุคำค้นให้ชัดขึ้น",
+		"no_results":         "ไม่พบรูปภาพที่ตรงกัน",
+		"archive":            "คลัง",
+		"folders":            "โฟลเดอร์",
+		"tags":               "แท็ก",
+		"no_tags":            "ยังไม่มีแท็ก",
+		"popular_today":      "ยอดนิยมวันนี้",
+		"popular_week":       "ยอดนิยมสัปดาห์นี้",
+	},
+	"en": {
+		"daily":              "Daily",
+		"weekly":             "Weekly",
+		"monthly":            "Monthly",
+		"special":            "Special",
+		"daily_folders":      "Daily Folders",
+		"no_daily_folders":   "No daily folders yet.",
+		"no_images_folder":   "No images in this folder.",
+		"save":               "Save",
+		"copy":               "Copy",
+		"copied":             "Copied",
+		"refresh":            "Refresh",
+		"loading":            "Loading...",
+		"images":             "images",
+		"load_failed":        "Failed to load folder.",
+		"toggle_theme":       "Toggle Theme",
+		"back":               "Back",
+		"download_original":  "Download original",
+		"download_all":       "Download all (ZIP)",
+		"print_pdf":          "Print (PDF)",
+		"photo_info":         "Photo info",
+		"video":              "Video",
+		"qr_code":            "QR code",
+		"scan_to_open":       "Scan to open this card on your phone",
+		"taken":              "Taken",
+		"copy_link":          "Copy link",
+		"close":              "Close",
+		"previous":           "Previous",
+		"next":               "Next",
+		"open_full":          "Open full page",
+		"recently_viewed":    "Recently viewed",
+		"todays_picks":       "Today's picks",
+		"no_picks":           "No images yet.",
+		"maintenance_title":  "Under maintenance",
+		"maintenance_body":   "We're reorganizing the gallery. Please check back in a few minutes.",
+		"not_found_title":    "Image not found",
+		"not_found_body":     "This image may have been moved or removed.",
+		"back_to_gallery":    "Back to the gallery",
+		"error_title":        "Something went wrong",
+		"error_body":         "Sorry, we couldn't show this page. Please try again.",
+		"request_id":         "Request ID",
+		"sort_by":            "Sort by",
+		"sort_default":       "Default",
+		"sort_name":          "File name",
+		"sort_newest":        "Newest",
+		"sort_oldest":        "Oldest",
+		"sort_size":          "File size",
+		"apply":              "Apply",
+		"search":             "Search",
+		"search_placeholder": "Search file names, e.g. 789",
+		"search_truncated":   "showing the first matches, try a more specific search",
+		"no_results":         "No matching images.",
+		"archive":            "Archive",
+		"folders":            "folders",
+		"tags":               "Tags",
+		"no_tags":            "No tags yet.",
+		"popular_today":      "Popular today",
+		"popular_week":       "Popular this week",
+	},
+}
+
+// detectLang picks the UI language from the lang query param, then the
+// Accept-Language header, then defaultLang
+func detectLang(r *http.Request) string {
+	if l := strings.ToLower(r.URL.Query().Get("lang")); translations[l] != nil {
+		return l
+	}
+	// Browsers list languages in preference order, so the first supported
+	// primary subtag wins
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if translations[primary] != nil {
+			return primary
+		}
+	}
+	return defaultLang
+}
+
+var thaiMonths = [...]string{"มกราคม", "กุมภาพันธ์", "มีนาคม", "เมษายน", "พฤษภาคม", "มิถุนายน",
+	"กรกฎาคม", "สิงหาคม", "กันยายน", "ตุลาคม", "พฤศจิกายน", "ธันวาคม"}
+
+// displayMonth formats a month like "June 2024", in Thai with the
+// Buddhist-era year
+func displayMonth(t time.Time, lang string) string {
+	if lang == "th" {
+		return fmt.Sprintf("%s %d", thaiMonths[t.Month()-1], t.Year()+543)
+	}
+	return t.Format("January 2006")
+}
+
+// displayDate formats a folder date like "1 June 2024", in Thai with the
+// Buddhist-era year. The zero time formats as "".
+func displayDate(t time.Time, lang string) string {
+	if t.IsZero() {
+		return ""
+	}
+	if lang == "th" {
+		return fmt.Sprintf("%d %s %d", t.Day(), thaiMonths[t.Month()-1], t.Year()+543)
+	}
+	return t.Format("2 January 2006")
+}
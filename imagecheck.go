@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Image check modes, selected with IMAGE_CHECK
+const (
+	imageCheckOff    = "off"    // list every file with an image extension
+	imageCheckSize   = "size"   // skip zero-byte files (default)
+	imageCheckDecode = "decode" // also require image.DecodeConfig to succeed
+)
+
+type imageCheckSettings struct {
+	imageCheckMode string
+}
+
+// loadImageCheckConfig reads IMAGE_CHECK. Decode mode opens every listed
+// file once, so it is opt-in.
+func (cfg *config) loadImageCheckConfig() {
+	switch v := os.Getenv("IMAGE_CHECK"); v {
+	case "":
+	case imageCheckOff, imageCheckSize, imageCheckDecode:
+		cfg.imageCheckMode = v
+	default:
+		log.Fatalf("invalid IMAGE_CHECK %q: want off, size or decode", v)
+	}
+}
+
+// imageVerdicts remembers the check result per file so broken files are
+// decoded and logged once, not on every listing. Entries are revalidated
+// when the file's size or modtime changes.
+var imageVerdicts = struct {
+	sync.Mutex
+	m map[string]imageVerdict
+}{m: map[string]imageVerdict{}}
+
+type imageVerdict struct {
+	size   int64
+	mod    time.Time
+	ok     bool
+	reason string // why a skipped file was skipped
+}
+
+// usableImage reports whether the image at path should be listed under the
+// IMAGE_CHECK mode of c
+func (c *catalog) usableImage(path string, info os.FileInfo) bool {
+	if c.cfg.imageCheckMode == imageCheckOff {
+		return true
+	}
+	imageVerdicts.Lock()
+	v, ok := imageVerdicts.m[path]
+	imageVerdicts.Unlock()
+	if ok && v.size == info.Size() && v.mod.Equal(info.ModTime()) {
+		return v.ok
+	}
+
+	good, reason := true, ""
+	if info.Size() == 0 {
+		good, reason = false, brokenReason(nil, 0)
+		slog.Warn("skipping empty image", "path", path)
+	} else if c.cfg.imageCheckMode == imageCheckDecode && !isVideoName(path) {
+		if _, err := decodeImageConfig(c.fs, path); err != nil {
+			good, reason = false, brokenReason(err, info.Size())
+			slog.Warn("skipping unreadable image", "path", path, "err", err)
+		}
+	}
+	imageVerdicts.Lock()
+	imageVerdicts.m[path] = imageVerdict{size: info.Size(), mod: info.ModTime(), ok: good, reason: reason}
+	imageVerdicts.Unlock()
+	return good
+}
+
+// brokenReason describes why a file of size bytes failed to decode with
+// err, in words an uploader can act on
+func brokenReason(err error, size int64) string {
+	var jpegErr jpeg.FormatError
+	switch {
+	case size == 0:
+		return "empty file"
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return "truncated file"
+	case errors.As(err, &jpegErr) && jpegErr == "short Huffman data": // JPEG cut off mid-scan
+		return "truncated file"
+	case errors.Is(err, image.ErrFormat):
+		return "not an image"
+	}
+	return err.Error()
+}
+
+// decodeImageConfig reads just the header of the image at path in fsys,
+// which is enough for the format and dimensions
+func decodeImageConfig(fsys storage, path string) (image.Config, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	return cfg, err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The background indexer records the size, modtime, dimensions and
+// checksum of every visible image (see imageFacts) at startup, every
+// indexInterval (INDEX_INTERVAL) and after /admin/refresh, with
+// indexWorkers (INDEX_WORKERS) files read at once. Galleries sort and total
+// folders from it instead of statting each file per request, and the
+// metadata store is synced from it.
+type indexerSettings struct {
+	indexWorkers  int
+	indexInterval time.Duration
+}
+
+func (cfg *config) loadIndexerConfig() {
+	if v := os.Getenv("INDEX_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 64 {
+			log.Fatalf("invalid INDEX_WORKERS %q: want 1-64", v)
+		}
+		cfg.indexWorkers = n
+	}
+	if v := os.Getenv("INDEX_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid INDEX_INTERVAL %q: want a duration like 10m", v)
+		}
+		cfg.indexInterval = d
+	}
+}
+
+// indexRequests wakes the index loop early, e.g. from /admin/refresh or
+// the file watcher
+var indexRequests = make(chan struct{}, 1)
+
+// requestIndexing asks for an index round soon; requests made while one is
+// pending are merged
+func requestIndexing() {
+	select {
+	case indexRequests <- struct{}{}:
+	default:
+	}
+}
+
+// indexLoop indexes every catalog, then syncs the metadata store if there
+// is one, at startup, every indexInterval and on request, until ctx is
+// cancelled. Every round after the first also rebuilds the search index
+// once the facts are fresh, so new, changed and removed images turn up in
+// searches without a refresh; the startup round leaves it to routes.
+func (s *Server) indexLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.indexInterval)
+	defer ticker.Stop()
+	rebuild := false
+	for {
+		if s.indexImages(ctx) > 0 && s.cfg.ocr != nil {
+			// Searches find newly read numbers without waiting for the
+			// next round
+			rebuild = true
+		}
+		if rebuild && ctx.Err() == nil {
+			for _, c := range s.Catalogs {
+				c.rebuildIndex()
+			}
+		}
+		if s.metaDB != nil {
+			for _, c := range s.Catalogs {
+				if err := c.syncMetadata(ctx); err != nil && ctx.Err() == nil {
+					slog.Error("metadata sync failed", "catalog", c.Prefix, "err", err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-indexRequests:
+		}
+		rebuild = true
+	}
+}
+
+// ingestDirs are the directories new images arrive in: every daily folder,
+// hidden ones included so staged folders are ready when they go public, and
+// every category
+func (c *catalog) ingestDirs() []string {
+	var dirs []string
+	if entries, err := c.fs.ReadDir(c.dir("daily")); err == nil {
+		for _, e := range entries {
+			if e.IsDir() && safeFolderRe.MatchString(e.Name()) {
+				dirs = append(dirs, c.dir("daily", e.Name()))
+			}
+		}
+	}
+	for _, cat := range c.categories() {
+		dirs = append(dirs, c.dir(cat.Name))
+	}
+	return dirs
+}
+
+// indexImages brings the facts of every visible image up to date with a
+// bounded worker pool, after converting new HEIC photos and running new
+// JPEGs through the optimize pipeline. Files whose size
+// and modtime haven't changed are not read again; facts of images no longer
+// listed are dropped after a complete round. It returns how many files it
+// read.
+func (s *Server) indexImages(ctx context.Context) (fresh int64) {
+	type indexJob struct {
+		c   *catalog
+		img string
+	}
+	var images []indexJob
+	for _, c := range s.Catalogs {
+		c.convertHEICs(ctx)
+		c.optimizeImages(ctx)
+		for _, img := range c.visibleImages(ctx) {
+			images = append(images, indexJob{c, img})
+		}
+	}
+	start := time.Now()
+
+	jobs := make(chan indexJob)
+	var indexed, unchanged, failed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < s.cfg.indexWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				img := job.img
+				fresh, err := job.c.indexImage(img)
+				switch {
+				case err != nil:
+					slog.Warn("index: reading image failed", "path", img, "err", err)
+					failed.Add(1)
+				case fresh:
+					if n := indexed.Add(1); n%500 == 0 {
+						slog.Info("index: progress", "indexed", n)
+					}
+				default:
+					unchanged.Add(1)
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, job := range images {
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	state := "done"
+	if ctx.Err() != nil {
+		state = "stopped"
+	} else {
+		keep := make(map[string]bool, len(images))
+		for _, job := range images {
+			keep[job.img] = true
+		}
+		pruneFacts(keep)
+	}
+	slog.Info("index "+state, "duration", time.Since(start).Round(time.Millisecond).String(),
+		"images", len(images), "indexed", indexed.Load(), "unchanged", unchanged.Load(), "failed", failed.Load())
+	return indexed.Load()
+}
+
+// indexImage records the facts of one image unless the index already
+// matches its size and modtime, and reports whether it read the file
+func (c *catalog) indexImage(img string) (fresh bool, err error) {
+	gen := indexGen()
+	info, err := c.fs.Stat(img)
+	if err != nil {
+		return false, err
+	}
+	if f, ok := cachedFacts(img); ok && f.size == info.Size() && f.mod.Equal(info.ModTime()) {
+		return false, nil
+	}
+	sum, err := hashImage(c.fs, img, info)
+	if err != nil {
+		return false, err
+	}
+	f := imageFacts{size: info.Size(), mod: info.ModTime(), sum: sum}
+	// Hashing decodes the whole image, which finds truncated files whose
+	// header still reads fine
+	if isVideoName(img) {
+		c.indexVideo(&f, img, info)
+	} else if cfg, err := decodeImageConfig(c.fs, img); err != nil {
+		f.broken = brokenReason(err, f.size)
+	} else {
+		exif := readExifFile(c.fs, img, c.cfg.siteLocation)
+		f.width, f.height = orientedSize(cfg, exif.orientation)
+		f.taken = exif.taken
+		if src, orientation, err := decodeSource(c.fs, img); err == nil {
+			f.phash, f.hashed = perceptualHash(src, orientation), true
+			f.preview = previewDataURI(src, orientation)
+		} else if !errors.Is(err, errSourceTooLarge) {
+			f.broken = brokenReason(err, f.size)
+		}
+	}
+	if f.broken != "" {
+		slog.Warn("index: unreadable image", "path", img, "reason", f.broken)
+	} else if c.cfg.ocr != nil && !isVideoName(img) {
+		if f.numbers, err = c.ocrNumbers(img, info); err != nil {
+			slog.Warn("index: ocr failed", "path", img, "err", err)
+		}
+	}
+	storeFacts(img, f, gen)
+	return true, nil
+}
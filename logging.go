@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// loadLogConfig installs the slog default logger from LOG_FORMAT (text or
+// json) and LOG_LEVEL (debug, info, warn or error). It runs first in main so
+// startup messages use the selected format too; lines from the standard log
+// package go through the same handler.
+func loadLogConfig() {
+	var level slog.Level
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			log.Fatalf("invalid LOG_LEVEL %q: want debug, info, warn or error", v)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch v := os.Getenv("LOG_FORMAT"); v {
+	case "", "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		log.Fatalf("invalid LOG_FORMAT %q: want text or json", v)
+	}
+}
+
+// statusRecorder captures the status code and body size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// accessLog logs one entry per request. Gallery routes also carry the
+// folder or image they were about, so logs show what people actually look
+// at.
+func (s *Server) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int64("bytes", rec.bytes),
+			slog.String("remote_ip", s.cfg.clientIP(r)),
+			slog.String("request_id", requestIDFrom(r.Context())),
+		}
+		if src := r.URL.Query().Get("src"); src != "" {
+			attrs = append(attrs, slog.String("src", src))
+		}
+		if _, folder, ok := strings.Cut(r.URL.Path, "/daily/"); ok && folder != "" {
+			attrs = append(attrs, slog.String("folder", strings.TrimSuffix(folder, "/")))
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
+
+// remoteIP returns the client address without its port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP is the address a request came from: with TRUST_PROXY the
+// last X-Forwarded-For entry, which the proxy appended itself, and the
+// connection's address otherwise
+func (cfg *config) clientIP(r *http.Request) string {
+	if cfg.trustProxy {
+		fwd := r.Header.Values("X-Forwarded-For")
+		if len(fwd) > 0 {
+			last := fwd[len(fwd)-1]
+			if i := strings.LastIndexByte(last, ','); i >= 0 {
+				last = last[i+1:]
+			}
+			if ip := net.ParseIP(strings.TrimSpace(last)); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	return remoteIP(r)
+}
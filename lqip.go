@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html/template"
+	"image"
+	"image/png"
+	"path/filepath"
+	"strings"
+)
+
+// previewSize is the long side in px of the placeholder previews grid
+// tiles show while their thumbnail loads; the browser's upscaling blurs it
+const previewSize = 8
+
+var previewEncoder = png.Encoder{CompressionLevel: png.BestCompression}
+
+// previewDataURI returns a previewSize PNG of src, upright, as a data: URI
+// of a couple hundred bytes. Images with transparency get none: their
+// placeholder would show through once they load.
+func previewDataURI(src image.Image, orientation int) string {
+	if o, ok := src.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+		return ""
+	}
+	small := applyOrientation(resizeToFit(src, previewSize, previewSize), orientation)
+	var buf bytes.Buffer
+	if err := previewEncoder.Encode(&buf, small); err != nil {
+		return ""
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// previewStyle is the style attribute that puts the indexed preview of the
+// image at path behind its tile, or "" before the indexer has reached it
+func previewStyle(path string) template.CSS {
+	f, ok := cachedFacts(path)
+	if !ok || f.preview == "" {
+		return ""
+	}
+	return template.CSS("background:center/cover url(" + f.preview + ")")
+}
+
+// previewsBySrc returns the preview styles of those srcs that have one, for
+// the imageGrid template
+func (c *catalog) previewsBySrc(srcs []string) map[string]template.CSS {
+	previews := map[string]template.CSS{}
+	for _, src := range srcs {
+		if style := previewStyle(c.dir(filepath.FromSlash(strings.TrimPrefix(src, "images/")))); style != "" {
+			previews[src] = style
+		}
+	}
+	return previews
+}
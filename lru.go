@@ -0,0 +1,81 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// byteLRU is a size-bounded least-recently-used cache of byte slices. The
+// budget counts value bytes only; a zero budget disables caching.
+type byteLRU struct {
+	mu     sync.Mutex
+	budget int64
+	used   int64
+	ll     *list.List // front = most recently used
+	items  map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value []byte
+}
+
+func newByteLRU(budget int64) *byteLRU {
+	return &byteLRU{budget: budget, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+// Get returns the cached value for key and marks it most recently used
+func (c *byteLRU) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+// Add stores value under key, evicting least recently used entries until the
+// cache fits its budget. Values larger than the whole budget are not kept.
+func (c *byteLRU) Add(key string, value []byte) {
+	size := int64(len(value))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if size > c.budget {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.used -= int64(len(el.Value.(*lruEntry).value))
+		el.Value.(*lruEntry).value = value
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value})
+	}
+	c.used += size
+	for c.used > c.budget {
+		oldest := c.ll.Back()
+		e := oldest.Value.(*lruEntry)
+		c.ll.Remove(oldest)
+		delete(c.items, e.key)
+		c.used -= int64(len(e.value))
+	}
+}
+
+// Len returns the number of cached entries
+func (c *byteLRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Purge drops every entry and returns how many there were
+func (c *byteLRU) Purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.ll.Len()
+	c.ll.Init()
+	c.items = map[string]*list.Element{}
+	c.used = 0
+	return n
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestByteLRUEvictsOverBudget(t *testing.T) {
+	c := newByteLRU(10)
+	c.Add("a", make([]byte, 4))
+	c.Add("b", make([]byte, 4))
+	c.Add("c", make([]byte, 4)) // 12 bytes: a must go
+	if _, ok := c.Get("a"); ok {
+		t.Error("a still cached over budget")
+	}
+	for _, k := range []string{"b", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("%s evicted, want kept", k)
+		}
+	}
+	if c.used != 8 {
+		t.Errorf("used = %d, want 8", c.used)
+	}
+}
+
+func TestByteLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newByteLRU(10)
+	c.Add("a", make([]byte, 4))
+	c.Add("b", make([]byte, 4))
+	c.Get("a") // b is now the oldest
+	c.Add("c", make([]byte, 4))
+	if _, ok := c.Get("b"); ok {
+		t.Error("b cached, want evicted as least recently used")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("a evicted though used since b")
+	}
+}
+
+func TestByteLRUReplaceAndOversize(t *testing.T) {
+	c := newByteLRU(10)
+	c.Add("a", make([]byte, 4))
+	c.Add("a", make([]byte, 6))
+	if c.Len() != 1 || c.used != 6 {
+		t.Errorf("after replace: len %d used %d, want 1 and 6", c.Len(), c.used)
+	}
+	c.Add("big", make([]byte, 11))
+	if _, ok := c.Get("big"); ok {
+		t.Error("value over the whole budget was cached")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("oversize value evicted a")
+	}
+
+	off := newByteLRU(0)
+	off.Add("a", []byte{1})
+	if off.Len() != 0 {
+		t.Error("zero budget cached a value")
+	}
+}
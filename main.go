@@ -1,314 +1,1236 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"html/template"
+	"io/fs"
 	"log"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type DailyFolder struct {
-	Name string
+	Name        string // directory name, used in URLs
+	DisplayName string // folder.json title, or Name
+	Description string
+	Sort        string    // default image order from folder.json
+	Date        time.Time // folder.json display date; zero when unset
+	Cover       string    // src of the cover image; "" for an empty folder
 }
 
 type PageData struct {
+	Prefix            string // URL prefix of the catalog
 	ActiveTab         string
 	DailyFolders      []DailyFolder
 	ActiveDailyFolder string
+	ActiveDaily       DailyFolder // settings of ActiveDailyFolder
 	DailyImages       []string
-	WeeklyImages      []string
+	Categories        []category // tabs after daily, see categoryNames
+	ActiveCategory    category   // the category tab shown; zero on others
+	CategoryImages    []string
+	RecentImages      []string                // recently viewed srcs from the cookie
+	PopularToday      []string                // most viewed srcs today, on the daily tab
+	PopularWeek       []string                // most viewed srcs over trendingDays
+	PickImages        []string                // today's picks, on the picks tab
+	Captions          map[string]string       // captions of the grid images, by src
+	Previews          map[string]template.CSS // placeholder styles of the grid images, by src
 	SiteName          string
+	Lang              string
+	T                 map[string]string
+	Theme             string         // "light", "dark" or "" when unset
+	Pager             *pager         // category tabs; nil when it fits one page
+	Sort              string         // sort param; "" for the folder's own order
+	Search            *searchResults // search tab; nil elsewhere
+	Tags              *tagListing    // tags tab; nil elsewhere
+	Archive           []archiveMonth // archive tab, newest month first
 }
 
-type ImagePageData struct {
-	Title         string
-	Description   string
-	SiteName      string
-	PageURL       string
-	OGImage       string
-	Src           string
-	FileName      string
-	RelatedImages []string
-	CurrentIndex  int
-	TotalImages   int
-	Kind          string
-	Folder        string
+// imageGrid is the data of the "imageGrid" template
+type imageGrid struct {
+	Prefix   string
+	T        map[string]string
+	Images   []string
+	Captions map[string]string        // by src, for images that have one
+	Snippets map[string]template.HTML // search results: captions with the matches marked
+	Previews map[string]template.CSS  // by src, for images the indexer has reached
 }
 
-const siteName = "Thai Card Store"
+// Grid prepares imgs for the shared "imageGrid" template
+func (p PageData) Grid(imgs []string) imageGrid {
+	return imageGrid{Prefix: p.Prefix, T: p.T, Images: imgs, Captions: p.Captions, Previews: p.Previews}
+}
 
-var templates *template.Template
+type ImagePageData struct {
+	Title           string
+	Description     string
+	SiteName        string
+	PageURL         string
+	OGImage         string
+	Prefix          string // URL prefix of the catalog
+	Src             string // URL of the image
+	SrcPath         string // src query value, images/...
+	FileName        string
+	Width           int // pixel dimensions; 0 when the header can't be read
+	Height          int
+	JSONLD          *imageObject // structured data for the full page only
+	RelatedImages   []string
+	Prev            string // URL of the previous related image, if any
+	Next            string // URL of the next related image, if any
+	CurrentIndex    int
+	TotalImages     int
+	FolderImages    int               // leading RelatedImages from the image's own folder
+	Caption         string            // from the image's sidecar file
+	RelatedCaptions map[string]string // captions of RelatedImages, by URL
+	Tags            []string          // from the image's .json sidecar
+	RelatedTags     map[string]string // space-separated tags of RelatedImages, by URL
+	PhotoInfo       string            // photoInfoLine; "" unless PHOTO_INFO is on
+	RelatedInfo     map[string]string // photoInfoLine of RelatedImages, by URL
+	PrevView        string            // view page of the previous image in the folder; full page only
+	NextView        string            // view page of the next image in the folder; full page only
+	NextImage       string            // URL of that next image, for prefetching
+	related         relatedSet
+	Kind            string
+	Folder          string
+	FolderInfo      DailyFolder // folder.json settings of Folder; zero outside daily folders
+	Lang            string
+	T               map[string]string
+}
 
 func main() {
-	loadTemplates()
+	loadLogConfig()
+	cfg := loadConfig(os.Args[1:])
+	srv, err := newServer(cfg, loadCatalogs(cfg))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	http.Handle("/images/", http.StripPrefix("/images/", http.FileServer(http.Dir("images"))))
-	http.HandleFunc("/appicon.png", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "appicon.png")
-	})
-	http.HandleFunc("/preview.png", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "preview.png")
-	})
-	http.HandleFunc("/", galleryHandler)
-	http.HandleFunc("/daily/", dailyFolderHandler)
-	http.HandleFunc("/view", imageViewHandler)
+	// Background work watches ctx so it stops promptly on shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var background sync.WaitGroup
+	go srv.reloadOnHangup(ctx)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		srv.indexLoop(ctx)
+	}()
+	if cfg.trendingSize > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			srv.saveViewsLoop(ctx)
+		}()
+	}
+	if len(cfg.imageFormats) > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			srv.variantLoop(ctx)
+		}()
+	}
+	if cfg.prewarmThumbs {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			srv.prewarmThumbnails(ctx)
+		}()
+	}
+
+	// Plain HTTP on cfg.Addr, or HTTPS on :443 plus the :80 redirect when
+	// autocert is configured
+	var servers []*http.Server
+	serveErr := make(chan error, 2)
+	if len(cfg.autocertHosts()) > 0 {
+		https, redirect := autocertServers(cfg, srv)
+		servers = append(servers, https, redirect)
+		go func() { serveErr <- redirect.ListenAndServe() }()
+		go func() {
+			slog.Info("server running", "hosts", cfg.autocertHosts(), "tls", "autocert", "cert_cache", cfg.AutocertCache)
+			serveErr <- https.ListenAndServeTLS("", "")
+		}()
+	} else {
+		httpServer := cfg.applyTimeouts(&http.Server{Addr: cfg.Addr, Handler: srv})
+		servers = append(servers, httpServer)
+		go func() {
+			slog.Info("server running", "addr", cfg.Addr)
+			serveErr <- httpServer.ListenAndServe()
+		}()
+	}
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	// A second signal during the drain falls back to the default: exit now
+	stop()
+
+	slog.Info("shutting down", "drain_timeout", cfg.shutdownTimeout.String())
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(drainCtx); err != nil {
+			slog.Error("shutdown", "addr", s.Addr, "err", err)
+		}
+	}
+	background.Wait()
+	srv.Close()
+	slog.Info("stopped")
+}
 
-	log.Println("Server running on http://localhost:1250")
-	log.Fatal(http.ListenAndServe(":1250", nil))
+// galleryQuery holds the params that identify a gallery page; Link headers
+// must carry all of them so prefetched pages show the same view
+func galleryQuery(tab, folder, sortBy string) url.Values {
+	q := url.Values{"tab": {tab}}
+	if tab == "daily" && folder != "" {
+		q.Set("folder", folder)
+	}
+	if sortBy != "" {
+		q.Set("sort", sortBy)
+	}
+	return q
 }
 
-func loadTemplates() {
-	funcs := template.FuncMap{
-		"sub": func(a, b int) int { return a - b },
+// setPageLinks emits Link headers for the canonical URL of the current page
+// and, when there are neighbours, rel="prev"/rel="next" so browsers and
+// HTMX can prefetch them
+func setPageLinks(w http.ResponseWriter, prefix string, q url.Values, p pagination) {
+	pageURL := func(n int) string {
+		return prefix + "/?" + p.query(q, n).Encode()
 	}
-	var err error
-	templates, err = template.New("").Funcs(funcs).ParseGlob("templates/*.gohtml")
-	if err != nil {
-		log.Fatalf("error parsing templates: %v", err)
+	links := []string{"<" + pageURL(p.Page) + `>; rel="canonical"`}
+	if p.Page > 1 {
+		links = append(links, "<"+pageURL(p.Page-1)+`>; rel="prev"`)
 	}
+	if p.Page < p.TotalPages {
+		links = append(links, "<"+pageURL(p.Page+1)+`>; rel="next"`)
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
 }
 
-func galleryHandler(w http.ResponseWriter, r *http.Request) {
+// humanBytes formats a byte count using binary units, e.g. 1.5 MB
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func (c *catalog) galleryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	activeTab := r.URL.Query().Get("tab")
 	if activeTab == "" {
 		activeTab = "daily"
 	}
 
-	dailyFolders := listDailyFolders()
-	weeklyImages := []string{}
+	dailyFolders := c.listDailyFolders(ctx)
+	categories := c.categories()
 	var activeDaily string
-	var dailyImages []string
+	var activeInfo DailyFolder
+	var activeCategory category
+	var dailyImages, categoryImages []string
 
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy != "" && !sortModes[sortBy] {
+		httpError(w, r, errInvalidSort.Error(), http.StatusBadRequest)
+		return
+	}
 	if activeTab == "daily" {
-		// choose folder: query param or first
+		// choose folder: query param, else today's or the newest one
 		activeDaily = r.URL.Query().Get("folder")
-		if activeDaily == "" && len(dailyFolders) > 0 {
-			activeDaily = dailyFolders[0].Name
+		if activeDaily != "" && c.folderHidden(c.dir("daily", activeDaily)) {
+			c.srv.notFoundPage(w, r)
+			return
+		}
+		if activeDaily == "" {
+			activeDaily = c.defaultDailyFolder(dailyFolders)
 		}
 		if activeDaily != "" {
-			dailyImages = listImages(filepath.Join("images", "daily", activeDaily))
+			activeInfo = c.dailyFolderInfo(activeDaily)
+			mode, _ := requestSort(r, activeInfo.Sort)
+			dailyImages = c.sortImages(c.listImages(ctx, c.dir("daily", activeDaily)), mode)
 		}
-	} else if activeTab == "weekly" {
-		weeklyImages = listImages("images/weekly")
+	} else {
+		i := slices.IndexFunc(categories, func(cat category) bool { return cat.Name == activeTab })
+		if i < 0 {
+			c.srv.notFoundPage(w, r)
+			return
+		}
+		activeCategory = categories[i]
+		mode, _ := requestSort(r, activeCategory.Sort)
+		categoryImages = c.sortImages(c.listImages(ctx, c.dir(activeCategory.Name)), mode)
+	}
+	if ctx.Err() != nil {
+		return // client went away; the listing may be incomplete
+	}
+
+	// Freshness covers only what this tab/folder renders: the folder and
+	// category lists, the directory being shown (so deletions count), its
+	// manifest, its images and the templates, and the last reload since it
+	// may have changed the site name
+	site := c.srv.current()
+	modPaths := []string{c.Root, c.dir("daily")}
+	for _, f := range dailyFolders {
+		for _, name := range folderConfigNames {
+			modPaths = append(modPaths, c.dir("daily", f.Name, name))
+		}
+	}
+	for _, cat := range categories {
+		for _, name := range folderConfigNames {
+			modPaths = append(modPaths, c.dir(cat.Name, name))
+		}
+	}
+	if activeTab == "daily" && activeDaily != "" {
+		dir := c.dir("daily", activeDaily)
+		modPaths = append(modPaths, dir, filepath.Join(dir, orderFileName))
+		modPaths = append(modPaths, dailyImages...)
+		modPaths = append(modPaths, c.sidecarPaths(dir)...)
+	} else if activeCategory.Name != "" {
+		modPaths = append(modPaths, c.dir(activeCategory.Name), c.dir(activeCategory.Name, orderFileName))
+		modPaths = append(modPaths, categoryImages...)
+		modPaths = append(modPaths, c.sidecarPaths(c.dir(activeCategory.Name))...)
+	}
+	// The daily tab's images come from the folder partial, which pages
+	// them the same way
+	shown := categoryImages
+	if activeTab == "daily" {
+		shown = dailyImages
+	}
+	pg, err := c.paginate(r, len(shown))
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := galleryQuery(activeTab, activeDaily, sortBy)
+	setPageLinks(w, c.Prefix, q, pg)
+
+	// Language and theme cookie change the body without touching any file
+	w.Header().Set("Vary", "Accept-Language, Cookie")
+	recent := c.recentFromRequest(r)
+	var popularToday, popularWeek []string
+	if activeTab == "daily" {
+		popularToday, popularWeek = c.popularImages(1), c.popularImages(trendingDays)
+	}
+	// The recent and popular strips change without any file changing, so
+	// pages showing them are always rendered in full
+	modtime := newestModTime(c.fs, modPaths...)
+	if mt := newestModTime(osStorage{}, site.templateFiles...); mt.After(modtime) {
+		modtime = mt
+	}
+	if site.loadedAt.After(modtime) {
+		modtime = site.loadedAt
+	}
+	// A page that picked today's folder goes stale at midnight
+	if activeTab == "daily" && r.URL.Query().Get("folder") == "" && c.cfg.today().After(modtime) {
+		modtime = c.cfg.today()
+	}
+	if len(recent) == 0 && len(popularWeek) == 0 && checkNotModified(w, r, modtime) {
+		return
 	}
 
 	data := PageData{
+		Prefix:            c.Prefix,
 		ActiveTab:         activeTab,
 		DailyFolders:      dailyFolders,
 		ActiveDailyFolder: activeDaily,
-		DailyImages:       dailyImages,
-		WeeklyImages:      weeklyImages,
-		SiteName:          siteName,
+		ActiveDaily:       activeInfo,
+		DailyImages:       c.srcsFor(dailyImages),
+		Categories:        categories,
+		ActiveCategory:    activeCategory,
+		CategoryImages:    c.srcsFor(categoryImages),
+		RecentImages:      recent,
+		PopularToday:      popularToday,
+		PopularWeek:       popularWeek,
+		SiteName:          c.siteName(),
+		Sort:              sortBy,
+	}
+	data.Lang = detectLang(r)
+	data.T = translations[data.Lang]
+	data.Theme = themeFromRequest(r)
+	if activeTab != "daily" {
+		data.CategoryImages = data.CategoryImages[pg.Start:pg.End]
+		data.Pager = pg.pager(c.Prefix, q, "categoryView", data.T)
+		data.Captions = c.captionsBySrc(data.CategoryImages)
+		data.Previews = c.previewsBySrc(data.CategoryImages)
+	} else {
+		data.Captions = c.captionsBySrc(append(popularToday, popularWeek...))
+	}
+
+	c.srv.render(w, http.StatusOK, "index.gohtml", data)
+}
+
+// newestModTime returns the latest modtime among paths in fsys, ignoring
+// any that can't be stat-ed
+func newestModTime(fsys storage, paths ...string) time.Time {
+	var newest time.Time
+	for _, p := range paths {
+		info, err := fsys.Stat(p)
+		if err != nil {
+			continue
+		}
+		if mt := info.ModTime(); mt.After(newest) {
+			newest = mt
+		}
+	}
+	return newest
+}
+
+// checkNotModified sets Last-Modified from modtime and, when the request's
+// If-Modified-Since is at least as recent, writes a 304 and returns true
+func checkNotModified(w http.ResponseWriter, r *http.Request, modtime time.Time) bool {
+	if modtime.IsZero() {
+		return false
+	}
+	modtime = modtime.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", modtime.Format(http.TimeFormat))
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modtime.After(since) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// serverStart is folded into generated ETags so a deploy that changes the
+// markup never revalidates against an old response
+var serverStart = time.Now()
+
+// folderETag fingerprints a folder partial from its file set, each file's
+// size and modtime, the order manifest and variant, the response language,
+// order and page
+func (c *catalog) folderETag(dir string, imgs []string, variant string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d|%s\n", serverStart.UnixNano(), variant)
+	paths := append(slices.Clip(imgs), filepath.Join(dir, orderFileName))
+	for _, name := range folderConfigNames {
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	paths = append(paths, c.sidecarPaths(dir)...)
+	for _, p := range paths {
+		if info, err := c.fs.Stat(p); err == nil {
+			fmt.Fprintf(h, "%s|%d|%d\n", p, info.Size(), info.ModTime().UnixNano())
+		}
 	}
+	return `"` + hex.EncodeToString(h.Sum(nil))[:20] + `"`
+}
 
-	if err := templates.ExecuteTemplate(w, "index.gohtml", data); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// checkETag sets the ETag header and, when the request's If-None-Match
+// already names it, writes a 304 and returns true
+func checkETag(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
 	}
+	return false
+}
+
+// hiddenMarker is a file that, when present in a daily folder, keeps the
+// folder out of listings and its partial unreachable until removed
+const hiddenMarker = ".hidden"
+
+// folderHidden reports whether dir carries the hidden marker
+func (c *catalog) folderHidden(dir string) bool {
+	_, err := c.fs.Stat(filepath.Join(dir, hiddenMarker))
+	return err == nil
+}
+
+// inHiddenFolder reports whether fullPath, a path below c.Root, is in (or
+// is) a hidden daily folder or category
+func (c *catalog) inHiddenFolder(fullPath string) bool {
+	rel, err := filepath.Rel(c.Root, fullPath)
+	if err != nil || rel == "." {
+		return false
+	}
+	dir := c.Root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, name)
+		if c.folderHidden(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// hideHidden wraps the /images/ file server so files of hidden folders
+// 404 like everywhere else
+func (c *catalog) hideHidden(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.inHiddenFolder(filepath.Join(c.Root, filepath.FromSlash(path.Clean("/"+r.URL.Path)))) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
-// listDailyFolders returns sorted list of daily subfolders (names only)
-func listDailyFolders() []DailyFolder {
-	dailyBase := "images/daily"
-	entries, err := os.ReadDir(dailyBase)
+// listDailyFolders returns sorted list of daily subfolders (names only),
+// skipping hidden ones. Complete listings are served from dirIndex until
+// the folders change.
+func (c *catalog) listDailyFolders(ctx context.Context) []DailyFolder {
+	dailyBase := c.dir("daily")
+	cached, ok, gen := cachedFolders(dailyBase)
+	if ok {
+		return cached
+	}
+	entries, err := c.readDirLimited(dailyBase)
 	if err != nil {
 		return nil
 	}
 	var folders []DailyFolder
 	for _, e := range entries {
-		if e.IsDir() {
-			folders = append(folders, DailyFolder{Name: e.Name()})
+		if ctx.Err() != nil {
+			return folders
+		}
+		if e.IsDir() && !c.folderHidden(filepath.Join(dailyBase, e.Name())) {
+			folders = append(folders, c.dailyFolderInfo(e.Name()))
 		}
 	}
 	sort.Slice(folders, func(i, j int) bool { return strings.ToLower(folders[i].Name) < strings.ToLower(folders[j].Name) })
+	storeFolders(dailyBase, folders, gen)
 	return folders
 }
 
-func listImages(dir string) []string {
-	entries, err := os.ReadDir(dir)
+// dailyFolderInfo returns a daily folder with its folder.json settings and
+// cover
+func (c *catalog) dailyFolderInfo(name string) DailyFolder {
+	cfg := c.readFolderConfig(c.dir("daily", name))
+	f := DailyFolder{Name: name, DisplayName: cfg.Title, Description: cfg.Description, Sort: cfg.Sort}
+	if f.DisplayName == "" {
+		f.DisplayName = name
+	}
+	// Both were validated by readFolderConfig
+	f.Date, _ = time.Parse(time.DateOnly, cfg.Date)
+	if cfg.Cover != "" {
+		cover := c.dir("daily", name, cfg.Cover)
+		if info, err := c.fs.Stat(cover); err == nil && info.Mode().IsRegular() {
+			f.Cover = c.srcFor(cover)
+		}
+	}
+	// Without a usable cover setting the folder's first image stands in
+	if f.Cover == "" {
+		dir := c.dir("daily", name)
+		if imgs := c.sortImages(c.listImages(context.Background(), dir), cfg.Sort); len(imgs) > 0 {
+			f.Cover = c.srcFor(imgs[0])
+		}
+	}
+	return f
+}
+
+// imageExts are the file extensions served as gallery images
+var imageExts = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true}
+
+// isImageName reports whether name has a supported image extension
+func isImageName(name string) bool {
+	return imageExts[strings.ToLower(filepath.Ext(name))]
+}
+
+// folderNewest caches the newest image modtime per daily folder, keyed by
+// the folder's own modtime so it is only rescanned after files change
+var folderNewest = struct {
+	sync.Mutex
+	m map[string]folderNewestEntry
+}{m: map[string]folderNewestEntry{}}
+
+type folderNewestEntry struct {
+	dirMod time.Time
+	newest time.Time
+}
+
+// newestImageTime returns the modtime of the newest image directly inside
+// dir, or the zero time when it has none
+func (c *catalog) newestImageTime(dir string) time.Time {
+	info, err := c.fs.Stat(dir)
+	if err != nil {
+		return time.Time{}
+	}
+	folderNewest.Lock()
+	cached, ok := folderNewest.m[dir]
+	folderNewest.Unlock()
+	if ok && cached.dirMod.Equal(info.ModTime()) {
+		return cached.newest
+	}
+	var newest time.Time
+	entries, _ := c.fs.ReadDir(dir)
+	for _, e := range entries {
+		if e.IsDir() || !isMediaName(e.Name()) {
+			continue
+		}
+		if fi, err := e.Info(); err == nil && c.usableImage(filepath.Join(dir, e.Name()), fi) && fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	folderNewest.Lock()
+	folderNewest.m[dir] = folderNewestEntry{dirMod: info.ModTime(), newest: newest}
+	folderNewest.Unlock()
+	return newest
+}
+
+// newestDailyFolder picks the daily folder holding the most recently
+// modified image, falling back to the first folder when none have images
+func (c *catalog) newestDailyFolder(folders []DailyFolder) string {
+	if len(folders) == 0 {
+		return ""
+	}
+	best := folders[0].Name
+	var bestTime time.Time
+	for _, f := range folders {
+		if t := c.newestImageTime(c.dir("daily", f.Name)); t.After(bestTime) {
+			best, bestTime = f.Name, t
+		}
+	}
+	return best
+}
+
+// listImages returns the usable images directly inside dir in display
+// order. It stops early, with what it found so far, when ctx is cancelled;
+// callers serving a request check ctx before using the result. Complete
+// listings are served from dirIndex until dir changes.
+func (c *catalog) listImages(ctx context.Context, dir string) []string {
+	cached, ok, gen := cachedImages(dir)
+	if ok {
+		return cached
+	}
+	defer observeScan("images", time.Now())
+	entries, err := c.fs.ReadDir(dir)
 	if err != nil {
 		return nil
 	}
 	var imgs []string
 	for _, e := range entries {
-		if !e.IsDir() {
-			name := e.Name()
-			lower := strings.ToLower(name)
-			if strings.HasSuffix(lower, ".png") || strings.HasSuffix(lower, ".jpg") || strings.HasSuffix(lower, ".jpeg") || strings.HasSuffix(lower, ".gif") || strings.HasSuffix(lower, ".webp") {
-				imgs = append(imgs, filepath.ToSlash(filepath.Join(dir, name)))
-			}
+		if ctx.Err() != nil {
+			return imgs
+		}
+		if e.IsDir() || !isMediaName(e.Name()) {
+			continue
 		}
+		p := filepath.Join(dir, e.Name())
+		if info, err := e.Info(); err != nil || !c.usableImage(p, info) || c.isWebPVariant(p) {
+			continue
+		}
+		imgs = append(imgs, filepath.ToSlash(p))
 	}
 	sort.Strings(imgs)
+	imgs = c.applyOrderFile(dir, imgs)
+	storeImages(dir, imgs, gen)
 	return imgs
 }
 
+// orderFileName is an optional per-folder manifest listing image file names
+// one per line in the order they should be displayed. A line of the form
+// "* name" pins the image: pinned images come first whatever the sort.
+const orderFileName = "order.txt"
+
+// readOrderFile returns the file names listed in dir/order.txt in manifest
+// order, without duplicates, and which of them are pinned. Blank lines and
+// lines starting with # are ignored.
+func (c *catalog) readOrderFile(dir string) (names []string, pinned map[string]bool) {
+	raw, err := c.fs.ReadFile(filepath.Join(dir, orderFileName))
+	if err != nil {
+		return nil, nil
+	}
+	pinned = map[string]bool{}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(string(raw), "\n") {
+		name := strings.TrimSpace(line)
+		pin := false
+		if rest, ok := strings.CutPrefix(name, "*"); ok {
+			name, pin = strings.TrimSpace(rest), true
+		}
+		if name == "" || strings.HasPrefix(name, "#") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+		if pin {
+			pinned[name] = true
+		}
+	}
+	return names, pinned
+}
+
+// applyOrderFile reorders imgs (already sorted alphabetically) according to
+// dir/order.txt. Pinned files come first, then the other listed files, both
+// in manifest order; anything not mentioned keeps its alphabetical position
+// after them.
+func (c *catalog) applyOrderFile(dir string, imgs []string) []string {
+	names, pinned := c.readOrderFile(dir)
+	if names == nil {
+		return imgs
+	}
+	byName := make(map[string]string, len(imgs))
+	for _, img := range imgs {
+		byName[path.Base(img)] = img
+	}
+	ordered := make([]string, 0, len(imgs))
+	seen := make(map[string]bool, len(imgs))
+	for _, pins := range []bool{true, false} {
+		for _, name := range names {
+			if img, ok := byName[name]; ok && pinned[name] == pins {
+				ordered = append(ordered, img)
+				seen[name] = true
+			}
+		}
+	}
+	for _, img := range imgs {
+		if !seen[path.Base(img)] {
+			ordered = append(ordered, img)
+		}
+	}
+	return ordered
+}
+
 var safeFolderRe = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
 
+// trailingSlashSettings: trailingSlashRedirect selects how /daily/<folder>/
+// is handled: a 301 to the slash-less URL (TRAILING_SLASH=redirect,
+// default) or serving it as is (TRAILING_SLASH=accept)
+type trailingSlashSettings struct {
+	trailingSlashRedirect bool
+}
+
+func (cfg *config) loadTrailingSlashConfig() {
+	switch v := os.Getenv("TRAILING_SLASH"); v {
+	case "", "redirect":
+	case "accept":
+		cfg.trailingSlashRedirect = false
+	default:
+		log.Fatalf("invalid TRAILING_SLASH %q: want redirect or accept", v)
+	}
+}
+
+// folderFromPath extracts the folder name following prefix in an URL path,
+// tolerating a single trailing slash. slash reports whether one was
+// stripped.
+func folderFromPath(path, prefix string) (folder string, slash bool) {
+	folder = strings.TrimPrefix(path, prefix)
+	if strings.HasSuffix(folder, "/") {
+		return strings.TrimSuffix(folder, "/"), true
+	}
+	return folder, false
+}
+
+// dailyFolderCase returns the on-disk casing of a daily folder when name
+// only matches it case-insensitively, e.g. for links shared as /daily/January.
+// It returns "" when the exact folder exists or nothing matches.
+func (c *catalog) dailyFolderCase(ctx context.Context, name string) string {
+	if _, err := c.fs.Stat(c.dir("daily", name)); !errors.Is(err, os.ErrNotExist) {
+		return ""
+	}
+	for _, f := range c.listDailyFolders(ctx) {
+		if strings.EqualFold(f.Name, name) {
+			return f.Name
+		}
+	}
+	return ""
+}
+
+// redirectQuery redirects to path, keeping the request's query string
+func redirectQuery(w http.ResponseWriter, r *http.Request, path string, q url.Values) {
+	if q != nil {
+		path += "?" + q.Encode()
+	} else if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, path, http.StatusMovedPermanently)
+}
+
 // dailyFolderHandler serves HTMX partial for a specific folder images
-func dailyFolderHandler(w http.ResponseWriter, r *http.Request) {
-	folder := strings.TrimPrefix(r.URL.Path, "/daily/")
+func (c *catalog) dailyFolderHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	folder, slash := folderFromPath(r.URL.Path, "/daily/")
 	if !safeFolderRe.MatchString(folder) {
 		http.Error(w, "invalid folder", http.StatusBadRequest)
 		return
 	}
-	imgs := listImages(filepath.Join("images", "daily", folder))
+	canonical := c.dailyFolderCase(ctx, folder)
+	if canonical != "" || (slash && c.cfg.trailingSlashRedirect) {
+		if canonical == "" {
+			canonical = folder
+		}
+		redirectQuery(w, r, c.Prefix+"/daily/"+canonical, nil)
+		return
+	}
+	dir := c.dir("daily", folder)
+	if c.folderHidden(dir) {
+		http.NotFound(w, r)
+		return
+	}
+	sortBy := r.URL.Query().Get("sort")
+	c.serveImagesPartial(w, r, imagesPartial{
+		dir:         dir,
+		defaultSort: c.readFolderConfig(dir).Sort,
+		path:        "/daily/" + url.PathEscape(folder),
+		tab:         galleryQuery("daily", folder, sortBy),
+		target:      "dailyImages",
+		anchor:      "dailyFolderView",
+	})
+}
+
+// writeGridFigure renders one grid cell, matching the imageGrid template
+func (c *catalog) writeGridFigure(b *strings.Builder, img string, t map[string]string) {
+	src := c.srcFor(img)
+	caption := c.captionFor(img)
+	alt := caption
+	if alt == "" {
+		alt = filepath.Base(src)
+	}
+	imgURL := c.Prefix + "/" + src
+	q := "?src=" + template.URLQueryEscaper(src)
+	b.WriteString("<figure class='group relative overflow-hidden rounded-lg border bg-white shadow hover:shadow-md transition'>")
+	b.WriteString("<a href='" + c.Prefix + "/view" + q + "' hx-get='" + c.Prefix + "/view/partial" + q + "' hx-target='#lightbox' class='block focus:outline-none'>")
+	var style string
+	if preview := previewStyle(img); preview != "" {
+		style = " style='" + template.HTMLEscapeString(string(preview)) + "'"
+	}
+	b.WriteString("<img loading='lazy' src='" + c.Prefix + "/thumb" + q + "' srcset='" + template.HTMLEscapeString(srcset(c.Prefix, src, gridSrcsetWidths)) + "' sizes='" + gridSizes + "'" + style + " class='w-full h-40 object-cover group-hover:scale-105 transition' alt='" + template.HTMLEscapeString(alt) + "' />")
+	if isVideoName(img) {
+		b.WriteString("<span class='pointer-events-none absolute top-1 left-1 rounded-md bg-black/60 p-1 text-white' title='" + template.HTMLEscapeString(t["video"]) + "'><svg class='h-4 w-4' fill='currentColor' viewBox='0 0 24 24' aria-hidden='true'><path d='M8 5v14l11-7z'/></svg></span>")
+	}
+	b.WriteString("</a>")
+	if caption != "" {
+		b.WriteString("<figcaption class='pointer-events-none absolute inset-x-0 bottom-0 bg-black/50 px-2 py-1 text-xs text-white truncate'>" + template.HTMLEscapeString(caption) + "</figcaption>")
+	}
+	// overlay buttons
+	b.WriteString("<div class='absolute top-1 right-1 flex gap-1 opacity-0 group-hover:opacity-100 transition'>")
+	b.WriteString("<button data-dl='" + c.Prefix + "/download" + q + "' class='dl-btn p-1.5 rounded-md bg-white/90 hover:bg-white shadow text-gray-700 text-xs font-medium'>" + template.HTMLEscapeString(t["save"]) + "</button>")
+	b.WriteString("<button data-copy='" + imgURL + "' class='copy-btn p-1.5 rounded-md bg-white/90 hover:bg-white shadow text-gray-700 text-xs font-medium'>" + template.HTMLEscapeString(t["copy"]) + "</button>")
+	b.WriteString("</div>")
+	b.WriteString("</figure>")
+}
+
+// imagesPartial is an image set served as an HTMX grid fragment
+type imagesPartial struct {
+	dir         string
+	defaultSort string     // order when the request has no sort param
+	path        string     // route of the partial below the catalog prefix
+	tab         url.Values // gallery page showing the set, for pager links
+	target      string     // id of the element the fragment is loaded into
+	anchor      string     // id of the element scrolled to after paging
+}
+
+// serveImagesPartial renders the images of p.dir in their sort order, one
+// page at a time, with the set's size in headers for client overlays
+func (c *catalog) serveImagesPartial(w http.ResponseWriter, r *http.Request, p imagesPartial) {
+	ctx := r.Context()
+	dir := p.dir
+	mode, err := requestSort(r, p.defaultSort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	imgs := c.sortImages(c.listImages(ctx, dir), mode)
+	if ctx.Err() != nil {
+		return // client went away; the listing may be incomplete
+	}
+	pg, err := c.paginate(r, len(imgs))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lang := detectLang(r)
+	t := translations[lang]
+	w.Header().Set("Vary", "Accept-Language")
+	if checkETag(w, r, c.folderETag(dir, imgs, fmt.Sprintf("%s|%s|%d|%d", lang, mode, pg.Page, pg.Limit))) {
+		return
+	}
+	// Folder metadata for client overlays, so they need no second request
+	var total int64
+	for _, img := range imgs {
+		if size, _, err := c.imageStat(img); err == nil {
+			total += size
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Image-Count", strconv.Itoa(len(imgs)))
+	w.Header().Set("X-Folder-Bytes", strconv.FormatInt(total, 10))
 	// Render minimal HTML snippet (no template dependency) for speed
 	if len(imgs) == 0 {
-		w.Write([]byte("<p class='text-gray-500'>No images in this folder.</p>"))
+		w.Write([]byte("<p class='text-gray-500'>" + template.HTMLEscapeString(t["no_images_folder"]) + "</p>"))
 		return
 	}
 	var b strings.Builder
-	for _, src := range imgs {
-		viewURL := "/view?src=" + template.URLQueryEscaper(src)
-		b.WriteString("<figure class='group relative overflow-hidden rounded-lg border bg-white shadow hover:shadow-md transition'>")
-		b.WriteString("<a href='" + viewURL + "' class='block focus:outline-none'>")
-		b.WriteString("<img loading='lazy' src='" + "/" + src + "' class='w-full h-40 object-cover group-hover:scale-105 transition' alt='" + template.HTMLEscapeString(filepath.Base(src)) + "' />")
-		b.WriteString("</a>")
-		// overlay buttons
-		b.WriteString("<div class='absolute top-1 right-1 flex gap-1 opacity-0 group-hover:opacity-100 transition'>")
-		b.WriteString("<button data-dl='" + "/" + src + "' class='dl-btn p-1.5 rounded-md bg-white/90 hover:bg-white shadow text-gray-700 text-xs font-medium'>Save</button>")
-		b.WriteString("<button data-copy='" + "/" + src + "' class='copy-btn p-1.5 rounded-md bg-white/90 hover:bg-white shadow text-gray-700 text-xs font-medium'>Copy</button>")
-		b.WriteString("</div>")
-		b.WriteString("</figure>")
+	for _, img := range imgs[pg.Start:pg.End] {
+		c.writeGridFigure(&b, img, t)
 	}
+	if pg.TotalPages > 1 {
+		b.WriteString(c.partialPager(p, lang, r.URL.Query().Get("sort"), pg, t))
+	}
+	// Only full responses announce a load; a 304 leaves the grid as it was
 	w.Header().Set("HX-Trigger", "folderLoaded")
 	w.Write([]byte(b.String()))
 }
 
-// imageViewHandler renders a full screen view of one image with related images
-func imageViewHandler(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
-	src := q.Get("src") // expected like images/daily/<folder>/file or images/weekly/file
+var errInvalidSrc = errors.New("invalid src")
+
+// resolveImageSrc validates a src query value (expected like
+// images/daily/<folder>/file or images/<category>/file) and returns the cleaned
+// on-disk path below the catalog root. It returns errInvalidSrc when the
+// path escapes images/, and treats files of hidden folders as missing.
+func (c *catalog) resolveImageSrc(src string) (string, error) {
 	if src == "" {
-		http.NotFound(w, r)
-		return
+		return "", os.ErrNotExist
 	}
 	// security: ensure path stays under images
 	if strings.Contains(src, "..") || !strings.HasPrefix(src, "images/") {
-		http.Error(w, "invalid src", http.StatusBadRequest)
+		return "", errInvalidSrc
+	}
+	fullPath := c.dir(filepath.FromSlash(strings.TrimPrefix(src, "images/")))
+	if _, err := c.fs.Stat(fullPath); err != nil {
+		return "", err
+	}
+	if c.inHiddenFolder(fullPath) {
+		return "", os.ErrNotExist
+	}
+	return fullPath, nil
+}
+
+// resolveViewSrc is resolveImageSrc limited to image files: directories and
+// other files under images/ (readme.txt, folder.json, ...) don't exist as
+// far as the viewer is concerned
+func (c *catalog) resolveViewSrc(src string) (string, error) {
+	fullPath, err := c.resolveImageSrc(src)
+	if err != nil {
+		return "", err
+	}
+	if info, err := c.fs.Stat(fullPath); err != nil || info.IsDir() || !isMediaName(fullPath) {
+		return "", os.ErrNotExist
+	}
+	return fullPath, nil
+}
+
+// writeSrcError maps a resolveImageSrc error to an HTTP response
+func writeSrcError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errInvalidSrc) {
+		httpError(w, r, "invalid src", http.StatusBadRequest)
+		return
+	}
+	notFound(w, r)
+}
+
+// downloadHandler streams the original image as an attachment so browsers
+// save it under its real file name
+func (c *catalog) downloadHandler(w http.ResponseWriter, r *http.Request) {
+	fullPath, err := c.resolveImageSrc(r.URL.Query().Get("src"))
+	if err != nil {
+		writeSrcError(w, r, err)
 		return
 	}
-	fullPath := filepath.Clean(src)
-	if _, err := os.Stat(fullPath); err != nil {
+	f, err := c.fs.Open(fullPath)
+	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	// While watermarking or stripping is on, original=1 is the admin's way
+	// to the file as uploaded; everyone else gets the public copy
+	public := (c.cfg.watermarkID != "" || c.cfg.stripMetadata) && isImageName(fullPath)
+	name := info.Name()
+	if public && r.URL.Query().Get("original") == "1" {
+		if !c.cfg.adminAuthEnabled() {
+			http.Error(w, "untouched originals require ADMIN_USER and ADMIN_PASSWORD", http.StatusForbidden)
+			return
+		}
+		if ok, wait := c.srv.adminAuthorized(r); wait > 0 {
+			adminLoginLimited(w, wait)
+			return
+		} else if !ok {
+			adminChallenge(w)
+			return
+		}
+		public = false
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	if public && c.cfg.watermarkID != "" {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + watermarkedExt(fullPath)
+	}
+	// FormatMediaType quotes names with spaces and switches to RFC 2231
+	// encoding (filename*=utf-8'') for non-ASCII names such as Thai text
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": name})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Disposition", disposition)
+	if public {
+		c.servePublicCopy(w, r, fullPath, info)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// imageViewHandler renders a full screen view of one image with related images
+func (c *catalog) imageViewHandler(w http.ResponseWriter, r *http.Request) {
+	fullPath, err := c.resolveViewSrc(r.URL.Query().Get("src"))
+	if errors.Is(err, os.ErrNotExist) {
+		if src := c.dailySrcCase(r.Context(), r.URL.Query().Get("src")); src != "" {
+			q := r.URL.Query()
+			q.Set("src", src)
+			redirectQuery(w, r, c.Prefix+"/view", q)
+			return
+		}
+		c.srv.notFoundPage(w, r)
+		return
+	}
+	if err != nil {
+		writeSrcError(w, r, err)
+		return
+	}
+	data := c.imagePageData(r, fullPath)
+	if r.Context().Err() != nil {
+		return
+	}
+	c.countView(r, data.SrcPath)
+	c.rememberViewed(w, r, data.SrcPath)
+	data.JSONLD = &imageObject{
+		Context:    "https://schema.org",
+		Type:       "ImageObject",
+		Name:       data.FileName,
+		ContentURL: c.cfg.absoluteURL(r, (&url.URL{Path: data.Src}).EscapedPath()),
+		URL:        data.PageURL,
+		Width:      data.Width,
+		Height:     data.Height,
+		Caption:    data.Caption,
+		Keywords:   strings.Join(data.Tags, ", "),
+	}
+	if isVideoName(fullPath) {
+		data.JSONLD.Type = "VideoObject"
+		data.JSONLD.ThumbnailURL = c.cfg.absoluteURL(r, c.Prefix+"/img?"+url.Values{"src": {data.SrcPath}, "w": {"1280"}}.Encode())
+	}
+	// Links to flip through the folder without going back to the gallery.
+	// They stay in the image's own folder even when the carousel is topped
+	// up, and keep the request's related strategy.
+	viewURL := func(img string) string {
+		q := url.Values{"src": {strings.TrimPrefix(img, c.Prefix+"/")}}
+		if s := r.URL.Query().Get("related"); s != "" {
+			q.Set("related", s)
+		}
+		return c.Prefix + "/view?" + q.Encode()
+	}
+	prev, next := data.related.folderNeighbours()
+	if prev != "" {
+		data.PrevView = viewURL(prev)
+	}
+	if next != "" {
+		data.NextView, data.NextImage = viewURL(next), next
+	}
+	relatedImages := data.RelatedImages
+
+	slog.Debug("image view", "src", data.Src, "related", len(relatedImages),
+		"index", data.CurrentIndex, "total", data.TotalImages,
+		"first_related", relatedImages[:min(3, len(relatedImages))])
+
+	c.srv.render(w, http.StatusOK, "image.gohtml", data)
+}
+
+// imageObject is the schema.org ImageObject, or VideoObject for clips,
+// embedded as JSON-LD in view pages. html/template JSON-encodes it inside the ld+json script block, so
+// quotes or </script> in file names can't break out of it.
+type imageObject struct {
+	Context    string `json:"@context"`
+	Type       string `json:"@type"`
+	Name       string `json:"name"`
+	ContentURL string `json:"contentUrl"`
+	URL        string `json:"url"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	Caption    string `json:"caption,omitempty"`
+	Keywords   string `json:"keywords,omitempty"`
+	// ThumbnailURL is the poster of a clip
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+}
 
-	// Initialize data with defaults
+// dailySrcCase rewrites a daily src whose folder differs from the on-disk
+// folder only by case, returning "" when that doesn't produce a valid src
+func (c *catalog) dailySrcCase(ctx context.Context, src string) string {
+	parts := strings.SplitN(src, "/", 4) // images/daily/<folder>/file
+	if len(parts) != 4 || parts[1] != "daily" || !safeFolderRe.MatchString(parts[2]) {
+		return ""
+	}
+	canonical := c.dailyFolderCase(ctx, parts[2])
+	if canonical == "" {
+		return ""
+	}
+	parts[2] = canonical
+	src = strings.Join(parts, "/")
+	if _, err := c.resolveImageSrc(src); err != nil {
+		return ""
+	}
+	return src
+}
+
+// imagePartialHandler renders the same view as imageViewHandler as an HTML
+// fragment (image, related thumbnails, prev/next) for the HTMX lightbox
+func (c *catalog) imagePartialHandler(w http.ResponseWriter, r *http.Request) {
+	fullPath, err := c.resolveViewSrc(r.URL.Query().Get("src"))
+	if err != nil {
+		writeSrcError(w, r, err)
+		return
+	}
+	w.Header().Set("Vary", "Accept-Language")
+	data := c.imagePageData(r, fullPath)
+	if r.Context().Err() != nil {
+		return
+	}
+	c.countView(r, data.SrcPath)
+	c.srv.render(w, http.StatusOK, "image_partial.gohtml", data)
+}
+
+// imagePageData builds the view data shared by the full page and the
+// lightbox fragment so the two never diverge
+func (c *catalog) imagePageData(r *http.Request, fullPath string) ImagePageData {
 	data := ImagePageData{
-		Src:          "/" + filepath.ToSlash(fullPath),
+		Prefix:       c.Prefix,
+		Src:          c.imageURL(fullPath),
+		SrcPath:      c.srcFor(fullPath),
 		FileName:     filepath.Base(fullPath),
-		SiteName:     siteName,
+		SiteName:     c.siteName(),
 		CurrentIndex: 1,
 		TotalImages:  1,
+		Lang:         detectLang(r),
+	}
+	data.T = translations[data.Lang]
+	width, height, taken := c.photoDetails(fullPath)
+	data.Width, data.Height = width, height
+	if c.cfg.photoInfo {
+		data.PhotoInfo = photoInfoLine(width, height, taken, data.T, data.Lang)
 	}
 
 	// Build absolute URLs for social preview
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
-	}
-	data.PageURL = scheme + "://" + r.Host + r.URL.RequestURI()
-	data.OGImage = scheme + "://" + r.Host + data.Src
-	data.Title = data.FileName + " - " + siteName
-	data.Description = "Thai Card Store - View 2d thai card, thai vip card images with 2d lucky numbers and daily tips for thai stock lottery"
-
-	parts := strings.Split(fullPath, "/")
-	var relatedImages []string
-
-	if len(parts) >= 3 && parts[1] == "daily" { // images/daily/<folder>/file
-		data.Kind = "daily"
-		data.Folder = parts[2]
-		// gather related images in same folder
-		related := listImages(filepath.Join("images", "daily", data.Folder))
-		for _, rimg := range related {
-			relatedImages = append(relatedImages, "/"+rimg)
-		}
-		// Find current index in the related images
-		currentImagePath := "/" + filepath.ToSlash(fullPath)
-		for i, rimg := range relatedImages {
-			if rimg == currentImagePath {
-				data.CurrentIndex = i + 1
-				break
-			}
+	data.PageURL = c.cfg.absoluteURL(r, c.Prefix+r.URL.RequestURI())
+	data.OGImage = c.cfg.absoluteURL(r, c.Prefix+"/og?src="+url.QueryEscape(data.SrcPath)+"&lang="+data.Lang)
+	data.Title = data.FileName + " - " + c.siteName()
+	data.Description = c.siteName() + " - View 2d thai card, thai vip card images with 2d lucky numbers and daily tips for thai stock lottery"
+	if data.Caption = c.captionFor(fullPath); data.Caption != "" {
+		data.Description = data.Caption
+	}
+	data.Tags = c.tagsFor(fullPath)
+
+	related := c.relatedImagesFor(r.Context(), fullPath, r.URL.Query().Get("related"))
+	data.Kind = related.Kind
+	data.Folder = related.Folder
+	if related.Kind == "daily" {
+		data.FolderInfo = c.dailyFolderInfo(related.Folder)
+		data.Title = data.FileName + " - " + data.FolderInfo.DisplayName + " - " + c.siteName()
+	}
+	data.RelatedImages = related.Images
+	data.CurrentIndex = related.Index
+	data.TotalImages = len(related.Images)
+	data.FolderImages = related.Own
+	data.RelatedCaptions = map[string]string{}
+	data.RelatedTags = map[string]string{}
+	data.RelatedInfo = map[string]string{}
+	for _, img := range related.Images {
+		src := strings.TrimPrefix(img, c.Prefix+"/")
+		if c.cfg.photoInfo {
+			width, height, taken := c.photoDetails(c.dir(filepath.FromSlash(strings.TrimPrefix(src, "images/"))))
+			data.RelatedInfo[img] = photoInfoLine(width, height, taken, data.T, data.Lang)
 		}
-		data.TotalImages = len(relatedImages)
-	} else if len(parts) >= 2 && parts[1] == "weekly" { // images/weekly/file
-		data.Kind = "weekly"
-		data.Folder = ""
-		related := listImages("images/weekly")
-		for _, rimg := range related {
-			relatedImages = append(relatedImages, "/"+rimg)
-		}
-		// Find current index in the related images
-		currentImagePath := "/" + filepath.ToSlash(fullPath)
-		for i, rimg := range relatedImages {
-			if rimg == currentImagePath {
-				data.CurrentIndex = i + 1
-				break
-			}
+		if caption := c.srcCaption(src); caption != "" {
+			data.RelatedCaptions[img] = caption
 		}
-		data.TotalImages = len(relatedImages)
-	} else {
-		// For images that don't fit daily/weekly pattern, try to get all images
-		data.Kind = "other"
-		data.Folder = ""
-		// Get all images from the images directory recursively
-		allImages := getAllImagesRecursive("images")
-		for _, rimg := range allImages {
-			relatedImages = append(relatedImages, "/"+rimg)
-		}
-		// Find current index
-		currentImagePath := "/" + filepath.ToSlash(fullPath)
-		for i, rimg := range relatedImages {
-			if rimg == currentImagePath {
-				data.CurrentIndex = i + 1
-				break
-			}
+		if tags := c.srcTags(src); len(tags) > 0 {
+			data.RelatedTags[img] = strings.Join(tags, " ")
 		}
-		data.TotalImages = len(relatedImages)
 	}
+	data.Prev, data.Next = related.neighbours()
+	data.related = related
+	return data
+}
 
-	data.RelatedImages = relatedImages
-
-	// Debugging output
-	log.Printf("Debug - Current image: %s", "/"+filepath.ToSlash(fullPath))
-	log.Printf("Debug - Related images count: %d", len(relatedImages))
-	log.Printf("Debug - Current index: %d", data.CurrentIndex)
-	log.Printf("Debug - Total images: %d", data.TotalImages)
-	if len(relatedImages) > 0 {
-		log.Printf("Debug - First few related: %v", relatedImages[:min(3, len(relatedImages))])
-	}
+// relatedResponse is the JSON shape served by /api/related
+type relatedResponse struct {
+	Src    string   `json:"src"`
+	Kind   string   `json:"kind"`
+	Folder string   `json:"folder,omitempty"`
+	Images []string `json:"images"`
+	Index  int      `json:"index"`
+	Total  int      `json:"total"`
+	Prev   string   `json:"prev,omitempty"`
+	Next   string   `json:"next,omitempty"`
+}
 
-	err := templates.ExecuteTemplate(w, "image.gohtml", data)
+// relatedAPIHandler returns the related images of a view as JSON so clients
+// with their own lightbox can prefetch the carousel
+func (c *catalog) relatedAPIHandler(w http.ResponseWriter, r *http.Request) {
+	fullPath, err := c.resolveViewSrc(r.URL.Query().Get("src"))
 	if err != nil {
-		log.Printf("error executing template: %v", err)
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		writeSrcError(w, r, err)
+		return
+	}
+	related := c.relatedImagesFor(r.Context(), fullPath, r.URL.Query().Get("related"))
+	if r.Context().Err() != nil {
+		return
+	}
+	if related.Kind == "other" {
+		httpError(w, r, "unsupported src", http.StatusBadRequest)
+		return
+	}
+	resp := relatedResponse{
+		Src:    c.imageURL(fullPath),
+		Kind:   related.Kind,
+		Folder: related.Folder,
+		Images: related.Images,
+		Index:  related.Index,
+		Total:  len(related.Images),
 	}
+	if resp.Images == nil {
+		resp.Images = []string{}
+	}
+	resp.Prev, resp.Next = related.neighbours()
+	writeJSON(w, resp)
 }
 
-// Helper function to get all images recursively
-func getAllImagesRecursive(dir string) []string {
+// getAllImagesRecursive returns every usable image below dir, sorted. A
+// cancelled ctx stops the walk and yields nil.
+func (c *catalog) getAllImagesRecursive(ctx context.Context, dir string) []string {
 	var images []string
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	err := c.walkLimited(ctx, dir, func(path string, d fs.DirEntry) error {
+		if d.IsDir() || !isMediaName(path) {
+			return nil
 		}
-		if !info.IsDir() {
-			ext := strings.ToLower(filepath.Ext(path))
-			if ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".gif" || ext == ".webp" {
-				images = append(images, filepath.ToSlash(path))
-			}
+		if info, err := d.Info(); err == nil && c.usableImage(path, info) && !c.isWebPVariant(path) {
+			images = append(images, filepath.ToSlash(path))
 		}
 		return nil
 	})
 	if err != nil {
-		log.Printf("Error walking directory %s: %v", dir, err)
+		if ctx.Err() == nil {
+			slog.Error("walking directory", "dir", dir, "err", err)
+		}
 		return nil
 	}
 	sort.Strings(images)
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestViewOnlyServesMedia(t *testing.T) {
+	srv, root := newTestServer(t)
+	if err := os.WriteFile(filepath.Join(root, "weekly", "readme.txt"), []byte("not a card"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		src  string
+		want int
+	}{
+		{"images/weekly/readme.txt", http.StatusNotFound},
+		{"images/daily/2024-06-01", http.StatusNotFound},
+		{"images/daily/2024-06-01/card 1.jpg", http.StatusOK},
+		{"images/../secret.jpg", http.StatusBadRequest},
+	} {
+		for _, path := range []string{"/view", "/view/partial"} {
+			rec := get(t, srv, http.MethodGet, path+"?src="+url.QueryEscape(tc.src))
+			if rec.Code != tc.want {
+				t.Errorf("%s %s: %d, want %d", path, tc.src, rec.Code, tc.want)
+			}
+		}
+	}
+}
+
+func TestHiddenFolderUnreachable(t *testing.T) {
+	srv, root := newTestServer(t)
+	if err := os.WriteFile(filepath.Join(root, "daily", "2024-06-01", hiddenMarker), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	src := url.QueryEscape("images/daily/2024-06-01/card 1.jpg")
+	for _, target := range []string{
+		"/?tab=daily&folder=2024-06-01",
+		"/daily/2024-06-01",
+		"/view?src=" + src,
+		"/download?src=" + src,
+		"/thumb?src=" + src,
+		"/images/daily/2024-06-01/card%201.jpg",
+		"/images/daily/2024-06-01/",
+	} {
+		if rec := get(t, srv, http.MethodGet, target); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: %d, want 404", target, rec.Code)
+		}
+	}
+	req := httptest.NewRequest(http.MethodPost, "/download/selection", strings.NewReader(`["images/daily/2024-06-01/card 1.jpg"]`))
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("selection zip: %d, want 400", rec.Code)
+	}
+	if rec := get(t, srv, http.MethodGet, "/images/weekly/week1.jpg"); rec.Code != http.StatusOK {
+		t.Errorf("visible image: %d, want 200", rec.Code)
+	}
+}
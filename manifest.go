@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+)
+
+// themeColor matches the app bar so the installed app's title bar blends in
+const themeColor = "#0d413d"
+
+// webManifest is the JSON shape of /manifest.json
+type webManifest struct {
+	Name            string         `json:"name"`
+	ShortName       string         `json:"short_name"`
+	StartURL        string         `json:"start_url"`
+	Scope           string         `json:"scope"`
+	Display         string         `json:"display"`
+	BackgroundColor string         `json:"background_color"`
+	ThemeColor      string         `json:"theme_color"`
+	Icons           []manifestIcon `json:"icons"`
+}
+
+type manifestIcon struct {
+	Src     string `json:"src"`
+	Sizes   string `json:"sizes,omitempty"`
+	Type    string `json:"type"`
+	Purpose string `json:"purpose,omitempty"`
+}
+
+// manifestHandler serves the web app manifest that makes the catalog
+// installable. URLs are absolute so they follow the canonical URL settings.
+func (c *catalog) manifestHandler(w http.ResponseWriter, r *http.Request) {
+	icon := manifestIcon{Src: c.cfg.absoluteURL(r, "/appicon.png"), Type: "image/png", Purpose: "any"}
+	// Browsers only pick icons with known sizes, so read them from the file
+	if f, err := c.srv.openAsset("appicon.png"); err == nil {
+		if cfg, _, err := image.DecodeConfig(f); err == nil {
+			icon.Sizes = fmt.Sprintf("%dx%d", cfg.Width, cfg.Height)
+		}
+		f.Close()
+	}
+	m := webManifest{
+		Name:            c.siteName(),
+		ShortName:       c.siteName(),
+		StartURL:        c.cfg.absoluteURL(r, c.Prefix+"/"),
+		Scope:           c.cfg.absoluteURL(r, c.Prefix+"/"),
+		Display:         "standalone",
+		BackgroundColor: "#f9fafb",
+		ThemeColor:      themeColor,
+		Icons:           []manifestIcon{icon},
+	}
+	w.Header().Set("Content-Type", "application/manifest+json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	writeJSON(w, m)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// metadataSettings: metadataDB names the optional SQLite metadata store
+// (METADATA_DB, a file path), which the server opens as its metaDB: one row
+// per visible image with its size, dimensions, upload and capture times and
+// checksum, and one per daily folder. It is kept in step with the files by a
+// sync after each round of the background indexer, so features can query it
+// instead of walking folders.
+type metadataSettings struct {
+	metadataDB string
+}
+
+// metadataMigrations are applied in order; PRAGMA user_version records how
+// many have run. Append only.
+var metadataMigrations = []string{
+	`CREATE TABLE folders (
+		catalog     TEXT NOT NULL,
+		name        TEXT NOT NULL,
+		title       TEXT NOT NULL,
+		description TEXT NOT NULL,
+		sort        TEXT NOT NULL,
+		image_count INTEGER NOT NULL,
+		synced_at   INTEGER NOT NULL,
+		PRIMARY KEY (catalog, name)
+	);
+	CREATE TABLE images (
+		catalog     TEXT NOT NULL,
+		src         TEXT NOT NULL,
+		kind        TEXT NOT NULL,    -- daily, or the category's directory name (weekly, monthly, ...)
+		folder      TEXT NOT NULL,    -- daily folder name, empty for categories
+		size        INTEGER NOT NULL,
+		width       INTEGER NOT NULL,
+		height      INTEGER NOT NULL,
+		uploaded_at INTEGER NOT NULL, -- file modtime, unix seconds
+		checksum    TEXT NOT NULL,    -- hex SHA-256
+		synced_at   INTEGER NOT NULL,
+		PRIMARY KEY (catalog, src)
+	);
+	CREATE INDEX images_by_upload ON images (catalog, uploaded_at);
+	CREATE INDEX images_by_checksum ON images (checksum);`,
+	`ALTER TABLE images ADD COLUMN caption TEXT NOT NULL DEFAULT ''; -- from the image's sidecar file`,
+	// Trigrams match substrings in any script; Thai has no spaces to split
+	// words on. Rewritten whole by every sync.
+	`CREATE VIRTUAL TABLE search_fts USING fts5(catalog UNINDEXED, src UNINDEXED, path, title, caption, tokenize = 'trigram');`,
+	`ALTER TABLE images ADD COLUMN tags TEXT NOT NULL DEFAULT ''; -- space-separated, from the .json sidecar
+	DROP TABLE search_fts;
+	CREATE VIRTUAL TABLE search_fts USING fts5(catalog UNINDEXED, src UNINDEXED, path, title, caption, tags, tokenize = 'trigram');`,
+	// Clearing size makes the next sync rewrite every row, filling in the
+	// capture time and turning the dimensions of rotated photos
+	`ALTER TABLE images ADD COLUMN taken_at INTEGER NOT NULL DEFAULT 0; -- EXIF capture time, unix seconds; 0 when unknown
+	UPDATE images SET size = -1;`,
+	`DROP TABLE search_fts;
+	CREATE VIRTUAL TABLE search_fts USING fts5(catalog UNINDEXED, src UNINDEXED, path, title, caption, tags, numbers, tokenize = 'trigram');`,
+}
+
+func (cfg *config) loadMetadataConfig() {
+	cfg.metadataDB = os.Getenv("METADATA_DB")
+}
+
+// openMetadataDB opens the SQLite file, creating it if needed, and brings
+// its schema up to date
+func openMetadataDB(file string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+file+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// One writer at a time is all SQLite allows anyway
+	db.SetMaxOpenConns(1)
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for i := version; i < len(metadataMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		if _, err := tx.Exec(metadataMigrations[i]); err != nil {
+			tx.Rollback()
+			db.Close()
+			return nil, fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			db.Close()
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// metadataSyncMu runs one sync at a time
+var metadataSyncMu sync.Mutex
+
+type metadataStamp struct {
+	size    int64
+	mod     int64
+	caption string
+	tags    string
+}
+
+// searchRow is a search_fts row waiting to be written
+type searchRow struct {
+	src, path, title, caption, tags, numbers string
+}
+
+// metadataRow is an images row waiting to be written
+type metadataRow struct {
+	src, kind, folder string
+	size              int64
+	width, height     int
+	mod               int64
+	taken             int64 // 0 when unknown
+	sum               string
+	caption, tags     string
+}
+
+// syncMetadata records the catalog's visible folders and images, read with
+// the gallery's own listing functions. Files whose size and modtime match
+// their row are skipped, and the others take their dimensions and checksum
+// from the index, reading the file only when it changed since the last
+// round; rows of files and folders that are gone are deleted. The catalog's
+// full-text rows are rewritten every time, as folder titles can change
+// without any image changing. Everything is
+// read before the write transaction starts, so lookups are only held up for
+// the writes themselves.
+func (c *catalog) syncMetadata(ctx context.Context) error {
+	metadataSyncMu.Lock()
+	defer metadataSyncMu.Unlock()
+	start := time.Now()
+
+	known := map[string]metadataStamp{}
+	rows, err := c.srv.metaDB.QueryContext(ctx, "SELECT src, size, uploaded_at, caption, tags FROM images WHERE catalog = ?", c.Prefix)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var src string
+		var st metadataStamp
+		if err := rows.Scan(&src, &st.size, &st.mod, &st.caption, &st.tags); err != nil {
+			rows.Close()
+			return err
+		}
+		known[src] = st
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	var pending []metadataRow
+	var searchRows []searchRow
+	record := func(img, kind, folder, title string) {
+		src := c.srcFor(img)
+		seen[src] = true
+		info, err := c.fs.Stat(img)
+		if err != nil {
+			return // gone since listing
+		}
+		caption, tags := c.captionFor(img), strings.Join(c.tagsFor(img), " ")
+		searchRows = append(searchRows, searchRow{src: src, path: strings.TrimPrefix(src, "images/"), title: title, caption: caption, tags: tags, numbers: numbersFor(img)})
+		if st, ok := known[src]; ok && st.size == info.Size() && st.mod == info.ModTime().Unix() && st.caption == caption && st.tags == tags {
+			return
+		}
+		f, ok := cachedFacts(img)
+		if !ok || f.size != info.Size() || !f.mod.Equal(info.ModTime()) {
+			if _, err := c.indexImage(img); err != nil {
+				slog.Warn("metadata: reading image failed", "path", img, "err", err)
+				return
+			}
+			if f, ok = cachedFacts(img); !ok {
+				return // changed while being read; the next round picks it up
+			}
+		}
+		row := metadataRow{src: src, kind: kind, folder: folder,
+			size: f.size, width: f.width, height: f.height, mod: f.mod.Unix(), sum: f.sum, caption: caption, tags: tags}
+		if !f.taken.IsZero() {
+			row.taken = f.taken.Unix()
+		}
+		pending = append(pending, row)
+	}
+	folders := c.listDailyFolders(ctx)
+	counts := make([]int, len(folders))
+	for i, f := range folders {
+		imgs := c.listImages(ctx, c.dir("daily", f.Name))
+		counts[i] = len(imgs)
+		for _, img := range imgs {
+			record(img, "daily", f.Name, f.DisplayName)
+		}
+	}
+	for _, cat := range c.categories() {
+		for _, img := range c.listImages(ctx, c.dir(cat.Name)) {
+			record(img, cat.Name, "", cat.Title)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err // a partial listing must not delete rows
+	}
+
+	tx, err := c.srv.metaDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := start.Unix()
+	for _, row := range pending {
+		_, err := tx.ExecContext(ctx, `INSERT INTO images (catalog, src, kind, folder, size, width, height, uploaded_at, taken_at, checksum, caption, tags, synced_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (catalog, src) DO UPDATE SET kind = excluded.kind, folder = excluded.folder, size = excluded.size,
+				width = excluded.width, height = excluded.height, uploaded_at = excluded.uploaded_at, taken_at = excluded.taken_at,
+				checksum = excluded.checksum, caption = excluded.caption, tags = excluded.tags, synced_at = excluded.synced_at`,
+			c.Prefix, row.src, row.kind, row.folder, row.size, row.width, row.height, row.mod, row.taken, row.sum, row.caption, row.tags, now)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM search_fts WHERE catalog = ?", c.Prefix); err != nil {
+		return err
+	}
+	for _, row := range searchRows {
+		_, err := tx.ExecContext(ctx, "INSERT INTO search_fts (catalog, src, path, title, caption, tags, numbers) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			c.Prefix, row.src, row.path, row.title, row.caption, row.tags, row.numbers)
+		if err != nil {
+			return err
+		}
+	}
+	removed := 0
+	for src := range known {
+		if !seen[src] {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM images WHERE catalog = ? AND src = ?", c.Prefix, src); err != nil {
+				return err
+			}
+			removed++
+		}
+	}
+	names := make([]any, 0, len(folders))
+	for i, f := range folders {
+		_, err := tx.ExecContext(ctx, `INSERT INTO folders (catalog, name, title, description, sort, image_count, synced_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (catalog, name) DO UPDATE SET title = excluded.title, description = excluded.description,
+				sort = excluded.sort, image_count = excluded.image_count, synced_at = excluded.synced_at`,
+			c.Prefix, f.Name, f.DisplayName, f.Description, f.Sort, counts[i], now)
+		if err != nil {
+			return err
+		}
+		names = append(names, f.Name)
+	}
+	q := "DELETE FROM folders WHERE catalog = ?"
+	if len(names) > 0 {
+		q += " AND name NOT IN (?" + strings.Repeat(", ?", len(names)-1) + ")"
+	}
+	if _, err := tx.ExecContext(ctx, q, append([]any{c.Prefix}, names...)...); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	c.index.mu.Lock()
+	c.index.fts = true
+	c.index.mu.Unlock()
+	slog.Info("metadata synced", "catalog", c.Prefix, "images", len(seen), "updated", len(pending), "removed", removed,
+		"folders", len(folders), "duration", time.Since(start).Round(time.Millisecond).String())
+	return nil
+}
+
+// imageMetadata is the JSON shape of /api/metadata
+type imageMetadata struct {
+	Src        string     `json:"src"`
+	Kind       string     `json:"kind"`
+	Folder     string     `json:"folder,omitempty"`
+	Size       int64      `json:"size"`
+	Width      int        `json:"width,omitempty"`
+	Height     int        `json:"height,omitempty"`
+	UploadedAt time.Time  `json:"uploaded_at"`
+	TakenAt    *time.Time `json:"taken_at,omitempty"` // EXIF capture time, when known
+	Checksum   string     `json:"checksum"`
+	Caption    string     `json:"caption,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
+}
+
+// metadataAPIHandler returns the stored metadata of the image named by src
+func (c *catalog) metadataAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if c.srv.metaDB == nil {
+		httpError(w, r, "metadata store not enabled", http.StatusNotFound)
+		return
+	}
+	src := path.Clean(strings.TrimPrefix(r.URL.Query().Get("src"), "/"))
+	var m imageMetadata
+	var uploaded, taken int64
+	var tags string
+	err := c.srv.metaDB.QueryRowContext(r.Context(), `SELECT src, kind, folder, size, width, height, uploaded_at, taken_at, checksum, caption, tags
+		FROM images WHERE catalog = ? AND src = ?`, c.Prefix, src).
+		Scan(&m.Src, &m.Kind, &m.Folder, &m.Size, &m.Width, &m.Height, &uploaded, &taken, &m.Checksum, &m.Caption, &tags)
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, r, "image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("metadata lookup failed", "src", src, "err", err)
+		httpError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	m.Src = c.Prefix + "/" + m.Src
+	m.UploadedAt = time.Unix(uploaded, 0).UTC()
+	if taken != 0 {
+		t := time.Unix(taken, 0).In(c.cfg.siteLocation)
+		m.TakenAt = &t
+	}
+	m.Tags = strings.Fields(tags)
+	writeJSON(w, m)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are kept in process and served at /metrics in the Prometheus text
+// format. Handler labels come from a fixed route list so odd URLs can't blow
+// up the number of series.
+
+// Histogram buckets in seconds: requests range from cached 304s to cold
+// thumbnail renders, directory scans from a warm page cache to a slow disk
+var (
+	requestBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	scanBuckets    = []float64{.0005, .001, .005, .01, .05, .1, .5, 1, 5}
+)
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets))
+	}
+	for i, b := range buckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type requestKey struct {
+	handler, method string
+	code            int
+}
+
+var metrics = struct {
+	sync.Mutex
+	requests    map[requestKey]uint64
+	durations   map[string]*histogram // by handler
+	imageBytes  map[string]uint64     // by handler
+	scans       map[string]*histogram // by scan kind
+	rateLimited map[string]uint64     // by limit, pages, images, folder_zip, folder_pdf or admin_login
+}{
+	requests:    map[requestKey]uint64{},
+	durations:   map[string]*histogram{},
+	imageBytes:  map[string]uint64{},
+	scans:       map[string]*histogram{},
+	rateLimited: map[string]uint64{},
+}
+
+// catalogRoutes are the handler labels of catalog routes besides "/"; a
+// trailing slash marks a subtree
+var catalogRoutes = []string{
+	"/images/", "/daily/", "/category/", "/view", "/view/partial", "/download", "/download/selection", "/download/daily/",
+	"/api/related", "/api/folders/status", "/api/duplicates", "/api/metadata", "/api/scroll", "/thumb", "/og", "/qr", "/img", "/img/",
+	"/stats", "/picks", "/search", "/tag/", "/archive", "/manifest.json",
+}
+
+// imageRoutes serve image bytes, counted in image_bytes_served_total
+var imageRoutes = map[string]bool{
+	"/images/": true, "/thumb": true, "/og": true, "/qr": true, "/img": true, "/img/": true, "/download": true, "/download/selection": true, "/download/daily/": true,
+}
+
+// siteRoutes are the handler labels of routes outside any catalog
+var siteRoutes = []string{
+	"/static/", "/appicon.png", "/preview.png", "/prefs", "/healthz", "/readyz", "/metrics", "/admin", "/admin/login", "/admin/logout", "/admin/refresh", "/admin/reload", "/admin/folders/rename", "/admin/folders/cover", "/admin/folders/order", "/admin/duplicates", "/admin/broken", "/admin/images/remove", "/admin/images/tags",
+}
+
+// matchRoute returns the entry of routes that path falls under, or ""
+func matchRoute(routes []string, path string) string {
+	best := ""
+	for _, rt := range routes {
+		if path == rt {
+			return rt
+		}
+		if strings.HasSuffix(rt, "/") && strings.HasPrefix(path, rt) && len(rt) > len(best) {
+			best = rt
+		}
+	}
+	return best
+}
+
+// routeLabel maps a request path to its handler label: the site route, or
+// the catalog route without the catalog prefix, or "other". The catalog
+// root "/" only matches itself since it also catches unknown paths.
+func (s *Server) routeLabel(path string) string {
+	if rt := matchRoute(siteRoutes, path); rt != "" {
+		return rt
+	}
+	for _, c := range s.Catalogs {
+		if c.Prefix != "" && strings.HasPrefix(path, c.Prefix+"/") {
+			path = strings.TrimPrefix(path, c.Prefix)
+			break
+		}
+	}
+	if path == "/" {
+		return "/"
+	}
+	if rt := matchRoute(catalogRoutes, path); rt != "" {
+		return rt
+	}
+	return "other"
+}
+
+// instrument records the count, latency and (for image routes) bytes of
+// every request
+func (s *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		handler := s.routeLabel(r.URL.Path)
+		metrics.Lock()
+		defer metrics.Unlock()
+		metrics.requests[requestKey{handler, r.Method, rec.status}]++
+		h := metrics.durations[handler]
+		if h == nil {
+			h = &histogram{}
+			metrics.durations[handler] = h
+		}
+		h.observe(requestBuckets, time.Since(start).Seconds())
+		if imageRoutes[handler] {
+			metrics.imageBytes[handler] += uint64(rec.bytes)
+		}
+	})
+}
+
+// observeScan records how long a directory scan of the given kind took
+func observeScan(kind string, start time.Time) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	h := metrics.scans[kind]
+	if h == nil {
+		h = &histogram{}
+		metrics.scans[kind] = h
+	}
+	h.observe(scanBuckets, time.Since(start).Seconds())
+}
+
+// metricsHandler writes every metric in the Prometheus text format. The
+// page is rendered into a buffer first so a slow client never holds the
+// locks instrument and observeScan need.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	writeRequestMetrics(&buf)
+	fmt.Fprintln(&buf, "# HELP image_decodes_total Source images decoded for thumbnails and resized renditions.")
+	fmt.Fprintln(&buf, "# TYPE image_decodes_total counter")
+	fmt.Fprintf(&buf, "image_decodes_total %d\n", sourceDecodes.Load())
+	writeOptimizeMetrics(&buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+// writeRequestMetrics writes the metrics kept in metrics, under its lock
+func writeRequestMetrics(w io.Writer) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	fmt.Fprintln(w, "# HELP http_requests_total Requests served, by handler, method and status code.")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	keys := make([]requestKey, 0, len(metrics.requests))
+	for k := range metrics.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.handler != b.handler {
+			return a.handler < b.handler
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "http_requests_total{handler=%q,method=%q,code=\"%d\"} %d\n", k.handler, k.method, k.code, metrics.requests[k])
+	}
+
+	writeHistograms(w, "http_request_duration_seconds", "Request latency, by handler.", "handler", requestBuckets, metrics.durations)
+
+	fmt.Fprintln(w, "# HELP image_bytes_served_total Response bytes of image routes, by handler.")
+	fmt.Fprintln(w, "# TYPE image_bytes_served_total counter")
+	for _, handler := range sortedKeys(metrics.imageBytes) {
+		fmt.Fprintf(w, "image_bytes_served_total{handler=%q} %d\n", handler, metrics.imageBytes[handler])
+	}
+
+	writeHistograms(w, "dir_scan_duration_seconds", "Directory scan time, by kind.", "kind", scanBuckets, metrics.scans)
+
+	fmt.Fprintln(w, "# HELP rate_limited_total Requests refused with 429, by limit.")
+	fmt.Fprintln(w, "# TYPE rate_limited_total counter")
+	for _, kind := range sortedKeys(metrics.rateLimited) {
+		fmt.Fprintf(w, "rate_limited_total{limit=%q} %d\n", kind, metrics.rateLimited[kind])
+	}
+}
+
+// writeHistograms writes one histogram family with a single label
+func writeHistograms(w io.Writer, name, help, label string, buckets []float64, hs map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for _, v := range sortedKeys(hs) {
+		h := hs[v]
+		var cum uint64
+		for i, b := range buckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", name, label, v, strconv.FormatFloat(b, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, label, v, h.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", name, label, v, h.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, label, v, h.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
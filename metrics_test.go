@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stalledWriter is a client that stops reading: Write blocks until release
+// is closed
+type stalledWriter struct {
+	http.ResponseWriter
+	writing, release chan struct{}
+}
+
+func (w *stalledWriter) Write(b []byte) (int, error) {
+	close(w.writing)
+	<-w.release
+	return w.ResponseWriter.Write(b)
+}
+
+func TestMetricsClientDoesNotHoldLocks(t *testing.T) {
+	w := &stalledWriter{httptest.NewRecorder(), make(chan struct{}), make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		close(done)
+	}()
+	<-w.writing
+	if !metrics.TryLock() {
+		t.Error("metrics still locked while the response is written")
+	} else {
+		metrics.Unlock()
+	}
+	if !optimizeTotals.TryLock() {
+		t.Error("optimizeTotals still locked while the response is written")
+	} else {
+		optimizeTotals.Unlock()
+	}
+	close(w.release)
+	<-done
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maintenanceRetryAfter is sent with maintenance responses, in seconds
+const maintenanceRetryAfter = 300
+
+// maintenanceEnabled reports whether maintenance mode is on. It is checked
+// per request: MAINTENANCE=1 in the environment, or the sentinel file named
+// by MAINTENANCE_FILE (default .maintenance) existing, so it can be toggled
+// with touch/rm without a restart.
+func maintenanceEnabled() bool {
+	if os.Getenv("MAINTENANCE") == "1" {
+		return true
+	}
+	sentinel := os.Getenv("MAINTENANCE_FILE")
+	if sentinel == "" {
+		sentinel = ".maintenance"
+	}
+	_, err := os.Stat(sentinel)
+	return err == nil
+}
+
+// maintenanceExempt lists paths still served during maintenance: the health
+// checks, metrics and the assets the maintenance page itself uses
+func maintenanceExempt(path string) bool {
+	return path == "/healthz" || path == "/readyz" || path == "/metrics" || path == "/appicon.png" || strings.HasPrefix(path, "/static/")
+}
+
+// maintenance answers every other route with a styled 503 page while
+// maintenance mode is on
+func (s *Server) maintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maintenanceExempt(r.URL.Path) || !maintenanceEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		lang := detectLang(r)
+		data := struct {
+			SiteName string
+			Lang     string
+			T        map[string]string
+		}{s.siteName(), lang, translations[lang]}
+		w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+		w.Header().Set("Cache-Control", "no-store")
+		s.render(w, http.StatusServiceUnavailable, "maintenance.gohtml", data)
+	})
+}
+
+// healthzHandler reports that the process is alive
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// requiredTemplates are the pages the site can't serve without
+var requiredTemplates = []string{"index.gohtml", "image.gohtml", "image_partial.gohtml", "maintenance.gohtml", "notfound.gohtml", "error.gohtml", "stats.gohtml"}
+
+// missingTemplate returns the first of requiredTemplates that t lacks, or
+// ""
+func missingTemplate(t *template.Template) string {
+	for _, name := range requiredTemplates {
+		if t == nil || t.Lookup(name) == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// readiness is the JSON shape of /readyz; Checks maps each check to "ok" or
+// the reason it failed
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// readyzHandler reports whether the instance can serve pages: every
+// required template parsed and every catalog root is readable. It answers
+// 503 otherwise so load balancers stop routing to the instance.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	res := readiness{Status: "ok", Checks: map[string]string{}}
+	fail := func(check, reason string) {
+		res.Status = "unavailable"
+		res.Checks[check] = reason
+	}
+	res.Checks["templates"] = "ok"
+	if name := missingTemplate(s.current().templates); name != "" {
+		fail("templates", "missing "+name)
+	}
+	for _, c := range s.Catalogs {
+		check := "catalog " + c.Prefix + "/"
+		f, err := c.fs.Open(c.Root)
+		if err == nil {
+			if d, ok := f.(fs.ReadDirFile); ok {
+				_, err = d.ReadDir(1)
+			} else {
+				_, err = c.fs.ReadDir(c.Root)
+			}
+			f.Close()
+			if err == io.EOF { // empty but readable
+				err = nil
+			}
+		}
+		if err != nil {
+			fail(check, err.Error())
+			continue
+		}
+		res.Checks[check] = "ok"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if res.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, res)
+}
+
+// hostSettings decide which Hosts are served and how absolute URLs are
+// built. allowedHosts holds the lower-cased ALLOWED_HOSTS entries; empty
+// means any Host is accepted. canonicalHost (CANONICAL_HOST) replaces r.Host
+// when building absolute URLs; canonicalBaseURL (CANONICAL_BASE_URL, like
+// https://cards.example.com) replaces scheme and host both and wins over
+// everything else. trustProxy (TRUST_PROXY=1) takes the scheme from
+// X-Forwarded-Proto and the client address from X-Forwarded-For, for
+// TLS-terminating proxies.
+type hostSettings struct {
+	allowedHosts     map[string]bool
+	canonicalHost    string
+	canonicalBaseURL string
+	trustProxy       bool
+}
+
+// loadHostConfig reads ALLOWED_HOSTS (comma-separated, ports optional),
+// CANONICAL_HOST, CANONICAL_BASE_URL and TRUST_PROXY
+func (cfg *config) loadHostConfig() {
+	for _, h := range strings.Split(os.Getenv("ALLOWED_HOSTS"), ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			if cfg.allowedHosts == nil {
+				cfg.allowedHosts = map[string]bool{}
+			}
+			cfg.allowedHosts[h] = true
+		}
+	}
+	cfg.canonicalHost = strings.TrimSpace(os.Getenv("CANONICAL_HOST"))
+	if v := strings.TrimSpace(os.Getenv("CANONICAL_BASE_URL")); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			log.Fatalf("invalid CANONICAL_BASE_URL %q: want like https://cards.example.com", v)
+		}
+		cfg.canonicalBaseURL = strings.TrimSuffix(u.String(), "/")
+	}
+	switch v := os.Getenv("TRUST_PROXY"); v {
+	case "", "0":
+	case "1":
+		cfg.trustProxy = true
+	default:
+		log.Fatalf("invalid TRUST_PROXY %q: want 0 or 1", v)
+	}
+}
+
+// hostAllowed reports whether host (as sent in the Host header) matches
+// ALLOWED_HOSTS, either exactly or by hostname without the port
+func (cfg *config) hostAllowed(host string) bool {
+	if cfg.allowedHosts == nil {
+		return true
+	}
+	host = strings.ToLower(host)
+	if cfg.allowedHosts[host] {
+		return true
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return cfg.allowedHosts[name]
+	}
+	return false
+}
+
+// allowedHostsOnly rejects requests whose Host isn't allowed, so a spoofed
+// Host header can't end up in OG tags or other absolute URLs. /healthz and
+// /readyz stay reachable for probes that connect by IP.
+func (s *Server) allowedHostsOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" && r.URL.Path != "/readyz" && !s.cfg.hostAllowed(r.Host) {
+			http.Error(w, "invalid host", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// absoluteURL builds an absolute URL for path (which may carry a query):
+// CANONICAL_BASE_URL when set, otherwise the request's scheme (or the
+// proxy's, with TRUST_PROXY) and CANONICAL_HOST or the request's Host
+func (cfg *config) absoluteURL(r *http.Request, path string) string {
+	if cfg.canonicalBaseURL != "" {
+		return cfg.canonicalBaseURL + path
+	}
+	host := r.Host
+	if cfg.canonicalHost != "" {
+		host = cfg.canonicalHost
+	}
+	return cfg.requestScheme(r) + "://" + host + path
+}
+
+// requestScheme is the scheme the client used: https when the connection is
+// TLS, or as reported by the first X-Forwarded-Proto hop with TRUST_PROXY
+func (cfg *config) requestScheme(r *http.Request) string {
+	if cfg.trustProxy {
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		if proto = strings.ToLower(strings.TrimSpace(proto)); proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// corsSettings are the cross-origin API rules. allowedOrigins holds the
+// ALLOWED_ORIGINS entries for cross-origin API calls; "*" allows any origin
+// and originSuffixes hold the scheme and domain of entries like
+// https://*.example.com. Empty disables CORS headers entirely. corsMethods
+// (CORS_ALLOWED_METHODS) are the methods preflights may ask for, corsHeaders
+// (CORS_ALLOWED_HEADERS) the request headers, or nil to allow whatever is
+// asked, corsExposeHeaders (CORS_EXPOSE_HEADERS) the response headers
+// scripts may read, and corsMaxAge (CORS_MAX_AGE) how long browsers cache a
+// preflight.
+type corsSettings struct {
+	allowedOrigins    map[string]bool
+	originSuffixes    []originPattern
+	anyOrigin         bool
+	corsMethods       []string
+	corsHeaders       []string
+	corsExposeHeaders []string
+	corsMaxAge        time.Duration
+}
+
+// loadCORSConfig reads ALLOWED_ORIGINS (comma-separated origins like
+// https://app.example.com or https://*.example.com, or *) and the
+// CORS_* settings
+func (cfg *config) loadCORSConfig() {
+	for _, o := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		o = strings.ToLower(strings.TrimRight(strings.TrimSpace(o), "/"))
+		switch {
+		case o == "":
+		case o == "*":
+			cfg.anyOrigin = true
+		case strings.Contains(o, "://*."):
+			scheme, domain, _ := strings.Cut(o, "://*")
+			cfg.originSuffixes = append(cfg.originSuffixes, originPattern{scheme + "://", domain})
+		default:
+			if cfg.allowedOrigins == nil {
+				cfg.allowedOrigins = map[string]bool{}
+			}
+			cfg.allowedOrigins[o] = true
+		}
+	}
+	list := func(name string, upper bool) []string {
+		var out []string
+		for _, v := range strings.Split(os.Getenv(name), ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				if upper {
+					v = strings.ToUpper(v)
+				}
+				out = append(out, v)
+			}
+		}
+		return out
+	}
+	if m := list("CORS_ALLOWED_METHODS", true); m != nil {
+		cfg.corsMethods = m
+	}
+	cfg.corsHeaders = list("CORS_ALLOWED_HEADERS", false)
+	if _, ok := os.LookupEnv("CORS_EXPOSE_HEADERS"); ok {
+		cfg.corsExposeHeaders = list("CORS_EXPOSE_HEADERS", false)
+	}
+	if v := os.Getenv("CORS_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("invalid CORS_MAX_AGE %q: want a duration like 10m", v)
+		}
+		cfg.corsMaxAge = d
+	}
+}
+
+// originPattern is a wildcard ALLOWED_ORIGINS entry: scheme "https://" and
+// domain ".example.com" for https://*.example.com
+type originPattern struct{ scheme, domain string }
+
+// originAllowed reports whether a request Origin is allowed by
+// ALLOWED_ORIGINS, including subdomain patterns
+func (cfg *config) originAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	if cfg.anyOrigin || cfg.allowedOrigins[origin] {
+		return true
+	}
+	for _, p := range cfg.originSuffixes {
+		if host, ok := strings.CutPrefix(origin, p.scheme); ok && len(host) > len(p.domain) && strings.HasSuffix(host, p.domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAPIPath reports whether path is a JSON API route, at the site root or
+// under a catalog prefix (/api/... or /<prefix>/api/...)
+func isAPIPath(path string) bool {
+	if strings.HasPrefix(path, "/api/") {
+		return true
+	}
+	rest := strings.TrimPrefix(path, "/")
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		return strings.HasPrefix(rest[i:], "/api/")
+	}
+	return false
+}
+
+// apiCORS adds CORS headers to /api/ responses for allowed origins and
+// answers their preflight requests. Disallowed origins simply get no
+// headers, so the browser blocks the response. Other routes are untouched.
+func (s *Server) apiCORS(next http.Handler) http.Handler {
+	cfg := &s.cfg
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !isAPIPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed := cfg.originAllowed(origin)
+		if allowed {
+			if cfg.anyOrigin {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if len(cfg.corsExposeHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(cfg.corsExposeHeaders, ", "))
+			}
+		}
+		if method := r.Header.Get("Access-Control-Request-Method"); r.Method == http.MethodOptions && method != "" {
+			// A disallowed method gets a bare 204, which the browser
+			// treats as a refusal
+			if allowed && slices.Contains(cfg.corsMethods, strings.ToUpper(method)) {
+				w.Header().Set("Access-Control-Allow-Methods", strings.Join(cfg.corsMethods, ", "))
+				if cfg.corsHeaders != nil {
+					w.Header().Set("Access-Control-Allow-Headers", strings.Join(cfg.corsHeaders, ", "))
+				} else if h := r.Header.Get("Access-Control-Request-Headers"); h != "" {
+					w.Header().Set("Access-Control-Allow-Headers", h)
+				}
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.corsMaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headRecorder stands in for the ResponseWriter of a HEAD request: it holds
+// back the status line and counts the body the handler writes instead of
+// sending it, so the headers can carry the real Content-Length
+type headRecorder struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (h *headRecorder) WriteHeader(code int) {
+	if h.status == 0 {
+		h.status = code
+	}
+}
+
+func (h *headRecorder) Write(b []byte) (int, error) {
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+	// Sniff like the server does for GET, since these bytes never reach it
+	if h.n == 0 && h.Header().Get("Content-Type") == "" {
+		h.Header().Set("Content-Type", http.DetectContentType(b))
+	}
+	h.n += int64(len(b))
+	return len(b), nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (h *headRecorder) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
+// headRequests answers HEAD like GET minus the body. Handlers run as usual
+// (those with expensive bodies check for HEAD themselves) and the response
+// gets the Content-Length of the body that would have been sent.
+func headRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &headRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		bodyless := rec.status < 200 || rec.status == http.StatusNoContent || rec.status == http.StatusNotModified
+		if !bodyless && w.Header().Get("Content-Length") == "" && rec.n > 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(rec.n, 10))
+		}
+		w.WriteHeader(rec.status)
+	})
+}
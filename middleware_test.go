@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeadMatchesGet(t *testing.T) {
+	srv, _ := newTestServer(t)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	// Uncompressed, so lengths compare as sent
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	for _, path := range []string{
+		"/?tab=weekly",
+		"/view?src=images/weekly/week1.jpg",
+		"/api/related?src=images/weekly/week1.jpg",
+	} {
+		do := func(method string) (*http.Response, []byte) {
+			req, _ := http.NewRequest(method, ts.URL+path, nil)
+			req.Header.Set("User-Agent", "Mozilla/5.0")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp, body
+		}
+		get, getBody := do(http.MethodGet)
+		head, headBody := do(http.MethodHead)
+		if get.StatusCode != http.StatusOK || head.StatusCode != get.StatusCode {
+			t.Errorf("%s: HEAD %d, GET %d, want both 200", path, head.StatusCode, get.StatusCode)
+		}
+		if ct := head.Header.Get("Content-Type"); ct == "" || ct != get.Header.Get("Content-Type") {
+			t.Errorf("%s: HEAD Content-Type %q, GET %q", path, ct, get.Header.Get("Content-Type"))
+		}
+		if head.ContentLength != int64(len(getBody)) {
+			t.Errorf("%s: HEAD Content-Length %d, GET body %d bytes", path, head.ContentLength, len(getBody))
+		}
+		if len(headBody) != 0 {
+			t.Errorf("%s: HEAD sent %d body bytes", path, len(headBody))
+		}
+	}
+}
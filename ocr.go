@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ocr (OCR) reads the numbers printed on each card during indexing, so
+// searching for 57 finds every card showing it. "tesseract" runs the
+// tesseract binary (TESSERACT, default "tesseract" on the PATH); an
+// http(s) URL posts each image as a JPEG to that service, with OCR_API_KEY
+// as bearer token, and expects {"text": "..."} back. Off by default. What
+// an engine read is cached next to the thumbnails by file and engine, so
+// each image is read once.
+type ocrSettings struct {
+	ocr ocrEngine
+}
+
+// ocrEngine reads the text printed on an image
+type ocrEngine interface {
+	// ID names the engine in cache keys: switching engines reads every
+	// image again
+	ID() string
+	// Recognize returns the text of img, an upright JPEG
+	Recognize(ctx context.Context, img []byte) (string, error)
+}
+
+func (cfg *config) loadOCRConfig() {
+	v := os.Getenv("OCR")
+	switch {
+	case v == "", v == "off":
+	case v == "tesseract":
+		bin := os.Getenv("TESSERACT")
+		if bin == "" {
+			bin = "tesseract"
+		}
+		p, err := exec.LookPath(bin)
+		if err != nil {
+			log.Fatalf("invalid TESSERACT %q: %v", bin, err)
+		}
+		cfg.ocr = tesseractOCR{path: p}
+	case strings.HasPrefix(v, "http://"), strings.HasPrefix(v, "https://"):
+		if _, err := url.Parse(v); err != nil {
+			log.Fatalf("invalid OCR %q: %v", v, err)
+		}
+		cfg.ocr = apiOCR{url: v, key: os.Getenv("OCR_API_KEY"), client: &http.Client{Timeout: ocrTimeout}}
+	default:
+		log.Fatalf("invalid OCR %q: want off, tesseract or an http(s) URL", v)
+	}
+	if cfg.ocr != nil {
+		slog.Info("ocr", "engine", cfg.ocr.ID())
+	}
+}
+
+// ocrTimeout bounds reading one image
+const ocrTimeout = time.Minute
+
+// ocrMaxSide is the longest side of the image an engine gets: plenty for
+// printed numbers, and it keeps huge photos fast
+const ocrMaxSide = 2000
+
+// tesseractOCR runs the tesseract command line tool, reading digits only
+type tesseractOCR struct {
+	path string
+}
+
+func (t tesseractOCR) ID() string { return "tesseract" }
+
+func (t tesseractOCR) Recognize(ctx context.Context, img []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, ocrTimeout)
+	defer cancel()
+	var out, stderr bytes.Buffer
+	// Page segmentation mode 11 finds text anywhere, as on a card
+	cmd := exec.CommandContext(ctx, t.path, "stdin", "stdout", "--psm", "11", "-c", "tessedit_char_whitelist=0123456789")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(img), &out, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out.String(), nil
+}
+
+// apiOCR posts images to an HTTP OCR service
+type apiOCR struct {
+	url, key string
+	client   *http.Client
+}
+
+func (a apiOCR) ID() string { return a.url }
+
+func (a apiOCR) Recognize(ctx context.Context, img []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(img))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "image/jpeg")
+	if a.key != "" {
+		req.Header.Set("Authorization", "Bearer "+a.key)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ocr service: %s", resp.Status)
+	}
+	var body struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("ocr service: %w", err)
+	}
+	return body.Text, nil
+}
+
+// ocrNumbers returns the numbers c's ocr engine reads on the image at path,
+// space separated, from the cache when it has read the file before. Failures
+// are not cached: the indexer tries again once the file changes or the
+// server restarts.
+func (c *catalog) ocrNumbers(path string, info os.FileInfo) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%d|%d|%s", filepath.ToSlash(path), info.Size(), info.ModTime().UnixNano(), c.cfg.ocr.ID())
+	cachePath := c.cfg.cachePath(thumbCacheDir, hex.EncodeToString(h.Sum(nil))+".ocr.txt")
+	if data, err := os.ReadFile(cachePath); err == nil {
+		return string(data), nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	src, orientation, err := decodeSource(c.fs, path)
+	if err != nil {
+		return "", err
+	}
+	// Engines ignore EXIF orientation, and some can't read every format
+	upright := applyOrientation(resizeToFit(src, ocrMaxSide, ocrMaxSide), orientation)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, upright, &jpeg.Options{Quality: 90}); err != nil {
+		return "", err
+	}
+	start := time.Now()
+	text, err := c.cfg.ocr.Recognize(context.Background(), buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	numbers := extractNumbers(text)
+	slog.Debug("ocr", "path", path, "numbers", numbers, "duration", time.Since(start).Round(time.Millisecond).String())
+	if err := writeFileAtomic(cachePath, []byte(numbers)); err != nil {
+		slog.Warn("ocr cache write", "path", cachePath, "err", err)
+	}
+	return numbers, nil
+}
+
+// extractNumbers returns the runs of digits in text, Thai digits as Arabic
+// ones, each once in order of appearance
+func extractNumbers(text string) string {
+	var numbers []string
+	seen := map[string]bool{}
+	var run strings.Builder
+	flush := func() {
+		if n := run.String(); n != "" && !seen[n] {
+			seen[n] = true
+			numbers = append(numbers, n)
+		}
+		run.Reset()
+	}
+	for _, r := range text {
+		switch {
+		case r >= '0' && r <= '9':
+			run.WriteRune(r)
+		case r >= '๐' && r <= '๙':
+			run.WriteRune('0' + r - '๐')
+		default:
+			flush()
+		}
+	}
+	flush()
+	return strings.Join(numbers, " ")
+}
+
+// numbersFor returns the indexed OCR numbers of the image at path, or ""
+func numbersFor(path string) string {
+	f, _ := cachedFacts(path)
+	return f.numbers
+}
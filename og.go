@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// /og?src= serves the link preview of a view page: a 1200x630 card with
+// the image on the site's theme colour next to the site name, the folder
+// title and date and the caption. Cards are cached next to the thumbnails
+// under a name covering the image and the text, so renaming a folder
+// renders a new one. OG_FONT is a TTF/OTF file for text the bundled Go
+// fonts have no glyphs for, such as Thai.
+type ogSettings struct {
+	ogRegularFont, ogBoldFont *opentype.Font
+	// ogFontID identifies the fonts in card cache names
+	ogFontID string
+}
+
+// Card size recommended by Facebook and used as-is by LINE and X
+const (
+	ogCardWidth  = 1200
+	ogCardHeight = 630
+	ogMargin     = 48
+	ogImageWidth = 540 // of the box the image is fitted into
+)
+
+// defaultOGSettings uses the bundled Go fonts
+func defaultOGSettings() ogSettings {
+	og, err := newOGSettings(goregular.TTF, gobold.TTF)
+	if err != nil {
+		panic(err)
+	}
+	return og
+}
+
+// newOGSettings parses the card fonts
+func newOGSettings(regular, bold []byte) (ogSettings, error) {
+	var og ogSettings
+	var err error
+	if og.ogRegularFont, err = opentype.Parse(regular); err != nil {
+		return ogSettings{}, err
+	}
+	if og.ogBoldFont, err = opentype.Parse(bold); err != nil {
+		return ogSettings{}, err
+	}
+	h := sha256.New()
+	h.Write(regular)
+	h.Write(bold)
+	og.ogFontID = hex.EncodeToString(h.Sum(nil))[:16]
+	return og, nil
+}
+
+func (cfg *config) loadOGConfig() {
+	v := os.Getenv("OG_FONT")
+	if v == "" {
+		return
+	}
+	raw, err := os.ReadFile(v)
+	if err != nil {
+		log.Fatalf("invalid OG_FONT: %v", err)
+	}
+	if cfg.ogSettings, err = newOGSettings(raw, raw); err != nil {
+		log.Fatalf("invalid OG_FONT: %v", err)
+	}
+}
+
+// ogCardText is the text of a card; empty fields are left out
+type ogCardText struct {
+	site, title, date, caption string
+}
+
+// ogCardText returns the text of the card of the image at fullPath: its
+// daily folder's title and date, or its category's label
+func (c *catalog) ogCardText(fullPath, lang string) ogCardText {
+	text := ogCardText{site: c.siteName(), caption: c.captionFor(fullPath)}
+	parts := strings.Split(strings.TrimPrefix(c.srcFor(fullPath), "images/"), "/")
+	if parts[0] == "daily" && len(parts) > 2 {
+		f := c.dailyFolderInfo(parts[1])
+		text.title = f.DisplayName
+		text.date = ogDate(c.cfg.ogRegularFont, f.Date, lang)
+		return text
+	}
+	for _, cat := range c.categories() {
+		if cat.Name == parts[0] {
+			text.title = cat.Label(translations[lang])
+		}
+	}
+	return text
+}
+
+// ogDate formats t for a card, in English when font has no Thai glyphs
+func ogDate(font *opentype.Font, t time.Time, lang string) string {
+	if s := displayDate(t, lang); hasGlyphs(font, s) {
+		return s
+	}
+	return displayDate(t, "en")
+}
+
+// hasGlyphs reports whether f can draw every letter of s
+func hasGlyphs(f *opentype.Font, s string) bool {
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: 12, DPI: 72})
+	if err != nil {
+		return false
+	}
+	defer face.Close()
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		if _, ok := face.GlyphAdvance(r); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ogImageHandler serves the card of the src image, rendering it on first
+// request
+func (c *catalog) ogImageHandler(w http.ResponseWriter, r *http.Request) {
+	fullPath, err := c.resolveImageSrc(r.URL.Query().Get("src"))
+	if err != nil {
+		writeSrcError(w, r, err)
+		return
+	}
+	info, err := c.fs.Stat(fullPath)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	text := c.ogCardText(fullPath, detectLang(r))
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s|%s|%s|%s|%s", c.thumbCacheKey(fullPath, info, ogCardWidth, ogCardHeight, "og"), c.cfg.ogFontID, text.site, text.title, text.date, text.caption)
+	name := hex.EncodeToString(h.Sum(nil)) + ".og.jpg"
+	data, err := c.ogCard(name, fullPath, text)
+	if err != nil {
+		// The site-wide preview beats a missing card
+		slog.Warn("og card failed", "path", fullPath, "err", err)
+		http.ServeFileFS(w, r, c.srv.current().assets, "preview.png")
+		return
+	}
+	// Always JPEG: link previewers can't be counted on for anything newer
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("ETag", `"`+name[:32]+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// ogCard returns the cached card name, rendering it when missing
+func (c *catalog) ogCard(name, fullPath string, text ogCardText) ([]byte, error) {
+	if data, ok := c.srv.thumbs.Get(name); ok {
+		return data, nil
+	}
+	cachePath := c.cfg.cachePath(thumbCacheDir, name)
+	if data, err := os.ReadFile(cachePath); err == nil {
+		c.srv.thumbs.Add(name, data)
+		return data, nil
+	}
+	img, err := c.renderImage(fullPath, ogImageWidth, ogCardHeight-2*ogMargin, fitContain)
+	if err != nil {
+		return nil, err
+	}
+	var logo image.Image
+	if f, err := c.srv.openAsset("appicon.png"); err == nil {
+		logo, _, _ = image.Decode(f)
+		f.Close()
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, c.renderOGCard(img, logo, text), &jpeg.Options{Quality: 88}); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	if err := writeFileAtomic(cachePath, data); err != nil {
+		slog.Warn("og card cache write", "path", cachePath, "err", err)
+	}
+	c.srv.thumbs.Add(name, data)
+	return data, nil
+}
+
+// renderOGCard lays out a card: img in a white frame on the left, the
+// logo and site name at the top right with the title, date and caption
+// below them
+func (c *catalog) renderOGCard(img, logo image.Image, text ogCardText) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, ogCardWidth, ogCardHeight))
+	// The theme colour, darkening towards the bottom
+	base := color.RGBA{0x0d, 0x41, 0x3d, 0xff} // themeColor
+	for y := 0; y < ogCardHeight; y++ {
+		k := 1 - 0.45*float64(y)/ogCardHeight
+		row := color.RGBA{uint8(float64(base.R) * k), uint8(float64(base.G) * k), uint8(float64(base.B) * k), 0xff}
+		draw.Draw(dst, image.Rect(0, y, ogCardWidth, y+1), image.NewUniform(row), image.Point{}, draw.Src)
+	}
+
+	b := img.Bounds()
+	boxHeight := ogCardHeight - 2*ogMargin
+	x := ogMargin + (ogImageWidth-b.Dx())/2
+	y := ogMargin + (boxHeight-b.Dy())/2
+	const frame = 6
+	draw.Draw(dst, image.Rect(x-frame, y-frame, x+b.Dx()+frame, y+b.Dy()+frame), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(x, y, x+b.Dx(), y+b.Dy()), img, b.Min, draw.Over)
+
+	left := ogMargin + ogImageWidth + 56
+	width := ogCardWidth - ogMargin - left
+	top := ogMargin
+	if logo != nil {
+		const size = 56
+		draw.CatmullRom.Scale(dst, image.Rect(left, top, left+size, top+size), logo, logo.Bounds(), draw.Over, nil)
+		top += size + 28
+	}
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	muted := color.RGBA{0xcc, 0xdd, 0xdb, 0xff}
+	accent := color.RGBA{0x99, 0xf6, 0xe4, 0xff}
+	top = drawOGText(dst, c.cfg.ogRegularFont, 30, muted, text.site, left, top, width, 2)
+	top += 20
+	top = drawOGText(dst, c.cfg.ogBoldFont, 56, white, text.title, left, top, width, 3)
+	top += 12
+	top = drawOGText(dst, c.cfg.ogRegularFont, 36, accent, text.date, left, top, width, 1)
+	top += 20
+	drawOGText(dst, c.cfg.ogRegularFont, 30, muted, text.caption, left, top, width, 3)
+	return dst
+}
+
+// drawOGText draws s wrapped to width in at most maxLines lines with its
+// top at y, and returns the y below it. Text the font can't draw is left
+// out rather than shown as boxes.
+func drawOGText(dst *image.RGBA, f *opentype.Font, size float64, c color.Color, s string, x, y, width, maxLines int) int {
+	if s == "" || !hasGlyphs(f, s) {
+		return y
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return y
+	}
+	defer face.Close()
+	d := font.Drawer{Dst: dst, Src: image.NewUniform(c), Face: face}
+	m := face.Metrics()
+	lineHeight := int(size * 1.25)
+	for _, line := range wrapOGText(d, s, width, maxLines) {
+		d.Dot = fixed.P(x, y+m.Ascent.Ceil())
+		d.DrawString(line)
+		y += lineHeight
+	}
+	return y
+}
+
+// wrapOGText breaks s into lines no wider than width, between words where
+// it can and anywhere in a word that is too long alone (Thai has no spaces
+// between words). A last line that doesn't fit everything ends in "…".
+func wrapOGText(d font.Drawer, s string, width, maxLines int) []string {
+	fits := func(s string) bool { return d.MeasureString(s).Ceil() <= width }
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(s) {
+		if line != "" && fits(line+" "+word) {
+			line += " " + word
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		line = ""
+		for _, r := range word {
+			if line != "" && !fits(line+string(r)) {
+				lines = append(lines, line)
+				line = ""
+			}
+			line += string(r)
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	if len(lines) > maxLines {
+		last := []rune(lines[maxLines-1])
+		for len(last) > 0 && !fits(string(last)+"…") {
+			last = last[:len(last)-1]
+		}
+		lines = append(lines[:maxLines-1], strings.TrimRight(string(last), " ")+"…")
+	}
+	return lines
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// optimizeOriginals (OPTIMIZE=1; off by default, as it rewrites the files
+// themselves) normalizes JPEG photos when the indexer finds them: they are
+// turned upright by their EXIF orientation, scaled down to
+// optimizeMaxSide (OPTIMIZE_MAX_SIDE, default 4096) and re-encoded at
+// optimizeQuality (OPTIMIZE_QUALITY, default 85) when saved at a higher
+// quality. The file as uploaded is kept below optimizeBackupDir first,
+// EXIF data and the colour profile carry over, and the modtime is kept so
+// sort orders don't change. Every rewrite is appended to optimizeLogFile
+// with the bytes saved, and totalled in /metrics.
+type optimizeSettings struct {
+	optimizeOriginals bool
+	optimizeMaxSide   int
+	optimizeQuality   int
+}
+
+func (cfg *config) loadOptimizeConfig() {
+	switch v := os.Getenv("OPTIMIZE"); v {
+	case "", "0":
+	case "1":
+		cfg.optimizeOriginals = true
+	default:
+		log.Fatalf("invalid OPTIMIZE %q: want 0 or 1", v)
+	}
+	if v := os.Getenv("OPTIMIZE_MAX_SIDE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 640 || n > 16384 {
+			log.Fatalf("invalid OPTIMIZE_MAX_SIDE %q: want 640-16384", v)
+		}
+		cfg.optimizeMaxSide = n
+	}
+	if v := os.Getenv("OPTIMIZE_QUALITY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 50 || n > 100 {
+			log.Fatalf("invalid OPTIMIZE_QUALITY %q: want 50-100", v)
+		}
+		cfg.optimizeQuality = n
+	}
+}
+
+// Where in the cache directory the pipeline keeps files as uploaded, by
+// date and catalog like trashDir, and its record of every rewrite, one JSON
+// object a line
+const (
+	optimizeBackupDir = "originals"
+	optimizeLogFile   = "optimized.jsonl"
+)
+
+// optimizeChecked remembers files that need nothing, or failed, by path,
+// size and modtime, so each round doesn't read them again
+var optimizeChecked = struct {
+	sync.Mutex
+	m map[string]optimizeStamp
+}{m: map[string]optimizeStamp{}}
+
+type optimizeStamp struct {
+	size int64
+	mod  time.Time
+}
+
+// optimizeRecord is one line of optimizeLogFile
+type optimizeRecord struct {
+	Time    time.Time `json:"time"`
+	Path    string    `json:"path"`
+	Before  int64     `json:"before"`
+	After   int64     `json:"after"`
+	Saved   int64     `json:"saved"`
+	Rotated bool      `json:"rotated,omitempty"`
+	Resized bool      `json:"resized,omitempty"`
+	Backup  string    `json:"backup,omitempty"`
+}
+
+// optimizeTotals are the rewrites since startup, for /metrics
+var optimizeTotals struct {
+	sync.Mutex
+	files int
+	saved int64
+}
+
+// optimizeImages runs the JPEGs of every ingest directory through the
+// pipeline and returns how many it rewrote
+func (c *catalog) optimizeImages(ctx context.Context) int {
+	if !c.cfg.optimizeOriginals {
+		return 0
+	}
+	optimized := 0
+	for _, dir := range c.ingestDirs() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if ctx.Err() != nil {
+				return optimized
+			}
+			switch strings.ToLower(filepath.Ext(e.Name())) {
+			case ".jpg", ".jpeg":
+			default:
+				continue
+			}
+			if e.Type().IsRegular() && c.optimizeImage(filepath.Join(dir, e.Name())) {
+				optimized++
+			}
+		}
+	}
+	return optimized
+}
+
+// optimizeImage rewrites the JPEG at path when it is sideways, too large
+// or saved at a higher quality than it needs, and reports whether it did
+func (c *catalog) optimizeImage(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	stamp := optimizeStamp{size: info.Size(), mod: info.ModTime()}
+	optimizeChecked.Lock()
+	checked := optimizeChecked.m[path] == stamp
+	optimizeChecked.Unlock()
+	if checked {
+		return false
+	}
+	rec, err := c.rewriteJPEG(path, info)
+	if err != nil {
+		slog.Warn("optimize failed", "path", path, "err", err)
+	}
+	if rec == nil {
+		optimizeChecked.Lock()
+		optimizeChecked.m[path] = stamp
+		optimizeChecked.Unlock()
+		return false
+	}
+	slog.Info("image optimized", "path", path, "before", rec.Before, "after", rec.After, "saved", rec.Saved,
+		"rotated", rec.Rotated, "resized", rec.Resized)
+	optimizeTotals.Lock()
+	optimizeTotals.files++
+	optimizeTotals.saved += rec.Saved
+	optimizeTotals.Unlock()
+	if line, err := json.Marshal(rec); err == nil {
+		if f, err := os.OpenFile(c.cfg.cachePath(optimizeLogFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644); err == nil {
+			f.Write(append(line, '\n'))
+			f.Close()
+		}
+	}
+	return true
+}
+
+// rewriteJPEG does the work of optimizeImage, returning nil when the file
+// is left as it is
+func (c *catalog) rewriteJPEG(path string, info os.FileInfo) (*optimizeRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	jcfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	orientation := readExif(bytes.NewReader(data), time.UTC).orientation
+	rotate := orientation != 1
+	maxSide, quality := c.cfg.optimizeMaxSide, c.cfg.optimizeQuality
+	resize := max(jcfg.Width, jcfg.Height) > maxSide
+	if !rotate && !resize && jpegQuality(data) <= quality {
+		return nil, nil
+	}
+	src, _, err := decodeSource(osStorage{}, path)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	upright := applyOrientation(resizeToFit(src, maxSide, maxSide), orientation)
+	if err := jpeg.Encode(&buf, upright, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	out := carryJPEGMetadata(data, buf.Bytes())
+	if !rotate && !resize && len(out) >= len(data) {
+		return nil, nil // a lower quality setting that doesn't pay
+	}
+
+	rel, err := filepath.Rel(c.Root, path)
+	if err != nil {
+		return nil, err
+	}
+	backup := c.cfg.cachePath(optimizeBackupDir, time.Now().Format("20060102"), filepath.Base(c.Root), rel)
+	if err := os.MkdirAll(filepath.Dir(backup), 0o755); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(backup, data); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, out); err != nil {
+		return nil, err
+	}
+	// writeFileAtomic's temp files are private
+	if err := os.Chmod(path, info.Mode().Perm()); err != nil {
+		return nil, err
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		return nil, err
+	}
+	return &optimizeRecord{
+		Time: time.Now().UTC(), Path: filepath.ToSlash(path), Before: int64(len(data)), After: int64(len(out)),
+		Saved: int64(len(data) - len(out)), Rotated: rotate, Resized: resize, Backup: filepath.ToSlash(backup),
+	}, nil
+}
+
+// ijgLuminanceSum is the sum of the IJG reference luminance quantization
+// table, which libjpeg, Go and most cameras scale by quality
+const ijgLuminanceSum = 3688
+
+// jpegQuality estimates the IJG quality (1-100) a JPEG was saved at from
+// its luminance quantization table, or returns 0 when it has none
+func jpegQuality(data []byte) int {
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || end > len(data) {
+			return 0
+		}
+		// A DQT segment holds one or more tables, each a precision and id
+		// byte followed by 64 values
+		for j := i + 4; marker == 0xDB && j < end; {
+			wide := data[j]>>4 != 0 // 16-bit values
+			size := 64
+			if wide {
+				size = 128
+			}
+			if j+1+size > end {
+				return 0
+			}
+			if data[j]&0x0F == 0 {
+				sum := 0
+				for k := 0; k < 64; k++ {
+					if wide {
+						sum += int(binary.BigEndian.Uint16(data[j+1+2*k:]))
+					} else {
+						sum += int(data[j+1+k])
+					}
+				}
+				scale := float64(sum) * 100 / ijgLuminanceSum
+				if scale <= 100 {
+					return min(int((200-scale)/2+0.5), 100)
+				}
+				return max(int(5000/scale+0.5), 1)
+			}
+			j += 1 + size
+		}
+		i = end
+	}
+	return 0
+}
+
+// carryJPEGMetadata copies the EXIF (APP1) and ICC profile (APP2) segments
+// of orig into encoded, right after its start marker. The EXIF orientation
+// is reset to 1, as encoded is already upright.
+func carryJPEGMetadata(orig, encoded []byte) []byte {
+	var segments []byte
+	for i := 2; i+4 <= len(orig) && orig[i] == 0xFF; {
+		marker := orig[i+1]
+		end := i + 2 + int(binary.BigEndian.Uint16(orig[i+2:]))
+		if marker == 0xDA || end > len(orig) {
+			break
+		}
+		seg := orig[i:end]
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(seg[4:], []byte("Exif\x00\x00")):
+			seg = bytes.Clone(seg)
+			resetOrientation(seg[10:])
+			segments = append(segments, seg...)
+		case marker == 0xE2 && bytes.HasPrefix(seg[4:], []byte("ICC_PROFILE\x00")):
+			segments = append(segments, seg...)
+		}
+		i = end
+	}
+	out := make([]byte, 0, len(encoded)+len(segments))
+	out = append(out, encoded[:2]...)
+	out = append(out, segments...)
+	return append(out, encoded[2:]...)
+}
+
+// resetOrientation sets the orientation tag of the TIFF header b to 1 in
+// place
+func resetOrientation(b []byte) {
+	if len(b) < 8 {
+		return
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+	if e, ok := tiffIFD(b, order, int(order.Uint32(b[4:])))[tagOrientation]; ok && order.Uint16(e[2:]) == 3 { // SHORT
+		order.PutUint16(e[8:], 1)
+	}
+}
+
+// writeOptimizeMetrics writes the pipeline's totals in the Prometheus text
+// format
+func writeOptimizeMetrics(w io.Writer) {
+	optimizeTotals.Lock()
+	files, saved := optimizeTotals.files, optimizeTotals.saved
+	optimizeTotals.Unlock()
+	fmt.Fprintln(w, "# HELP images_optimized_total Originals rewritten by the ingest pipeline since startup.")
+	fmt.Fprintln(w, "# TYPE images_optimized_total counter")
+	fmt.Fprintf(w, "images_optimized_total %d\n", files)
+	fmt.Fprintln(w, "# HELP images_optimized_bytes_saved_total Bytes saved by the ingest pipeline since startup.")
+	fmt.Fprintln(w, "# TYPE images_optimized_bytes_saved_total counter")
+	fmt.Fprintf(w, "images_optimized_bytes_saved_total %d\n", saved)
+}
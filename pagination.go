@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// paginationSettings: pageSize (PAGE_SIZE) is how many images a gallery
+// page or folder partial shows when the request has no limit param;
+// maxPageSize caps the param.
+type paginationSettings struct {
+	pageSize int
+}
+
+const maxPageSize = 200
+
+func (cfg *config) loadPaginationConfig() {
+	if v := os.Getenv("PAGE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			log.Fatalf("invalid PAGE_SIZE %q: want 1-%d", v, maxPageSize)
+		}
+		cfg.pageSize = n
+	}
+}
+
+var errInvalidPage = errors.New("page and limit must be positive numbers")
+
+// pagination is one page of a listing. Page is 1-based; Limit is only set
+// when the request chose it, so links keep it.
+type pagination struct {
+	Page, TotalPages int
+	Limit            int
+	Start, End       int // slice bounds of the page in the listing
+}
+
+// paginate reads the page and limit params for a listing of n items. A
+// page past the end shows the last one, so bookmarks survive deletions.
+func (c *catalog) paginate(r *http.Request, n int) (pagination, error) {
+	p := pagination{Page: 1}
+	size := c.cfg.pageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 {
+			return p, errInvalidPage
+		}
+		p.Limit = min(l, maxPageSize)
+		size = p.Limit
+	}
+	if v := r.URL.Query().Get("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return p, errInvalidPage
+		}
+		p.Page = page
+	}
+	p.TotalPages = max((n+size-1)/size, 1)
+	p.Page = min(p.Page, p.TotalPages)
+	p.Start = min((p.Page-1)*size, n)
+	p.End = min(p.Start+size, n)
+	return p, nil
+}
+
+// query adds the page and limit params to q, leaving page 1 implicit
+func (p pagination) query(q url.Values, page int) url.Values {
+	pq := url.Values{}
+	for k, v := range q {
+		pq[k] = v
+	}
+	if page > 1 {
+		pq.Set("page", strconv.Itoa(page))
+	}
+	if p.Limit > 0 {
+		pq.Set("limit", strconv.Itoa(p.Limit))
+	}
+	return pq
+}
+
+// pager is the data of the "pager" template: links to the neighbouring
+// pages of a gallery tab. HTMX fetches the linked page and swaps its Target
+// element in for the current one, without reloading the page.
+type pager struct {
+	Page, TotalPages int
+	PrevURL, NextURL string // empty at either end
+	Target           string // element id
+	T                map[string]string
+}
+
+func (p pagination) pager(prefix string, q url.Values, target string, t map[string]string) *pager {
+	if p.TotalPages < 2 {
+		return nil
+	}
+	pg := &pager{Page: p.Page, TotalPages: p.TotalPages, Target: target, T: t}
+	if p.Page > 1 {
+		pg.PrevURL = prefix + "/?" + p.query(q, p.Page-1).Encode()
+	}
+	if p.Page < p.TotalPages {
+		pg.NextURL = prefix + "/?" + p.query(q, p.Page+1).Encode()
+	}
+	return pg
+}
+
+// partialPager renders the pager of an images partial by hand, like the
+// partial itself. Links fetch the neighbouring partial into the target and
+// put the gallery URL of that page in the address bar.
+func (c *catalog) partialPager(set imagesPartial, lang, sortBy string, p pagination, t map[string]string) string {
+	partialQuery := url.Values{"lang": {lang}}
+	if sortBy != "" {
+		partialQuery.Set("sort", sortBy)
+	}
+	link := func(page int, label string) string {
+		full := c.Prefix + "/?" + p.query(set.tab, page).Encode()
+		partial := c.Prefix + set.path + "?" + p.query(partialQuery, page).Encode()
+		return "<a href='" + template.HTMLEscapeString(full) + "' hx-get='" + template.HTMLEscapeString(partial) +
+			"' hx-target='#" + set.target + "' hx-swap='innerHTML show:#" + set.anchor + ":top' hx-push-url='" + template.HTMLEscapeString(full) +
+			"' class='text-indigo-600 hover:underline'>" + template.HTMLEscapeString(label) + "</a>"
+	}
+	var b strings.Builder
+	b.WriteString("<nav class='pager col-span-full mt-4 flex items-center justify-center gap-4 text-sm'>")
+	if p.Page > 1 {
+		b.WriteString(link(p.Page-1, t["previous"]))
+	}
+	b.WriteString("<span class='text-gray-500'>" + strconv.Itoa(p.Page) + " / " + strconv.Itoa(p.TotalPages) + "</span>")
+	if p.Page < p.TotalPages {
+		b.WriteString(link(p.Page+1, t["next"]))
+	}
+	b.WriteString("</nav>")
+	return b.String()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// /download/daily/<folder>.pdf lays a daily folder out on A4 pages for
+// printing, ?per=1 (the default), 2, 4, 6 or 9 images to a page. Images are
+// embedded as the JPEGs the thumbnail cache already makes, at 200 dpi for
+// the space they get. Each client IP may start folderPDFPerHour
+// (FOLDER_PDF_PER_HOUR, default 10; 0 for no limit) of them an hour,
+// counted by the server's folderPDFs limiter.
+type folderPDFSettings struct {
+	folderPDFPerHour float64
+}
+
+// maxFolderPDFImages caps how many images one PDF may contain
+const maxFolderPDFImages = 200
+
+func (cfg *config) loadFolderPDFConfig() {
+	if v := os.Getenv("FOLDER_PDF_PER_HOUR"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || math.IsInf(f, 0) {
+			log.Fatalf("invalid FOLDER_PDF_PER_HOUR %q: want a non-negative number, 0 for no limit", v)
+		}
+		cfg.folderPDFPerHour = f
+	}
+}
+
+// A4 in points, with the margin around and gap between images
+const (
+	a4Width   = 595.28
+	a4Height  = 841.89
+	pdfMargin = 24.0
+	pdfGap    = 12.0
+	pdfDPI    = 200
+)
+
+// pdfGrids are the columns and rows of each supported per value
+var pdfGrids = map[int][2]int{1: {1, 1}, 2: {1, 2}, 4: {2, 2}, 6: {2, 3}, 9: {3, 3}}
+
+// folderPDFHandler streams a PDF of every image of a visible daily folder,
+// in the folder's default order
+func (c *catalog) folderPDFHandler(w http.ResponseWriter, r *http.Request) {
+	folder, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/download/daily/"), ".pdf")
+	if !ok || !safeFolderRe.MatchString(folder) {
+		http.NotFound(w, r)
+		return
+	}
+	dir := c.dir("daily", folder)
+	if info, err := c.fs.Stat(dir); err != nil || !info.IsDir() || c.folderHidden(dir) {
+		http.NotFound(w, r)
+		return
+	}
+	per := 1
+	if v := r.URL.Query().Get("per"); v != "" {
+		per, _ = strconv.Atoi(v)
+	}
+	grid, ok := pdfGrids[per]
+	if !ok {
+		http.Error(w, "invalid per: want 1, 2, 4, 6 or 9", http.StatusBadRequest)
+		return
+	}
+	info := c.dailyFolderInfo(folder)
+	imgs := c.sortImages(c.listImages(r.Context(), dir), info.Sort)
+	if len(imgs) == 0 {
+		http.Error(w, "folder has no images", http.StatusNotFound)
+		return
+	}
+	if len(imgs) > maxFolderPDFImages {
+		http.Error(w, fmt.Sprintf("folder too large to print at once: max %d images", maxFolderPDFImages), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if l := c.srv.folderPDFs; l != nil {
+		if ok, wait := l.take(c.cfg.clientIP(r), 1, 1); !ok {
+			metrics.Lock()
+			metrics.rateLimited["folder_pdf"]++
+			metrics.Unlock()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			httpError(w, r, "too many folder downloads, try again later", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	// Inline, so browsers open it in their viewer, ready to print
+	disposition := mime.FormatMediaType("inline", map[string]string{"filename": folder + ".pdf"})
+	if disposition == "" {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", disposition)
+	if r.Method == http.MethodHead {
+		return
+	}
+	cols, rows := grid[0], grid[1]
+	cellWidth := (a4Width - 2*pdfMargin - float64(cols-1)*pdfGap) / float64(cols)
+	cellHeight := (a4Height - 2*pdfMargin - float64(rows-1)*pdfGap) / float64(rows)
+	pixelWidth, pixelHeight := int(cellWidth*pdfDPI/72), int(cellHeight*pdfDPI/72)
+
+	p := newPDFWriter(w)
+	var pages []int
+	for start := 0; start < len(imgs); start += per {
+		var content bytes.Buffer
+		var xobjects []string
+		for i, img := range imgs[start:min(start+per, len(imgs))] {
+			fileInfo, err := c.fs.Stat(img)
+			if err != nil {
+				continue // gone since listing
+			}
+			data, err := c.thumbnailFor(img, fileInfo, pixelWidth, pixelHeight, fitContain)
+			if err != nil {
+				// The stream has started: leave the cell empty
+				slog.Warn("folder pdf: image failed", "path", img, "err", err)
+				continue
+			}
+			id, imgWidth, imgHeight, err := p.jpeg(data)
+			if err != nil {
+				slog.Warn("folder pdf: image failed", "path", img, "err", err)
+				continue
+			}
+			// Fit the image into its cell, centred; PDF's origin is the
+			// bottom left corner
+			scale := math.Min(cellWidth/float64(imgWidth), cellHeight/float64(imgHeight))
+			drawWidth, drawHeight := float64(imgWidth)*scale, float64(imgHeight)*scale
+			col, row := i%cols, i/cols
+			x := pdfMargin + float64(col)*(cellWidth+pdfGap) + (cellWidth-drawWidth)/2
+			y := a4Height - pdfMargin - float64(row)*(cellHeight+pdfGap) - cellHeight + (cellHeight-drawHeight)/2
+			name := fmt.Sprintf("Im%d", i)
+			fmt.Fprintf(&content, "q %.2f 0 0 %.2f %.2f %.2f cm /%s Do Q\n", drawWidth, drawHeight, x, y, name)
+			xobjects = append(xobjects, fmt.Sprintf("/%s %d 0 R", name, id))
+		}
+		contentID := p.stream("", content.Bytes())
+		pages = append(pages, p.object(fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << %s >> >> /Contents %d 0 R >>",
+			pdfPagesID, a4Width, a4Height, strings.Join(xobjects, " "), contentID)))
+	}
+	if err := p.finish(pages, info.DisplayName); err != nil {
+		// Headers are gone by now; all we can do is log and cut the stream
+		slog.Warn("folder pdf", "folder", folder, "err", err)
+	}
+}
+
+// Object numbers fixed up front, as pages point at their parent before it
+// is written
+const (
+	pdfCatalogID = 1
+	pdfPagesID   = 2
+)
+
+// pdfWriter writes a PDF front to back, one object at a time, remembering
+// where each starts for the cross-reference table at the end. Write errors
+// are kept and returned by finish.
+type pdfWriter struct {
+	w       io.Writer
+	n       int64
+	offsets []int64 // by object number - 1
+	err     error
+}
+
+func newPDFWriter(w io.Writer) *pdfWriter {
+	p := &pdfWriter{w: w, offsets: make([]int64, pdfPagesID)}
+	// The binary comment tells transfer tools the file isn't text
+	p.write([]byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n"))
+	return p
+}
+
+func (p *pdfWriter) write(b []byte) {
+	if p.err != nil {
+		return
+	}
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	p.err = err
+}
+
+// begin starts object id, or a new object when id is 0, and returns its
+// number
+func (p *pdfWriter) begin(id int) int {
+	if id == 0 {
+		p.offsets = append(p.offsets, 0)
+		id = len(p.offsets)
+	}
+	p.offsets[id-1] = p.n
+	p.write([]byte(strconv.Itoa(id) + " 0 obj\n"))
+	return id
+}
+
+// object writes a new object holding body
+func (p *pdfWriter) object(body string) int {
+	id := p.begin(0)
+	p.write([]byte(body + "\nendobj\n"))
+	return id
+}
+
+// stream writes a new stream object; dict holds its entries besides
+// Length
+func (p *pdfWriter) stream(dict string, data []byte) int {
+	id := p.begin(0)
+	p.write([]byte(fmt.Sprintf("<< %s/Length %d >>\nstream\n", dict, len(data))))
+	p.write(data)
+	p.write([]byte("\nendstream\nendobj\n"))
+	return id
+}
+
+// jpeg writes a JPEG as an image object, which PDF readers decode
+// themselves, and returns its number and pixel size
+func (p *pdfWriter) jpeg(data []byte) (id, width, height int, err error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	space := "/DeviceRGB"
+	if cfg.ColorModel == color.GrayModel {
+		space = "/DeviceGray"
+	}
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode ",
+		cfg.Width, cfg.Height, space)
+	return p.stream(dict, data), cfg.Width, cfg.Height, nil
+}
+
+// finish writes the page tree, the catalog, the document title and the
+// cross-reference table
+func (p *pdfWriter) finish(pages []int, title string) error {
+	kids := make([]string, len(pages))
+	for i, id := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", id)
+	}
+	p.begin(pdfPagesID)
+	p.write([]byte(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), len(pages))))
+	p.begin(pdfCatalogID)
+	p.write([]byte(fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>\nendobj\n", pdfPagesID)))
+	infoID := p.object("<< /Title " + pdfText(title) + " >>")
+
+	xref := p.n
+	var b strings.Builder
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(p.offsets)+1)
+	for _, off := range p.offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(p.offsets)+1, pdfCatalogID, infoID, xref)
+	p.write([]byte(b.String()))
+	return p.err
+}
+
+// pdfText encodes s as a PDF text string: UTF-16BE with a byte order mark,
+// in hex, which covers Thai and needs no escaping
+func pdfText(s string) string {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2, 2+2*len(u))
+	b[0], b[1] = 0xFE, 0xFF
+	for _, c := range u {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return "<" + hex.EncodeToString(b) + ">"
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"log/slog"
+	"math/bits"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/image/draw"
+)
+
+// similarDistance (SIMILAR_DISTANCE, default 6) is how many of the 64 bits
+// of two perceptual hashes may differ for the images to be reported as
+// likely duplicates. 0 only matches visually identical images.
+type similarSettings struct {
+	similarDistance int
+}
+
+func (cfg *config) loadSimilarConfig() {
+	if v := os.Getenv("SIMILAR_DISTANCE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 32 {
+			log.Fatalf("invalid SIMILAR_DISTANCE %q: want 0-32", v)
+		}
+		cfg.similarDistance = n
+	}
+}
+
+// errSourceTooLarge is returned for images over maxSourcePixels, which
+// are skipped rather than decoded
+var errSourceTooLarge = fmt.Errorf("over the %d pixel limit", maxSourcePixels)
+
+// decodeSource decodes the image at path in fsys for the indexer and
+// returns it with its EXIF orientation, refusing images over maxSourcePixels
+func decodeSource(fsys storage, path string) (image.Image, int, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxSourcePixels {
+		return nil, 0, fmt.Errorf("source is %dx%d: %w", cfg.Width, cfg.Height, errSourceTooLarge)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	orientation := exifOrientation(f)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return src, orientation, nil
+}
+
+// perceptualHash returns the difference hash (dHash) of src: the image is
+// shrunk to 9x8 grey pixels and each bit says whether a pixel is brighter
+// than its right neighbour. Re-encoded, resized or renamed copies of a card
+// hash the same or a few bits apart. The EXIF orientation is applied first
+// so a rotated upload matches the original.
+func perceptualHash(src image.Image, orientation int) uint64 {
+	// Square, so quarter turns keep the 9x9 shape
+	small := image.NewGray(image.Rect(0, 0, 9, 9))
+	draw.CatmullRom.Scale(small, small.Bounds(), src, src.Bounds(), draw.Src, nil)
+	oriented := applyOrientation(small, orientation)
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			l := color.GrayModel.Convert(oriented.At(x, y)).(color.Gray).Y
+			r := color.GrayModel.Convert(oriented.At(x+1, y)).(color.Gray).Y
+			h <<= 1
+			if l > r {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+// similarGroup is one set of images whose perceptual hashes are within
+// similarDistance of each other, directly or through another member
+type similarGroup struct {
+	Images   []similarImage
+	Distance int  // largest distance between two members
+	Exact    bool // every member has the same bytes
+}
+
+type similarImage struct {
+	Src           string // images/...
+	Name          string // file name
+	Folder        string // daily folder or category the image is in
+	Size          int64
+	Width, Height int
+	Mod           time.Time
+}
+
+// similarGroups groups c's visible images by perceptual hash, biggest
+// groups first. It relies on the indexer's facts; images the indexer
+// hasn't reached yet are left out.
+func (c *catalog) similarGroups(ctx context.Context) []similarGroup {
+	type entry struct {
+		img string
+		f   imageFacts
+	}
+	var entries []entry
+	for _, img := range c.visibleImages(ctx) {
+		if f, ok := cachedFacts(img); ok && f.hashed {
+			entries = append(entries, entry{img, f})
+		}
+	}
+
+	// Union-find over every pair close enough; fine for the few thousand
+	// images a catalog holds
+	parent := make([]int, len(entries))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range entries {
+		for j := i + 1; j < len(entries); j++ {
+			if bits.OnesCount64(entries[i].f.phash^entries[j].f.phash) <= c.cfg.similarDistance {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+	members := map[int][]int{}
+	for i := range entries {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+
+	var groups []similarGroup
+	for _, idx := range members {
+		if len(idx) < 2 {
+			continue
+		}
+		g := similarGroup{Exact: true}
+		for n, i := range idx {
+			e := entries[i]
+			g.Images = append(g.Images, similarImage{
+				Src:    c.srcFor(e.img),
+				Name:   filepath.Base(e.img),
+				Folder: filepath.Base(filepath.Dir(e.img)),
+				Size:   e.f.size,
+				Width:  e.f.width,
+				Height: e.f.height,
+				Mod:    e.f.mod,
+			})
+			for _, k := range idx[n+1:] {
+				g.Distance = max(g.Distance, bits.OnesCount64(e.f.phash^entries[k].f.phash))
+			}
+			if e.f.sum != entries[idx[0]].f.sum {
+				g.Exact = false
+			}
+		}
+		// Oldest first: that is usually the upload to keep
+		sort.Slice(g.Images, func(i, j int) bool {
+			if !g.Images[i].Mod.Equal(g.Images[j].Mod) {
+				return g.Images[i].Mod.Before(g.Images[j].Mod)
+			}
+			return g.Images[i].Src < g.Images[j].Src
+		})
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if len(groups[i].Images) != len(groups[j].Images) {
+			return len(groups[i].Images) > len(groups[j].Images)
+		}
+		return groups[i].Images[0].Src < groups[j].Images[0].Src
+	})
+	return groups
+}
+
+// adminDuplicatesHandler renders the likely-duplicates report of one
+// catalog (catalog param, empty for the root one), with a remove button on
+// every image
+func (s *Server) adminDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	c := s.adminCatalog(r)
+	if c == nil {
+		http.Error(w, "unknown catalog", http.StatusNotFound)
+		return
+	}
+	groups := c.similarGroups(r.Context())
+	if r.Context().Err() != nil {
+		return
+	}
+	data := struct {
+		SiteName  string
+		Prefix    string
+		Groups    []similarGroup
+		Distance  int
+		CanRemove bool
+	}{c.siteName(), c.Prefix, groups, c.cfg.similarDistance, s.cfg.adminAuthEnabled()}
+	w.Header().Set("Cache-Control", "no-store")
+	s.render(w, http.StatusOK, "duplicates.gohtml", data)
+}
+
+// trashDir, in the cache directory, receives images removed through
+// /admin/images/remove, under the time of removal and their src path, so a
+// wrong click can be undone by moving the file back
+const trashDir = "trash"
+
+// imageRemoveMu keeps two removals from racing for the same trash path
+var imageRemoveMu sync.Mutex
+
+// adminRemoveImageHandler moves one image (src param) of a catalog out of
+// the image root into trashDir. Like rename it requires admin auth to be
+// configured.
+func (s *Server) adminRemoveImageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.cfg.adminAuthEnabled() {
+		http.Error(w, "removing images requires ADMIN_USER and ADMIN_PASSWORD", http.StatusForbidden)
+		return
+	}
+	c := s.adminCatalog(r)
+	if c == nil {
+		http.Error(w, "unknown catalog", http.StatusNotFound)
+		return
+	}
+	src := r.FormValue("src")
+	fullPath, err := c.resolveViewSrc(src)
+	if err != nil {
+		writeSrcError(w, r, err)
+		return
+	}
+
+	imageRemoveMu.Lock()
+	defer imageRemoveMu.Unlock()
+	dst := s.cfg.cachePath(trashDir, time.Now().Format("20060102-150405"), filepath.Base(c.Root), filepath.FromSlash(src))
+	if err := moveFile(fullPath, dst); err != nil {
+		slog.Error("admin remove", "path", fullPath, "err", err)
+		http.Error(w, "removing image failed", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin remove", "catalog", c.Prefix, "src", src, "trash", dst)
+	// Don't wait for the watcher: the next listing must not show it
+	invalidateDir(fsnotify.Event{Name: fullPath, Op: fsnotify.Remove})
+	c.statsMu.Lock()
+	c.stats = nil
+	c.statsMu.Unlock()
+	c.rebuildIndex()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// moveFile renames src to dst, creating dst's directory, and falls back to
+// copying when they are on different filesystems
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// photoInfo (PHOTO_INFO=1) adds an info button to /view that shows the
+// image's dimensions and, from its EXIF data, when it was taken. Off by
+// default; nothing else from the EXIF data is ever shown.
+type photoInfoSettings struct {
+	photoInfo bool
+}
+
+func (cfg *config) loadPhotoInfoConfig() {
+	switch v := os.Getenv("PHOTO_INFO"); v {
+	case "", "0":
+	case "1":
+		cfg.photoInfo = true
+	default:
+		log.Fatalf("invalid PHOTO_INFO %q: want 0 or 1", v)
+	}
+}
+
+// photoDetails returns the displayed dimensions and capture time of the
+// image at fullPath, from the index when it is current and from the file's
+// headers otherwise. taken is zero when unknown.
+func (c *catalog) photoDetails(fullPath string) (width, height int, taken time.Time) {
+	if info, err := c.fs.Stat(fullPath); err == nil {
+		if f, ok := cachedFacts(fullPath); ok && f.size == info.Size() && f.mod.Equal(info.ModTime()) {
+			return f.width, f.height, f.taken
+		}
+	}
+	cfg, err := decodeImageConfig(c.fs, fullPath)
+	if err != nil {
+		return 0, 0, time.Time{}
+	}
+	exif := readExifFile(c.fs, fullPath, c.cfg.siteLocation)
+	width, height = orientedSize(cfg, exif.orientation)
+	return width, height, exif.taken
+}
+
+// photoInfoLine is the info button's text for an image, such as
+// "915 × 1280 · Taken 23 August 2025, 17:07"
+func photoInfoLine(width, height int, taken time.Time, t map[string]string, lang string) string {
+	line := ""
+	if width > 0 {
+		line = fmt.Sprintf("%d × %d", width, height)
+	}
+	if !taken.IsZero() {
+		if line != "" {
+			line += " · "
+		}
+		line += t["taken"] + " " + displayDate(taken, lang) + ", " + taken.Format("15:04")
+	}
+	return line
+}
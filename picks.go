@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// picksCount is how many images the daily picks show
+const picksCount = 24
+
+// picksSeed derives the shuffle seed from the calendar date of day, so every
+// visitor sees the same picks until midnight (server time)
+func picksSeed(day time.Time) int64 {
+	y, m, d := day.Date()
+	return int64(y)*10000 + int64(m)*100 + int64(d)
+}
+
+// dailyPicks returns up to n of imgs in a shuffled order that is stable for
+// the given day. The input is sorted first so the result doesn't depend on
+// listing order.
+func dailyPicks(imgs []string, day time.Time, n int) []string {
+	picks := append([]string(nil), imgs...)
+	sort.Strings(picks)
+	rng := rand.New(rand.NewSource(picksSeed(day)))
+	rng.Shuffle(len(picks), func(i, j int) { picks[i], picks[j] = picks[j], picks[i] })
+	if len(picks) > n {
+		picks = picks[:n]
+	}
+	return picks
+}
+
+// picksHandler renders today's picks: a daily-rotating random selection
+// from every daily folder and category
+func (c *catalog) picksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	folders := c.listDailyFolders(ctx)
+	imgs := c.visibleImages(ctx)
+	if ctx.Err() != nil {
+		return // client went away; the listing may be incomplete
+	}
+
+	data := PageData{
+		Prefix:       c.Prefix,
+		ActiveTab:    "picks",
+		DailyFolders: folders,
+		PickImages:   c.srcsFor(dailyPicks(imgs, time.Now(), picksCount)),
+		RecentImages: c.recentFromRequest(r),
+		SiteName:     c.siteName(),
+	}
+	data.Captions = c.captionsBySrc(data.PickImages)
+	data.Previews = c.previewsBySrc(data.PickImages)
+	data.Lang = detectLang(r)
+	data.T = translations[data.Lang]
+	data.Theme = themeFromRequest(r)
+	w.Header().Set("Vary", "Accept-Language, Cookie")
+	c.srv.render(w, http.StatusOK, "index.gohtml", data)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDailyPicksStableForADay(t *testing.T) {
+	var imgs []string
+	for i := 0; i < 50; i++ {
+		imgs = append(imgs, fmt.Sprintf("images/weekly/%02d.jpg", i))
+	}
+	morning := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	evening := time.Date(2024, 6, 1, 22, 30, 0, 0, time.UTC)
+	nextDay := time.Date(2024, 6, 2, 8, 0, 0, 0, time.UTC)
+
+	first := dailyPicks(imgs, morning, picksCount)
+	if len(first) != picksCount {
+		t.Fatalf("got %d picks, want %d", len(first), picksCount)
+	}
+	// Listing order must not matter either
+	reversed := slices.Clone(imgs)
+	slices.Reverse(reversed)
+	if later := dailyPicks(reversed, evening, picksCount); !slices.Equal(later, first) {
+		t.Errorf("same day, different picks:\n%v\n%v", first, later)
+	}
+	if next := dailyPicks(imgs, nextDay, picksCount); slices.Equal(next, first) {
+		t.Error("next day has the same picks")
+	}
+	if few := dailyPicks(imgs[:3], morning, picksCount); len(few) != 3 {
+		t.Errorf("3 images gave %d picks", len(few))
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// themeCookie stores the visitor's light/dark choice so pages can render
+// the right theme server-side without a flash
+const themeCookie = "theme"
+
+// themeFromRequest returns "light" or "dark" from the theme cookie, or ""
+// when the visitor hasn't chosen (follow the default light theme)
+func themeFromRequest(r *http.Request) string {
+	c, err := r.Cookie(themeCookie)
+	if err != nil {
+		return ""
+	}
+	if c.Value == "light" || c.Value == "dark" {
+		return c.Value
+	}
+	return ""
+}
+
+// prefsHandler saves display preferences in cookies. It takes theme=light,
+// dark or system (system clears the cookie). Plain form posts are
+// redirected back to the local path in next; script calls get a 204.
+func prefsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     themeCookie,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	switch theme := r.FormValue("theme"); theme {
+	case "light", "dark":
+		cookie.Value = theme
+		cookie.Expires = time.Now().AddDate(1, 0, 0)
+	case "system":
+		cookie.MaxAge = -1
+	default:
+		http.Error(w, "invalid theme", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, cookie)
+
+	// only follow local paths so next can't be used as an open redirect
+	if next := r.FormValue("next"); strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
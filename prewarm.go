@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// prewarmSettings: prewarmThumbs (PREWARM_THUMBS=1) generates missing grid
+// thumbnails in the background after startup so the first visitor after a
+// deploy doesn't wait. prewarmWorkers (PREWARM_WORKERS) bounds how many run
+// at once.
+type prewarmSettings struct {
+	prewarmThumbs  bool
+	prewarmWorkers int
+}
+
+func (cfg *config) loadPrewarmConfig() {
+	switch v := os.Getenv("PREWARM_THUMBS"); v {
+	case "", "0":
+	case "1":
+		cfg.prewarmThumbs = true
+	default:
+		log.Fatalf("invalid PREWARM_THUMBS %q: want 0 or 1", v)
+	}
+	if v := os.Getenv("PREWARM_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 64 {
+			log.Fatalf("invalid PREWARM_WORKERS %q: want 1-64", v)
+		}
+		cfg.prewarmWorkers = n
+	}
+}
+
+// thumbCached reports whether the disk cache already holds a current
+// thumbnail of fullPath
+func (c *catalog) thumbCached(fullPath string, info os.FileInfo, maxWidth, maxHeight int, fit string) bool {
+	name := c.thumbCacheKey(fullPath, info, maxWidth, maxHeight, fit) + ".jpg"
+	_, err := os.Stat(c.cfg.cachePath(thumbCacheDir, name))
+	return err == nil
+}
+
+// thumbSize is one resized variant prewarm generates
+type thumbSize struct {
+	width, height int
+	fit           string
+}
+
+func (s thumbSize) String() string {
+	if s.fit == fitCover {
+		return fmt.Sprintf("%dx%d", s.width, s.height)
+	}
+	return strconv.Itoa(s.width)
+}
+
+// prewarmSizes are the thumbnails pages load: /thumb, the src of grid
+// tiles, the grid srcset candidates and the square tile crops
+func prewarmSizes(thumbMaxWidth int) []thumbSize {
+	sizes := []thumbSize{{thumbMaxWidth, 0, fitContain}}
+	for _, w := range gridSrcsetWidths {
+		if s := (thumbSize{w, 0, fitContain}); !slices.Contains(sizes, s) {
+			sizes = append(sizes, s)
+		}
+	}
+	for _, w := range tileSrcsetWidths {
+		sizes = append(sizes, thumbSize{w, w, fitCover})
+	}
+	return sizes
+}
+
+// prewarmThumbnails walks every catalog and generates the missing grid
+// thumbnails, in every prewarmSizes size, with a bounded worker pool. It
+// returns once all are done or ctx is cancelled; workers finish their
+// current image and stop.
+func (s *Server) prewarmThumbnails(ctx context.Context) {
+	type prewarmJob struct {
+		c   *catalog
+		img string
+	}
+	var images []prewarmJob
+	for _, c := range s.Catalogs {
+		for _, img := range c.getAllImagesRecursive(ctx, c.Root) {
+			images = append(images, prewarmJob{c, img})
+		}
+	}
+	start := time.Now()
+	sizes := prewarmSizes(s.cfg.thumbMaxWidth)
+	slog.Info("prewarm: checking images", "images", len(images), "sizes", sizes, "workers", s.cfg.prewarmWorkers)
+
+	jobs := make(chan prewarmJob)
+	var generated, skipped, failed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < s.cfg.prewarmWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				c, img := job.c, job.img
+				info, err := c.fs.Stat(img)
+				if err != nil {
+					failed.Add(1)
+					continue
+				}
+				for _, size := range sizes {
+					if c.thumbCached(img, info, size.width, size.height, size.fit) {
+						skipped.Add(1)
+						continue
+					}
+					// Fill only the disk cache; the memory LRU is left to
+					// the thumbnails visitors actually request
+					data, err := c.generateThumbnail(img, size.width, size.height, size.fit)
+					if err == nil {
+						cachePath := c.cfg.cachePath(thumbCacheDir, c.thumbCacheKey(img, info, size.width, size.height, size.fit)+".jpg")
+						err = writeFileAtomic(cachePath, data)
+					}
+					if err != nil {
+						slog.Warn("prewarm: thumbnail failed", "path", img, "size", size, "err", err)
+						failed.Add(1)
+						break // the other sizes would fail the same way
+					}
+					if n := generated.Add(1); n%100 == 0 {
+						slog.Info("prewarm: progress", "generated", n)
+					}
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, job := range images {
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	state := "done"
+	if ctx.Err() != nil {
+		state = "stopped"
+	}
+	slog.Info("prewarm "+state, "duration", time.Since(start).Round(time.Millisecond).String(),
+		"generated", generated.Load(), "cached", skipped.Load(), "failed", failed.Load())
+}
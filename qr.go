@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"rsc.io/qr"
+)
+
+// qrScale is the size in pixels of one QR module: a typical view URL makes
+// a code of about 300px, which phones scan from a screen at arm's length
+const qrScale = 8
+
+// qrHandler serves a PNG QR code of the view page of the src image, so a
+// customer in the shop can scan a card shown on the counter screen straight
+// to their phone. The URL follows the canonical URL settings, like og:url.
+func (c *catalog) qrHandler(w http.ResponseWriter, r *http.Request) {
+	src := r.URL.Query().Get("src")
+	if _, err := c.resolveViewSrc(src); err != nil {
+		writeSrcError(w, r, err)
+		return
+	}
+	target := c.cfg.absoluteURL(r, c.Prefix+"/view?"+url.Values{"src": {src}}.Encode())
+	// M recovers from about 15% damage: glare on a screen or a smudged
+	// print
+	code, err := qr.Encode(target, qr.M)
+	if err != nil {
+		slog.Warn("qr code failed", "url", target, "err", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	code.Scale = qrScale
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(code.PNG()))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitSettings are the per-IP rate limits, both off by default since
+// mobile carriers put many people behind one address. rateLimitPages
+// (RATE_LIMIT_PAGES) is page and API requests per minute; rateLimitImageMB
+// (RATE_LIMIT_IMAGE_MB) is megabytes of image responses per minute. Each
+// bucket holds one minute's worth, so a visitor can burst through a folder
+// and then slows to the rate.
+type rateLimitSettings struct {
+	rateLimitPages   float64
+	rateLimitImageMB float64
+}
+
+func (cfg *config) loadRateLimitConfig() {
+	parse := func(name string) float64 {
+		v := os.Getenv(name)
+		if v == "" {
+			return 0
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || math.IsInf(f, 0) {
+			log.Fatalf("invalid %s %q: want a non-negative number, 0 for no limit", name, v)
+		}
+		return f
+	}
+	cfg.rateLimitPages = parse("RATE_LIMIT_PAGES")
+	cfg.rateLimitImageMB = parse("RATE_LIMIT_IMAGE_MB")
+}
+
+// rateLimitExempt are paths that are never limited: probes, scrapes and the
+// small assets every page pulls
+var rateLimitExempt = []string{"/healthz", "/readyz", "/metrics", "/static/", "/appicon.png", "/preview.png"}
+
+// tokenBucket refills at rate tokens per second up to capacity. Tokens may
+// go negative when a cost is only known afterwards; the client then waits
+// until the debt is paid back.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, capacity float64) {
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+// limiter holds one bucket per client IP for a single limit
+type limiter struct {
+	mu        sync.Mutex
+	rate      float64 // per second
+	capacity  float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newLimiter(perMinute float64) *limiter {
+	return newLimiterPer(perMinute, time.Minute)
+}
+
+// newLimiterPer allows n per period, with a burst of n
+func newLimiterPer(n float64, period time.Duration) *limiter {
+	return &limiter{rate: n / period.Seconds(), capacity: n, buckets: map[string]*tokenBucket{}}
+}
+
+// take spends cost tokens of ip's bucket if at least need are available,
+// otherwise it returns how long until they are
+func (l *limiter) take(ip string, need, cost float64) (ok bool, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	b := l.buckets[ip]
+	if b == nil {
+		b = &tokenBucket{tokens: l.capacity, last: now}
+		l.buckets[ip] = b
+	}
+	b.refill(now, l.rate, l.capacity)
+	if b.tokens < need {
+		return false, time.Duration((need - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens -= cost
+	return true, 0
+}
+
+// charge takes cost tokens from ip's bucket after the fact
+func (l *limiter) charge(ip string, cost float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b := l.buckets[ip]; b != nil {
+		b.tokens -= cost
+	}
+}
+
+// sweep drops buckets that have refilled completely, at most once a
+// minute, so the map only holds recently active clients
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.capacity {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// rateLimit enforces the per-IP limits: image routes (see imageRoutes)
+// against the image byte budget, charged with what was actually sent, and
+// everything else against the page budget. Over the limit the client gets
+// 429 with Retry-After.
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	cfg := &s.cfg
+	if cfg.rateLimitPages == 0 && cfg.rateLimitImageMB == 0 {
+		return next
+	}
+	var pages, images *limiter
+	if cfg.rateLimitPages > 0 {
+		pages = newLimiter(cfg.rateLimitPages)
+	}
+	if cfg.rateLimitImageMB > 0 {
+		images = newLimiter(cfg.rateLimitImageMB * (1 << 20))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if matchRoute(rateLimitExempt, r.URL.Path) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := cfg.clientIP(r)
+		kind, l, need, cost := "pages", pages, 1.0, 1.0
+		if imageRoutes[s.routeLabel(r.URL.Path)] {
+			// Image sizes are only known once sent: admit while the
+			// budget isn't exhausted, then charge the bytes written
+			kind, l, need, cost = "images", images, 1, 0
+		}
+		if l == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := l.take(ip, need, cost); !ok {
+			metrics.Lock()
+			metrics.rateLimited[kind]++
+			metrics.Unlock()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			httpError(w, r, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if kind == "pages" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		l.charge(ip, float64(rec.bytes))
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// recentCookie holds the src values of the last viewed images, newest
+// first, each query-escaped and joined with "|". Each catalog keeps its
+// own list because the cookie is scoped to the catalog prefix.
+const (
+	recentCookie = "recent"
+	recentMax    = 12
+)
+
+// recentFromRequest returns the recently viewed srcs that still resolve to
+// images in the catalog. Cookie contents are client-controlled, so every
+// entry goes through resolveImageSrc like a src query param would.
+func (c *catalog) recentFromRequest(r *http.Request) []string {
+	ck, err := r.Cookie(recentCookie)
+	if err != nil {
+		return nil
+	}
+	var srcs []string
+	for _, part := range strings.Split(ck.Value, "|") {
+		src, err := url.QueryUnescape(part)
+		if err != nil || !isMediaName(src) {
+			continue
+		}
+		fullPath, err := c.resolveImageSrc(src)
+		if err != nil {
+			continue
+		}
+		if info, err := c.fs.Stat(fullPath); err != nil || info.IsDir() {
+			continue
+		}
+		srcs = append(srcs, c.srcFor(fullPath))
+		if len(srcs) == recentMax {
+			break
+		}
+	}
+	return srcs
+}
+
+// rememberViewed moves src to the front of the recently viewed cookie
+func (c *catalog) rememberViewed(w http.ResponseWriter, r *http.Request, src string) {
+	parts := []string{url.QueryEscape(src)}
+	for _, prev := range c.recentFromRequest(r) {
+		if prev != src && len(parts) < recentMax {
+			parts = append(parts, url.QueryEscape(prev))
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     recentCookie,
+		Value:    strings.Join(parts, "|"),
+		Path:     c.Prefix + "/",
+		Expires:  time.Now().AddDate(0, 1, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Related strategies pick the carousel shown with an image. "folder" keeps
+// to the image's own folder; "mixed" tops up small sets with daily picks from
+// the whole catalog, so weekly singles still get a strip.
+var relatedStrategies = map[string]func(c *catalog, ctx context.Context, fullPath string) relatedSet{
+	"folder": (*catalog).sameFolderRelated,
+	"mixed":  (*catalog).mixedRelated,
+}
+
+// relatedSettings: relatedStrategy is the default strategy
+// (RELATED_STRATEGY), overridable per request with ?related=
+type relatedSettings struct {
+	relatedStrategy string
+}
+
+// relatedMinImages is the set size below which "mixed" adds other images
+const relatedMinImages = 8
+
+func (cfg *config) loadRelatedConfig() {
+	if v := os.Getenv("RELATED_STRATEGY"); v != "" {
+		if relatedStrategies[v] == nil {
+			log.Fatalf("invalid RELATED_STRATEGY %q: want folder or mixed", v)
+		}
+		cfg.relatedStrategy = v
+	}
+}
+
+// relatedImagesFor gathers the related images for fullPath (as returned by
+// resolveImageSrc) with the named strategy, or the default when strategy is
+// empty or unknown. It is shared by the HTML view and the JSON API so both
+// always agree on ordering and position.
+func (c *catalog) relatedImagesFor(ctx context.Context, fullPath, strategy string) relatedSet {
+	pick := relatedStrategies[strategy]
+	if pick == nil {
+		pick = relatedStrategies[c.cfg.relatedStrategy]
+	}
+	return pick(c, ctx, fullPath)
+}
+
+// relatedSet is the carousel an image belongs to: its siblings in the same
+// daily folder or category, or every image for anything else
+type relatedSet struct {
+	Kind   string // daily, the category name, or other
+	Folder string
+	Images []string // URL paths with a leading slash
+	Index  int      // 1-based position of the current image
+	Own    int      // leading Images from the set itself; the rest are top-ups
+}
+
+// sameFolderRelated is the "folder" strategy: the siblings of fullPath in
+// its daily folder or category
+func (c *catalog) sameFolderRelated(ctx context.Context, fullPath string) relatedSet {
+	set := relatedSet{Index: 1}
+	parts := strings.Split(c.srcFor(fullPath), "/")
+	var related []string
+	if len(parts) >= 3 && parts[1] == "daily" { // images/daily/<folder>/file
+		set.Kind = "daily"
+		set.Folder = parts[2]
+		dir := c.dir("daily", set.Folder)
+		related = c.sortImages(c.listImages(ctx, dir), c.readFolderConfig(dir).Sort)
+	} else if cat, ok := c.imageCategory(parts); ok { // images/<category>/file
+		set.Kind = cat.Name
+		related = c.sortImages(c.listImages(ctx, c.dir(cat.Name)), cat.Sort)
+	} else {
+		// For images that don't fit the daily or category pattern, try to get all images
+		set.Kind = "other"
+		related = c.getAllImagesRecursive(ctx, c.Root)
+	}
+	for _, rimg := range related {
+		set.Images = append(set.Images, c.imageURL(rimg))
+	}
+	set.Own = len(set.Images)
+	// Find current index in the related images
+	currentImagePath := c.imageURL(fullPath)
+	for i, rimg := range set.Images {
+		if rimg == currentImagePath {
+			set.Index = i + 1
+			break
+		}
+	}
+	return set
+}
+
+// neighbours returns the images before and after the current one; either is
+// empty at the ends of the set
+func (s relatedSet) neighbours() (prev, next string) {
+	i := s.Index - 1
+	if i >= len(s.Images) {
+		return "", ""
+	}
+	if i > 0 {
+		prev = s.Images[i-1]
+	}
+	if i+1 < len(s.Images) {
+		next = s.Images[i+1]
+	}
+	return prev, next
+}
+
+// folderNeighbours is neighbours within the set itself, so stepping
+// through a folder never wanders into top-up images
+func (s relatedSet) folderNeighbours() (prev, next string) {
+	own := s
+	own.Images = s.Images[:s.Own]
+	return own.neighbours()
+}
+
+// mixedRelated is the "mixed" strategy: the same-folder set, followed by
+// today's picks from the rest of the catalog when it has fewer than
+// relatedMinImages. The current image keeps its position.
+func (c *catalog) mixedRelated(ctx context.Context, fullPath string) relatedSet {
+	set := c.sameFolderRelated(ctx, fullPath)
+	if len(set.Images) >= relatedMinImages {
+		return set
+	}
+	have := make(map[string]bool, len(set.Images))
+	for _, img := range set.Images {
+		have[img] = true
+	}
+	// Draw from the same pool as /picks so hidden folders stay hidden
+	var pool []string
+	for _, f := range c.listDailyFolders(ctx) {
+		pool = append(pool, c.listImages(ctx, c.dir("daily", f.Name))...)
+	}
+	for _, cat := range c.categories() {
+		pool = append(pool, c.listImages(ctx, c.dir(cat.Name))...)
+	}
+	var others []string
+	for _, img := range pool {
+		if u := c.imageURL(img); !have[u] {
+			others = append(others, u)
+		}
+	}
+	set.Images = append(set.Images, dailyPicks(others, time.Now(), relatedMinImages-len(set.Images))...)
+	return set
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRelatedStrategies(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "images")
+	writeTestJPEG(t, filepath.Join(root, "weekly", "single.jpg"), 8, 8)
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		writeTestJPEG(t, filepath.Join(root, "daily", "small", name), 8, 8)
+	}
+	for i := 0; i < relatedMinImages; i++ {
+		writeTestJPEG(t, filepath.Join(root, "daily", "big", fmt.Sprintf("%02d.jpg", i)), 8, 8)
+	}
+	cfg := defaultConfig()
+	c := &catalog{Root: root, cfg: &cfg, fs: osStorage{}}
+
+	for _, tc := range []struct {
+		name, strategy, src string
+		kind, folder        string
+		images, own, index  int
+	}{
+		{"folder daily", "folder", "daily/small/b.jpg", "daily", "small", 3, 3, 2},
+		{"folder weekly single", "folder", "weekly/single.jpg", "weekly", "", 1, 1, 1},
+		{"mixed tops up a small folder", "mixed", "daily/small/c.jpg", "daily", "small", relatedMinImages, 3, 3},
+		{"mixed tops up a weekly single", "mixed", "weekly/single.jpg", "weekly", "", relatedMinImages, 1, 1},
+		{"mixed leaves a full folder", "mixed", "daily/big/03.jpg", "daily", "big", relatedMinImages, relatedMinImages, 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			set := c.relatedImagesFor(context.Background(), filepath.Join(root, filepath.FromSlash(tc.src)), tc.strategy)
+			if set.Kind != tc.kind || set.Folder != tc.folder {
+				t.Errorf("kind %q folder %q, want %q and %q", set.Kind, set.Folder, tc.kind, tc.folder)
+			}
+			if len(set.Images) != tc.images || set.Own != tc.own || set.Index != tc.index {
+				t.Errorf("%d images, %d own, index %d; want %d, %d, %d", len(set.Images), set.Own, set.Index, tc.images, tc.own, tc.index)
+			}
+			if set.Index >= 1 && set.Index <= len(set.Images) && set.Images[set.Index-1] != "/images/"+tc.src {
+				t.Errorf("image at index is %s, want /images/%s", set.Images[set.Index-1], tc.src)
+			}
+			seen := map[string]bool{}
+			for _, img := range set.Images {
+				if seen[img] {
+					t.Errorf("%s listed twice", img)
+				}
+				seen[img] = true
+			}
+		})
+	}
+}
+
+func TestRelatedAPIOnlyAcceptsMedia(t *testing.T) {
+	srv, root := newTestServer(t)
+	if err := os.WriteFile(filepath.Join(root, "daily", "2024-06-01", "readme.txt"), []byte("not a card"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		src  string
+		want int
+	}{
+		{"images/daily/2024-06-01", http.StatusNotFound},
+		{"images/daily/2024-06-01/readme.txt", http.StatusNotFound},
+		{"images/daily/2024-06-01/card 1.jpg", http.StatusOK},
+	} {
+		if rec := get(t, srv, http.MethodGet, "/api/related?src="+url.QueryEscape(tc.src)); rec.Code != tc.want {
+			t.Errorf("%s: %d, want %d", tc.src, rec.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadResponse is the JSON shape served by /admin/reload
+type reloadResponse struct {
+	SiteName        string   `json:"site_name"`
+	TemplateDir     string   `json:"template_dir"`
+	AssetDir        string   `json:"asset_dir"`
+	Templates       int      `json:"templates"`
+	RestartRequired []string `json:"restart_required,omitempty"`
+	EnvNotReloaded  []string `json:"env_not_reloaded,omitempty"`
+}
+
+// startupEnv names the environment settings loadEnv and loadCatalogs
+// read once at startup. A reload doesn't apply them, and being environment
+// a process can't see them change anyway, so reload lists the ones in use
+// as a reminder that changing them means a restart.
+var startupEnv = []string{
+	"ADMIN_PASSWORD", "ADMIN_PASSWORD_HASH", "ADMIN_USER", "ALLOWED_HOSTS", "ALLOWED_ORIGINS",
+	"CANONICAL_BASE_URL", "CANONICAL_HOST", "CATALOGS_FILE", "CATEGORIES", "COMPRESS",
+	"CONTENT_SECURITY_POLICY", "CORS_ALLOWED_HEADERS", "CORS_ALLOWED_METHODS", "CORS_EXPOSE_HEADERS", "CORS_MAX_AGE",
+	"CSP_REPORT_ONLY", "DIR_CACHE", "FFMPEG", "FOLDER_PDF_PER_HOUR", "FOLDER_ZIP_MAX_MB",
+	"FOLDER_ZIP_PER_HOUR", "FRAME_OPTIONS", "HEIC_CONVERT", "IMAGE_CHECK", "IMAGE_FORMATS",
+	"INDEX_INTERVAL", "INDEX_WORKERS", "LOG_FORMAT", "LOG_LEVEL", "METADATA_DB",
+	"OCR", "OCR_API_KEY", "OG_FONT", "OPTIMIZE", "OPTIMIZE_MAX_SIDE",
+	"OPTIMIZE_QUALITY", "PAGE_SIZE", "PHOTO_INFO", "PREWARM_THUMBS", "PREWARM_WORKERS",
+	"RATE_LIMIT_IMAGE_MB", "RATE_LIMIT_PAGES", "REFERRER_POLICY", "RELATED_STRATEGY", "SCAN_MAX_DEPTH",
+	"SCAN_MAX_FILES", "SIMILAR_DISTANCE", "STRIP_METADATA", "TESSERACT", "THUMB_MAX_WIDTH",
+	"THUMB_MEMORY_CACHE_MB", "THUMB_QUALITY", "TIMEZONE", "TRAILING_SLASH", "TRENDING",
+	"TRUST_PROXY", "WATERMARK_FONT", "WATERMARK_LOGO", "WATERMARK_TEXT",
+}
+
+// envNotReloaded returns the startupEnv settings that are set
+func envNotReloaded() []string {
+	var set []string
+	for _, name := range startupEnv {
+		if _, ok := os.LookupEnv(name); ok {
+			set = append(set, name)
+		}
+	}
+	return set
+}
+
+// reload re-reads the config from the command line, environment and config
+// file and re-parses the templates, then swaps the new site in at once.
+// Requests in flight finish with the old one. A bad config or template
+// leaves everything as it was. Settings bound at startup, like the listen
+// address, are reported in RestartRequired instead, and the environment
+// settings read at startup in EnvNotReloaded.
+func (s *Server) reload() (reloadResponse, error) {
+	cfg, err := readConfig(os.Args[1:])
+	if err != nil {
+		return reloadResponse{}, err
+	}
+	cfg.envSettings = s.cfg.envSettings
+	st, err := loadSite(cfg)
+	if err != nil {
+		return reloadResponse{}, err
+	}
+	if name := missingTemplate(st.templates); name != "" {
+		return reloadResponse{}, fmt.Errorf("template %s missing from %s", name, cfg.TemplateDir)
+	}
+	s.mu.Lock()
+	s.site = st
+	s.mu.Unlock()
+	// Cached stats carry the site name
+	for _, c := range s.Catalogs {
+		c.statsMu.Lock()
+		c.stats = nil
+		c.statsMu.Unlock()
+	}
+
+	res := reloadResponse{
+		SiteName:        st.SiteName,
+		TemplateDir:     st.TemplateDir,
+		AssetDir:        st.AssetDir,
+		Templates:       len(st.templateFiles),
+		RestartRequired: s.cfg.restartRequired(cfg),
+		EnvNotReloaded:  envNotReloaded(),
+	}
+	slog.Info("reloaded", "site_name", res.SiteName, "template_dir", res.TemplateDir, "asset_dir", res.AssetDir)
+	if len(res.RestartRequired) > 0 {
+		slog.Warn("reload: changed settings take effect after a restart", "settings", res.RestartRequired)
+	}
+	if len(res.EnvNotReloaded) > 0 {
+		slog.Warn("reload: environment settings are read at startup only", "settings", res.EnvNotReloaded)
+	}
+	return res, nil
+}
+
+// restartRequired lists the settings that differ between cfg and next but
+// are only read at startup
+func (cfg config) restartRequired(next config) []string {
+	var changed []string
+	for _, f := range []struct {
+		name      string
+		old, next string
+	}{
+		{"addr", cfg.Addr, next.Addr},
+		{"images_root", cfg.ImagesRoot, next.ImagesRoot},
+		{"cache_dir", cfg.CacheDir, next.CacheDir},
+		{"shutdown_timeout", cfg.ShutdownTimeout, next.ShutdownTimeout},
+		{"read_timeout", cfg.ReadTimeout, next.ReadTimeout},
+		{"write_timeout", cfg.WriteTimeout, next.WriteTimeout},
+		{"idle_timeout", cfg.IdleTimeout, next.IdleTimeout},
+		{"autocert_hosts", cfg.AutocertHosts, next.AutocertHosts},
+		{"autocert_cache", cfg.AutocertCache, next.AutocertCache},
+		{"autocert_email", cfg.AutocertEmail, next.AutocertEmail},
+	} {
+		if f.old != f.next {
+			changed = append(changed, f.name)
+		}
+	}
+	return changed
+}
+
+// reloadOnHangup reloads s on every SIGHUP until ctx is done
+func (s *Server) reloadOnHangup(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			if _, err := s.reload(); err != nil {
+				slog.Error("reload failed, keeping the running config", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// adminReloadHandler is reload over HTTP, for hosts where signalling the
+// process is awkward
+func (s *Server) adminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	res, err := s.reload()
+	if err != nil {
+		slog.Error("reload failed, keeping the running config", "err", err)
+		http.Error(w, "reload failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, res)
+}
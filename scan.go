@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// scanSettings guard against an image root pointed at a huge tree. Scans
+// stop at the limit and serve what they found so far.
+type scanSettings struct {
+	scanMaxDepth int // directory levels below the root walked recursively
+	scanMaxFiles int // entries read by one listing or walk
+}
+
+// loadScanConfig reads SCAN_MAX_DEPTH and SCAN_MAX_FILES; invalid values are
+// fatal so a typo can't silently disable the guard
+func (cfg *config) loadScanConfig() {
+	if v := os.Getenv("SCAN_MAX_DEPTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid SCAN_MAX_DEPTH %q: want a positive integer", v)
+		}
+		cfg.scanMaxDepth = n
+	}
+	if v := os.Getenv("SCAN_MAX_FILES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid SCAN_MAX_FILES %q: want a positive integer", v)
+		}
+		cfg.scanMaxFiles = n
+	}
+}
+
+// scanWarned remembers which limit warnings were logged so a bad root
+// doesn't log on every request
+var scanWarned sync.Map
+
+func warnScanLimit(dir, msg string) {
+	if _, loaded := scanWarned.LoadOrStore(dir+"\x00"+msg, true); !loaded {
+		slog.Warn("scan limit reached; serving partial results", "dir", dir, "limit", msg)
+	}
+}
+
+// readDirLimited is ReadDir capped at scanMaxFiles entries. Entries come
+// back in directory order, not sorted, when the cap is hit.
+func (c *catalog) readDirLimited(dir string) ([]fs.DirEntry, error) {
+	defer observeScan("folders", time.Now())
+	f, err := c.fs.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []fs.DirEntry
+	if rd, ok := f.(fs.ReadDirFile); ok {
+		entries, err = rd.ReadDir(c.cfg.scanMaxFiles + 1)
+	} else {
+		entries, err = c.fs.ReadDir(dir)
+	}
+	if err != nil && len(entries) == 0 {
+		return nil, err
+	}
+	if len(entries) > c.cfg.scanMaxFiles {
+		warnScanLimit(dir, "more than SCAN_MAX_FILES="+strconv.Itoa(c.cfg.scanMaxFiles)+" entries")
+		entries = entries[:c.cfg.scanMaxFiles]
+	}
+	return entries, nil
+}
+
+// walkLimited walks root like filepath.WalkDir, reading through c.fs, but
+// skips directories deeper than scanMaxDepth and stops after scanMaxFiles
+// entries, or with ctx's error once ctx is cancelled
+func (c *catalog) walkLimited(ctx context.Context, root string, fn func(path string, d fs.DirEntry) error) error {
+	defer observeScan("walk", time.Now())
+	seen := 0
+	root = filepath.Clean(root)
+	var walk func(path string, d fs.DirEntry, depth int) error
+	walk = func(path string, d fs.DirEntry, depth int) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if seen++; seen > c.cfg.scanMaxFiles {
+			warnScanLimit(root, "more than SCAN_MAX_FILES="+strconv.Itoa(c.cfg.scanMaxFiles)+" entries")
+			return fs.SkipAll
+		}
+		if d.IsDir() && depth > c.cfg.scanMaxDepth {
+			warnScanLimit(root, "deeper than SCAN_MAX_DEPTH="+strconv.Itoa(c.cfg.scanMaxDepth))
+			return nil
+		}
+		if err := fn(path, d); err != nil || !d.IsDir() {
+			if err == fs.SkipDir {
+				return nil
+			}
+			return err
+		}
+		entries, err := c.fs.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := walk(filepath.Join(path, e.Name()), e, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	info, err := c.fs.Stat(root)
+	if err != nil {
+		return err
+	}
+	if err := walk(root, fs.FileInfoToDirEntry(info), 0); err != fs.SkipAll {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// scrollCursor marks where a /api/scroll listing left off. It travels as
+// opaque base64 JSON; the sort rides along so follow-up requests need only
+// the set and the cursor.
+type scrollCursor struct {
+	Sort  string `json:"s"`
+	Index int    `json:"i"` // position of the next image
+	Last  string `json:"n"` // file name of the last image served
+}
+
+func (cur scrollCursor) encode() string {
+	raw, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (scrollCursor, error) {
+	var cur scrollCursor
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(raw, &cur) != nil || cur.Index < 0 || !sortModes[cur.Sort] {
+		return cur, errInvalidCursor
+	}
+	return cur, nil
+}
+
+// resume returns where the next batch starts in imgs. Images added or
+// removed since the cursor was made shift positions, so the last image
+// served is looked up by name; only when it is gone does the old position
+// stand.
+func (cur scrollCursor) resume(imgs []string) int {
+	if i := cur.Index; i > 0 && i <= len(imgs) && path.Base(imgs[i-1]) == cur.Last {
+		return i
+	}
+	for i, img := range imgs {
+		if path.Base(img) == cur.Last {
+			return i + 1
+		}
+	}
+	return min(cur.Index, len(imgs))
+}
+
+// scrollResponse is the JSON shape of /api/scroll. Next is null once the
+// set is exhausted.
+type scrollResponse struct {
+	Images []string `json:"images"`
+	Next   *string  `json:"next"`
+	Total  int      `json:"total"`
+}
+
+// scrollAPIHandler serves a daily folder (folder param) or category
+// (category) a batch at a time for infinite scrolling: limit images after
+// the cursor param, or from the start without one. Listings come from
+// dirIndex, so a batch costs no directory scan. HTMX requests get grid
+// cells followed by a sentinel that loads the next batch once revealed;
+// everyone else gets JSON.
+func (c *catalog) scrollAPIHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	set := url.Values{}
+	var dir, defaultSort string
+	switch folder, cat := query.Get("folder"), query.Get("category"); {
+	case folder != "" && cat == "":
+		if !safeFolderRe.MatchString(folder) {
+			httpError(w, r, "invalid folder", http.StatusBadRequest)
+			return
+		}
+		dir = c.dir("daily", folder)
+		if info, err := c.fs.Stat(dir); err != nil || !info.IsDir() || c.folderHidden(dir) {
+			notFound(w, r)
+			return
+		}
+		defaultSort = c.readFolderConfig(dir).Sort
+		set.Set("folder", folder)
+	case cat != "" && folder == "":
+		category, ok := c.category(cat)
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		dir, defaultSort = c.dir(category.Name), category.Sort
+		set.Set("category", category.Name)
+	default:
+		httpError(w, r, "give either folder or category", http.StatusBadRequest)
+		return
+	}
+
+	var cur scrollCursor
+	if v := query.Get("cursor"); v != "" {
+		var err error
+		if cur, err = decodeCursor(v); err != nil {
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s := query.Get("sort"); s != "" && s != cur.Sort {
+			httpError(w, r, "sort differs from the cursor's", http.StatusBadRequest)
+			return
+		}
+	} else {
+		mode, err := requestSort(r, defaultSort)
+		if err != nil {
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cur.Sort = mode
+		if cur.Sort == "" {
+			cur.Sort = sortName
+		}
+	}
+	limit := c.cfg.pageSize
+	if v := query.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 {
+			httpError(w, r, errInvalidPage.Error(), http.StatusBadRequest)
+			return
+		}
+		limit = min(l, maxPageSize)
+		set.Set("limit", strconv.Itoa(limit))
+	}
+
+	imgs := c.sortImages(c.listImages(ctx, dir), cur.Sort)
+	if ctx.Err() != nil {
+		return // client went away; the listing may be incomplete
+	}
+	start := cur.resume(imgs)
+	end := min(start+limit, len(imgs))
+	batch := imgs[start:end]
+	var next string
+	if end < len(imgs) {
+		next = scrollCursor{Sort: cur.Sort, Index: end, Last: path.Base(imgs[end-1])}.encode()
+	}
+
+	htmx := r.Header.Get("HX-Request") == "true"
+	lang := detectLang(r)
+	w.Header().Set("Vary", "Accept-Language, HX-Request")
+	variant := "json"
+	if htmx {
+		variant = lang
+	}
+	if checkETag(w, r, c.folderETag(dir, imgs, variant+"|"+cur.Sort+"|"+strconv.Itoa(start)+"|"+strconv.Itoa(limit))) {
+		return
+	}
+	w.Header().Set("X-Image-Count", strconv.Itoa(len(imgs)))
+
+	if !htmx {
+		resp := scrollResponse{Images: make([]string, 0, len(batch)), Total: len(imgs)}
+		for _, img := range batch {
+			resp.Images = append(resp.Images, c.srcFor(img))
+		}
+		if next != "" {
+			resp.Next = &next
+		}
+		writeJSON(w, resp)
+		return
+	}
+	t := translations[lang]
+	var b strings.Builder
+	for _, img := range batch {
+		c.writeGridFigure(&b, img, t)
+	}
+	if next != "" {
+		set.Set("cursor", next)
+		b.WriteString("<div hx-get='" + c.Prefix + "/api/scroll?" + template.HTMLEscapeString(set.Encode()) + "' hx-trigger='revealed' hx-swap='outerHTML' class='col-span-full h-8' aria-hidden='true'></div>")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
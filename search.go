@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// searchEntry is one indexed image. key is what queries match against.
+type searchEntry struct {
+	src     string // images/... form
+	key     string
+	caption string
+}
+
+// searchIndex holds every visible image of a catalog in memory so searches
+// are substring lookups rather than directory walks. It is built at startup
+// and rebuilt by /admin/refresh; readers keep working during a rebuild.
+type searchIndex struct {
+	mu      sync.RWMutex
+	entries []searchEntry
+	folders int
+	builtAt time.Time
+	fts     bool // search_fts holds this catalog; set by the first metadata sync
+}
+
+// searchKey is the text a query matches: the image path below images/, the
+// folder's display title and the image's caption, tags and OCR numbers,
+// lowercased
+func searchKey(src, folderTitle, caption string, tags []string, numbers string) string {
+	return strings.ToLower(strings.TrimPrefix(src, "images/") + "\n" + folderTitle + "\n" + caption + "\n" + strings.Join(tags, " ") + "\n" + numbers)
+}
+
+// searchMatches reports whether an image with the given key matches q: every
+// whitespace-separated term of q must occur in the key, ignoring case. An
+// empty query matches nothing.
+func searchMatches(key, q string) bool {
+	terms := strings.Fields(strings.ToLower(q))
+	if len(terms) == 0 {
+		return false
+	}
+	for _, t := range terms {
+		if !strings.Contains(key, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// rebuildIndex lists the catalog with the gallery's own listing functions,
+// so hidden folders and skipped files stay out of search results too, then
+// swaps the new entries in
+func (c *catalog) rebuildIndex() {
+	ctx := context.Background()
+	start := time.Now()
+	var entries []searchEntry
+	folders := c.listDailyFolders(ctx)
+	for _, f := range folders {
+		for _, img := range c.listImages(ctx, c.dir("daily", f.Name)) {
+			src, caption := c.srcFor(img), c.captionFor(img)
+			entries = append(entries, searchEntry{src: src, key: searchKey(src, f.DisplayName, caption, c.tagsFor(img), numbersFor(img)), caption: caption})
+		}
+	}
+	for _, cat := range c.categories() {
+		for _, img := range c.listImages(ctx, c.dir(cat.Name)) {
+			src, caption := c.srcFor(img), c.captionFor(img)
+			entries = append(entries, searchEntry{src: src, key: searchKey(src, cat.Title, caption, c.tagsFor(img), numbersFor(img)), caption: caption})
+		}
+	}
+
+	c.index.mu.Lock()
+	c.index.entries = entries
+	c.index.folders = len(folders)
+	c.index.builtAt = time.Now()
+	c.index.mu.Unlock()
+	slog.Info("search index built", "catalog", c.Prefix, "images", len(entries),
+		"folders", len(folders), "duration", time.Since(start).Round(time.Millisecond).String())
+}
+
+// searchHit is one image matching a query. snippet is its caption with the
+// matched text between markStart and markEnd, or "" without a caption.
+type searchHit struct {
+	src     string
+	snippet string
+}
+
+// Highlight markers in snippets; control characters can't occur in captions
+const (
+	markStart = "\x02"
+	markEnd   = "\x03"
+)
+
+// search returns every indexed image matching q, in listing order. With
+// the metadata store the full-text index answers, so captions match by
+// substring in any script; the in-memory index covers the rest: before the
+// first sync, and terms under three characters, which trigrams can't find.
+func (c *catalog) search(ctx context.Context, q string) []searchHit {
+	terms := strings.Fields(strings.ToLower(q))
+	// Rebuilds swap the slice rather than change it, so it can be used
+	// without the lock
+	c.index.mu.RLock()
+	entries, fts := c.index.entries, c.index.fts
+	c.index.mu.RUnlock()
+	if fts && ftsSearchable(terms) {
+		snippets, err := c.ftsSearch(ctx, terms)
+		if err == nil {
+			var hits []searchHit
+			for _, e := range entries {
+				if snippet, ok := snippets[e.src]; ok {
+					hits = append(hits, searchHit{src: e.src, snippet: snippet})
+				}
+			}
+			return hits
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		slog.Error("full-text search failed", "catalog", c.Prefix, "err", err)
+	}
+	var hits []searchHit
+	for _, e := range entries {
+		if searchMatches(e.key, q) {
+			hits = append(hits, searchHit{src: e.src, snippet: markTerms(e.caption, terms)})
+		}
+	}
+	return hits
+}
+
+// ftsSearchable reports whether every term is long enough for the trigram
+// index
+func ftsSearchable(terms []string) bool {
+	for _, t := range terms {
+		if utf8.RuneCountInString(t) < 3 {
+			return false
+		}
+	}
+	return len(terms) > 0
+}
+
+// ftsSearch queries search_fts for images matching every term and returns
+// their marked captions by src
+func (c *catalog) ftsSearch(ctx context.Context, terms []string) (map[string]string, error) {
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(t, `"`, `""`) + `"`
+	}
+	rows, err := c.srv.metaDB.QueryContext(ctx, `SELECT src, highlight(search_fts, 4, char(2), char(3))
+		FROM search_fts WHERE search_fts MATCH ? AND catalog = ?`, strings.Join(quoted, " "), c.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	snippets := map[string]string{}
+	for rows.Next() {
+		var src, snippet string
+		if err := rows.Scan(&src, &snippet); err != nil {
+			return nil, err
+		}
+		snippets[src] = snippet
+	}
+	return snippets, rows.Err()
+}
+
+// markTerms marks every occurrence of the terms in caption, ignoring case
+func markTerms(caption string, terms []string) string {
+	lower := strings.ToLower(caption)
+	if len(lower) != len(caption) {
+		return caption // offsets wouldn't line up; show it unmarked
+	}
+	marked := make([]bool, len(caption))
+	for _, t := range terms {
+		for i := 0; ; {
+			j := strings.Index(lower[i:], t)
+			if j < 0 {
+				break
+			}
+			for k := i + j; k < i+j+len(t); k++ {
+				marked[k] = true
+			}
+			i += j + len(t)
+		}
+	}
+	var b strings.Builder
+	for i := 0; i < len(caption); i++ {
+		if marked[i] && (i == 0 || !marked[i-1]) {
+			b.WriteString(markStart)
+		}
+		b.WriteByte(caption[i])
+		if marked[i] && (i == len(caption)-1 || !marked[i+1]) {
+			b.WriteString(markEnd)
+		}
+	}
+	return b.String()
+}
+
+// snippetRunes is how much of a long caption a result shows
+const snippetRunes = 80
+
+// snippetHTML renders a marked caption as HTML with <mark> highlights,
+// cutting long ones to snippetRunes around the first match
+func snippetHTML(marked string) template.HTML {
+	runes := []rune(marked)
+	start, end := 0, len(runes)
+	if end > snippetRunes {
+		if i := strings.Index(marked, markStart); i >= 0 {
+			start = max(utf8.RuneCountInString(marked[:i])-snippetRunes/4, 0)
+		}
+		end = min(start+snippetRunes, len(runes))
+	}
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	open := false
+	for _, r := range runes[start:end] {
+		switch string(r) {
+		case markStart:
+			b.WriteString("<mark>")
+			open = true
+		case markEnd:
+			b.WriteString("</mark>")
+			open = false
+		default:
+			b.WriteString(template.HTMLEscapeString(string(r)))
+		}
+	}
+	if open {
+		b.WriteString("</mark>")
+	}
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return template.HTML(b.String())
+}
+
+// indexSize reports the number of indexed images and folders and when the
+// index was built
+func (c *catalog) indexSize() (images, folders int, builtAt time.Time) {
+	c.index.mu.RLock()
+	defer c.index.mu.RUnlock()
+	return len(c.index.entries), c.index.folders, c.index.builtAt
+}
+
+// maxSearchResults caps how many images one search shows
+const maxSearchResults = 200
+
+// searchResults is the data of the "searchResults" template
+type searchResults struct {
+	Query     string
+	Groups    []searchGroup
+	Total     int  // matches shown
+	Truncated bool // more matched than maxSearchResults
+	T         map[string]string
+}
+
+// searchGroup is the matches within one daily folder or category, in
+// search results and on tag pages
+type searchGroup struct {
+	Title string
+	URL   string // the folder's gallery page
+	Grid  imageGrid
+}
+
+// groupByFolder splits srcs, in listing order, into one group per daily
+// folder or category, titled and linked like the gallery tabs
+func (c *catalog) groupByFolder(folders []DailyFolder, srcs []string, t map[string]string) []searchGroup {
+	titles := make(map[string]string, len(folders))
+	for _, f := range folders {
+		titles[f.Name] = f.DisplayName
+	}
+	categories := map[string]category{}
+	for _, cat := range c.categories() {
+		categories[cat.Name] = cat
+	}
+	var groups []searchGroup
+	for _, src := range srcs {
+		dir := path.Dir(src)
+		var title, link string
+		if folder, ok := strings.CutPrefix(dir, "images/daily/"); ok {
+			title = titles[folder]
+			if title == "" {
+				title = folder
+			}
+			link = c.Prefix + "/?" + galleryQuery("daily", folder, "").Encode()
+		} else {
+			name := strings.TrimPrefix(dir, "images/")
+			title, link = categories[name].Label(t), c.Prefix+"/?"+url.Values{"tab": {name}}.Encode()
+		}
+		if n := len(groups); n == 0 || groups[n-1].URL != link {
+			groups = append(groups, searchGroup{Title: title, URL: link, Grid: imageGrid{Prefix: c.Prefix, T: t}})
+		}
+		g := &groups[len(groups)-1]
+		g.Grid.Images = append(g.Grid.Images, src)
+	}
+	for i := range groups {
+		groups[i].Grid.Captions = c.captionsBySrc(groups[i].Grid.Images)
+		groups[i].Grid.Previews = c.previewsBySrc(groups[i].Grid.Images)
+	}
+	return groups
+}
+
+// searchHandler finds images whose name, path, folder title, caption, tags
+// or OCR numbers match q and groups them by folder in listing order. HTMX
+// requests from the search box get the results fragment; others get the
+// gallery page showing them.
+func (c *catalog) searchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	lang := detectLang(r)
+	t := translations[lang]
+	res := &searchResults{Query: q, T: t}
+	hits := c.search(ctx, q)
+	if len(hits) > maxSearchResults {
+		hits, res.Truncated = hits[:maxSearchResults], true
+	}
+	res.Total = len(hits)
+
+	folders := c.listDailyFolders(ctx)
+	srcs := make([]string, len(hits))
+	for i, hit := range hits {
+		srcs[i] = hit.src
+	}
+	res.Groups = c.groupByFolder(folders, srcs, t)
+	snippets := map[string]template.HTML{}
+	for _, hit := range hits {
+		if hit.snippet != "" {
+			snippets[hit.src] = snippetHTML(hit.snippet)
+		}
+	}
+	for i := range res.Groups {
+		res.Groups[i].Grid.Snippets = snippets
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	w.Header().Set("Vary", "Accept-Language, Cookie, HX-Request")
+	if r.Header.Get("HX-Request") == "true" {
+		c.srv.render(w, http.StatusOK, "searchResults", res)
+		return
+	}
+	data := PageData{
+		Prefix:       c.Prefix,
+		ActiveTab:    "search",
+		DailyFolders: folders,
+		RecentImages: c.recentFromRequest(r),
+		SiteName:     c.siteName(),
+		Search:       res,
+	}
+	data.Lang = lang
+	data.T = t
+	data.Theme = themeFromRequest(r)
+	c.srv.render(w, http.StatusOK, "index.gohtml", data)
+}
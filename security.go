@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// defaultCSP allows the CDNs the templates load (Tailwind, htmx, the
+// Material Tailwind stylesheet) plus the inline scripts and styles they use.
+// %s is the frame-ancestors source, matching FRAME_OPTIONS.
+const defaultCSP = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline' https://cdn.tailwindcss.com https://unpkg.com; " +
+	"style-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net; " +
+	"img-src 'self' data: blob:; connect-src 'self'; object-src 'none'; " +
+	"base-uri 'self'; form-action 'self'; frame-ancestors %s"
+
+// securitySettings are the headers sent with every HTML response.
+// contentSecurityPolicy (CONTENT_SECURITY_POLICY) replaces the default
+// policy, and with cspReportOnly (CSP_REPORT_ONLY=1) is sent as
+// Content-Security-Policy-Report-Only to try a policy out first.
+// referrerPolicy (REFERRER_POLICY) and frameOptions (FRAME_OPTIONS, DENY or
+// SAMEORIGIN) set the headers of the same name. "off" drops a header.
+type securitySettings struct {
+	contentSecurityPolicy string
+	cspReportOnly         bool
+	referrerPolicy        string
+	frameOptions          string
+}
+
+func (cfg *config) loadSecurityConfig() {
+	if v := os.Getenv("FRAME_OPTIONS"); v != "" {
+		switch v = strings.ToUpper(v); v {
+		case "DENY", "SAMEORIGIN", "OFF":
+			cfg.frameOptions = v
+		default:
+			log.Fatalf("invalid FRAME_OPTIONS %q: want DENY, SAMEORIGIN or off", v)
+		}
+	}
+	if v := os.Getenv("REFERRER_POLICY"); v != "" {
+		cfg.referrerPolicy = v
+	}
+	ancestors := "'none'"
+	switch cfg.frameOptions {
+	case "SAMEORIGIN":
+		ancestors = "'self'"
+	case "OFF":
+		ancestors = "*"
+	}
+	cfg.contentSecurityPolicy = fmt.Sprintf(defaultCSP, ancestors)
+	if v := os.Getenv("CONTENT_SECURITY_POLICY"); v != "" {
+		cfg.contentSecurityPolicy = v
+	}
+	switch v := os.Getenv("CSP_REPORT_ONLY"); v {
+	case "", "0":
+	case "1":
+		cfg.cspReportOnly = true
+	default:
+		log.Fatalf("invalid CSP_REPORT_ONLY %q: want 0 or 1", v)
+	}
+}
+
+// securityHeaders adds the security headers to HTML responses once the
+// handler has settled on a Content-Type. Images and JSON don't run scripts
+// and are left as they are.
+func (s *Server) securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&securityWriter{ResponseWriter: w, cfg: &s.cfg}, r)
+	})
+}
+
+type securityWriter struct {
+	http.ResponseWriter
+	cfg         *config
+	wroteHeader bool
+}
+
+func (sw *securityWriter) WriteHeader(code int) {
+	if !sw.wroteHeader {
+		sw.wroteHeader = true
+		if strings.HasPrefix(sw.Header().Get("Content-Type"), "text/html") {
+			sw.cfg.setSecurityHeaders(sw.Header())
+		}
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *securityWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		if sw.Header().Get("Content-Type") == "" {
+			sw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sw *securityWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (cfg *config) setSecurityHeaders(h http.Header) {
+	h.Set("X-Content-Type-Options", "nosniff")
+	if cfg.contentSecurityPolicy != "off" {
+		if cfg.cspReportOnly {
+			h.Set("Content-Security-Policy-Report-Only", cfg.contentSecurityPolicy)
+		} else {
+			h.Set("Content-Security-Policy", cfg.contentSecurityPolicy)
+		}
+	}
+	if cfg.referrerPolicy != "off" {
+		h.Set("Referrer-Policy", cfg.referrerPolicy)
+	}
+	if cfg.frameOptions != "OFF" {
+		h.Set("X-Frame-Options", cfg.frameOptions)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is the whole site: the template set, where assets live, the
+// catalogs, and the handler tree built from them. main builds one from the
+// environment; tests can build one over temp directories with newServer and
+// serve it with httptest.
+type Server struct {
+	Catalogs []*catalog
+
+	mu          sync.RWMutex
+	site        *site  // replaced whole by reload
+	cfg         config // as started; catalogs read their settings from it
+	mux         *http.ServeMux
+	middlewares []middleware // outermost first
+	handler     http.Handler // mux wrapped in the middlewares
+
+	// State that lives as long as the server
+	thumbs       *byteLRU      // hottest generated thumbnails, in front of the disk cache
+	variants     *variantQueue // AVIF and WebP variants waiting for variantLoop
+	views        *viewCounts
+	metaDB       *sql.DB  // nil without METADATA_DB
+	folderZips   *limiter // nil when folder ZIPs are off
+	folderPDFs   *limiter // nil when folder PDFs are off
+	loginLimiter *limiter
+	sessions     adminSessions
+}
+
+// embedded holds the templates and app icons so a single binary runs from
+// any directory. TEMPLATE_DIR and ASSET_DIR switch to copies on disk, for
+// editing templates without rebuilding.
+//
+//go:embed templates/*.gohtml appicon.png preview.png
+var embedded embed.FS
+
+// site is the part of the server a reload swaps in one piece: the brand,
+// the assets and the parsed templates
+type site struct {
+	SiteName      string // for pages outside any catalog and catalogs without their own
+	TemplateDir   string // page templates (*.gohtml); empty for the embedded ones
+	AssetDir      string // holds static/, appicon.png and preview.png; empty for the embedded ones
+	templates     *template.Template
+	templateFiles []string  // parsed files on disk, whose modtimes feed Last-Modified
+	loadedAt      time.Time // also feeds Last-Modified
+	assets        fs.FS
+}
+
+// newServer parses the templates in cfg.TemplateDir and wires up the routes
+// of every catalog
+func newServer(cfg config, catalogs []*catalog) (*Server, error) {
+	st, err := loadSite(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Catalogs:     catalogs,
+		site:         st,
+		cfg:          cfg,
+		thumbs:       newByteLRU(int64(cfg.thumbMemoryMB) << 20),
+		variants:     newVariantQueue(),
+		views:        newViewCounts(),
+		loginLimiter: newLimiterPer(adminLoginFailuresPerHour, time.Hour),
+		sessions:     adminSessions{m: map[string]adminSession{}},
+	}
+	if cfg.folderZipPerHour > 0 {
+		s.folderZips = newLimiterPer(cfg.folderZipPerHour, time.Hour)
+	}
+	if cfg.folderPDFPerHour > 0 {
+		s.folderPDFs = newLimiterPer(cfg.folderPDFPerHour, time.Hour)
+	}
+	if cfg.metadataDB != "" {
+		if s.metaDB, err = openMetadataDB(cfg.metadataDB); err != nil {
+			return nil, fmt.Errorf("error opening METADATA_DB %s: %w", cfg.metadataDB, err)
+		}
+	}
+	s.loadViewCounts()
+	s.mux = http.NewServeMux()
+	s.routes()
+	s.Use(
+		requestID,
+		s.securityHeaders,
+		s.accessLog,
+		s.instrument,
+		s.recoverPanics,
+		s.allowedHostsOnly,
+		s.apiCORS,
+		s.rateLimit,
+		s.compressResponses,
+		headRequests,
+		s.maintenance,
+	)
+	return s, nil
+}
+
+// Close releases what the server holds open: the metadata store
+func (s *Server) Close() error {
+	if s.metaDB != nil {
+		return s.metaDB.Close()
+	}
+	return nil
+}
+
+// ServeHTTP serves the site through the middleware chain
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// current returns the site as of the last (re)load
+func (s *Server) current() *site {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.site
+}
+
+// siteName is the current site name
+func (s *Server) siteName() string {
+	return s.current().SiteName
+}
+
+// openAsset opens a file of the asset directory or the embedded assets
+func (s *Server) openAsset(name string) (fs.File, error) {
+	return s.current().assets.Open(name)
+}
+
+// routes registers the site-wide handlers and mounts each catalog
+func (s *Server) routes() {
+	// Assets are looked up per request so a reload can move them
+	s.mux.Handle("/static/", http.StripPrefix("/static/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		static, _ := fs.Sub(s.current().assets, "static")
+		http.FileServerFS(static).ServeHTTP(w, r)
+	})))
+	s.mux.HandleFunc("/appicon.png", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFileFS(w, r, s.current().assets, "appicon.png")
+	})
+	s.mux.HandleFunc("/preview.png", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFileFS(w, r, s.current().assets, "preview.png")
+	})
+	s.mux.HandleFunc("/prefs", prefsHandler)
+	s.mux.HandleFunc("/healthz", healthzHandler)
+	s.mux.HandleFunc("/readyz", s.readyzHandler)
+	s.mux.HandleFunc("/metrics", s.adminAuth(metricsHandler))
+	s.mux.HandleFunc("/admin", s.adminAuth(s.adminHomeHandler))
+	s.mux.HandleFunc("/admin/login", s.adminLoginHandler)
+	s.mux.HandleFunc("/admin/logout", s.adminLogoutHandler)
+	s.mux.HandleFunc("/admin/refresh", s.adminAuth(s.adminRefreshHandler))
+	s.mux.HandleFunc("/admin/reload", s.adminAuth(s.adminReloadHandler))
+	s.mux.HandleFunc("/admin/folders/rename", s.adminAuth(s.adminRenameFolderHandler))
+	s.mux.HandleFunc("/admin/folders/cover", s.adminAuth(s.adminFolderCoverHandler))
+	s.mux.HandleFunc("/admin/folders/order", s.adminAuth(s.adminFolderOrderHandler))
+	s.mux.HandleFunc("/admin/duplicates", s.adminAuth(s.adminDuplicatesHandler))
+	s.mux.HandleFunc("/admin/broken", s.adminAuth(s.adminBrokenHandler))
+	s.mux.HandleFunc("/admin/images/remove", s.adminAuth(s.adminRemoveImageHandler))
+	s.mux.HandleFunc("/admin/images/tags", s.adminAuth(s.adminImageTagsHandler))
+	for _, c := range s.Catalogs {
+		c.srv = s
+		c.cfg = &s.cfg
+		if c.fs == nil {
+			c.fs = osStorage{}
+		}
+		c.mount(s.mux)
+		c.watchCatalog()
+		slog.Info("catalog mounted", "site_name", c.siteName(), "root", c.Root, "prefix", c.Prefix+"/")
+		c.rebuildIndex()
+	}
+}
+
+// loadSite parses every template in cfg.TemplateDir, or the embedded ones
+// when it is empty. The directory and the glob are checked separately so a
+// wrong working directory (common in containers) reads differently from a
+// bad template.
+func loadSite(cfg config) (*site, error) {
+	funcs := template.FuncMap{
+		"sub":          func(a, b int) int { return a - b },
+		"trimPrefix":   func(s, prefix string) string { return strings.TrimPrefix(s, prefix) },
+		"base":         path.Base,
+		"isVideo":      isVideoName,
+		"humanBytes":   humanBytes,
+		"displayDate":  displayDate,
+		"displayMonth": displayMonth,
+		"gridSrcset":   func(prefix, src string) string { return srcset(prefix, src, gridSrcsetWidths) },
+		"viewSrcset":   func(prefix, src string) string { return srcset(prefix, src, viewSrcsetWidths) },
+		"tileSrcset":   tileSrcset,
+		"folderZips":   cfg.folderZipEnabled,
+		"gridSizes":    func() string { return gridSizes },
+		"viewSizes":    func() string { return viewSizes },
+		"viewWidths":   func() []int { return viewSrcsetWidths },
+	}
+	templateFS, _ := fs.Sub(embedded, "templates")
+	if cfg.TemplateDir != "" {
+		wd, _ := os.Getwd()
+		info, err := os.Stat(cfg.TemplateDir)
+		if err != nil {
+			return nil, fmt.Errorf("no templates directory: %s not found in working directory %s: %w", cfg.TemplateDir, wd, err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("no templates directory: %s in %s is not a directory", cfg.TemplateDir, wd)
+		}
+		templateFS = os.DirFS(cfg.TemplateDir)
+	}
+	names, _ := fs.Glob(templateFS, "*.gohtml")
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no matching templates: %s has no *.gohtml files", cfg.TemplateDir)
+	}
+	templates, err := template.New("").Funcs(funcs).ParseFS(templateFS, names...)
+	if err != nil {
+		return nil, fmt.Errorf("template parse error: %w", err)
+	}
+	var files []string
+	if cfg.TemplateDir != "" {
+		for _, n := range names {
+			files = append(files, filepath.Join(cfg.TemplateDir, n))
+		}
+	}
+	var assets fs.FS = embedded
+	if cfg.AssetDir != "" {
+		assets = os.DirFS(cfg.AssetDir)
+	}
+
+	var defined []string
+	for _, t := range templates.Templates() {
+		if t.Name() != "" && t.Tree != nil {
+			defined = append(defined, t.Name())
+		}
+	}
+	sort.Strings(defined)
+	source := cfg.TemplateDir
+	if source == "" {
+		source = "embedded"
+	}
+	slog.Info("templates loaded", "dir", source, "count", len(defined), "names", defined)
+	return &site{
+		SiteName:      cfg.SiteName,
+		TemplateDir:   cfg.TemplateDir,
+		AssetDir:      cfg.AssetDir,
+		templates:     templates,
+		templateFiles: files,
+		loadedAt:      time.Now(),
+		assets:        assets,
+	}, nil
+}
+
+// render executes the named template into a buffer and only writes it out
+// on success, so a failure halfway through yields a clean 500 instead of a
+// partial page with a 500 body appended
+func (s *Server) render(w http.ResponseWriter, status int, name string, data any) {
+	var buf bytes.Buffer
+	if err := s.current().templates.ExecuteTemplate(&buf, name, data); err != nil {
+		slog.Error("executing template", "template", name, "err", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// notFoundPage answers with the styled 404 page
+func (s *Server) notFoundPage(w http.ResponseWriter, r *http.Request) {
+	lang := detectLang(r)
+	data := struct {
+		SiteName string
+		Lang     string
+		T        map[string]string
+	}{s.siteName(), lang, translations[lang]}
+	s.render(w, http.StatusNotFound, "notfound.gohtml", data)
+}
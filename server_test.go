@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// TestMain logs quietly unless LOG_LEVEL asks otherwise
+func TestMain(m *testing.M) {
+	if os.Getenv("LOG_LEVEL") == "" {
+		os.Setenv("LOG_LEVEL", "error")
+	}
+	loadLogConfig()
+	os.Exit(m.Run())
+}
+
+// newTestServer builds a server over a temp image root holding a weekly
+// image and a daily folder with one image, and returns it with the root.
+// The cache goes to the same temp directory; opts adjust the config first.
+func newTestServer(t *testing.T, opts ...func(*config)) (*Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "images")
+	writeTestJPEG(t, filepath.Join(root, "weekly", "week1.jpg"), 64, 48)
+	writeTestJPEG(t, filepath.Join(root, "daily", "2024-06-01", "card 1.jpg"), 64, 48)
+	cfg := defaultConfig()
+	cfg.ImagesRoot = root
+	cfg.CacheDir = filepath.Join(dir, "cache")
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	srv, err := newServer(cfg, []*catalog{{Root: root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, root
+}
+
+// get serves one request through srv's whole middleware chain
+func get(t *testing.T, srv http.Handler, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServerServesGallery(t *testing.T) {
+	srv, _ := newTestServer(t)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		path, contains string
+	}{
+		{"/healthz", ""},
+		{"/?tab=weekly", "images/weekly/week1.jpg"},
+		{"/?tab=daily&folder=2024-06-01", "card%201.jpg"},
+		{"/images/weekly/week1.jpg", ""},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+tc.path, nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: %d, want 200", tc.path, resp.StatusCode)
+			continue
+		}
+		if !strings.Contains(string(body), tc.contains) {
+			t.Errorf("GET %s: body lacks %q", tc.path, tc.contains)
+		}
+	}
+	if rec := get(t, srv, http.MethodGet, "/view?src=images/weekly/missing.jpg"); rec.Code != http.StatusNotFound {
+		t.Errorf("view of a missing image: %d, want 404", rec.Code)
+	}
+}
+
+// mapStorage serves a catalog from memory. Directories of a MapFS can't
+// seek, so they come back wrapped.
+type mapStorage struct{ fstest.MapFS }
+
+type unseekable struct{ fs.File }
+
+func (unseekable) Seek(int64, int) (int64, error) { return 0, errors.ErrUnsupported }
+
+func (m mapStorage) Open(name string) (storageFile, error) {
+	f, err := m.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if sf, ok := f.(storageFile); ok {
+		return sf, nil
+	}
+	return unseekable{f}, nil
+}
+
+func (m mapStorage) Stat(name string) (fs.FileInfo, error) { return m.MapFS.Stat(name) }
+
+func TestServerReadsCatalogStorage(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 64, 48)), nil); err != nil {
+		t.Fatal(err)
+	}
+	mem := mapStorage{fstest.MapFS{
+		"mem/weekly/week1.jpg":          {Data: buf.Bytes(), ModTime: time.Now()},
+		"mem/daily/2024-06-01/card.jpg": {Data: buf.Bytes(), ModTime: time.Now()},
+	}}
+	cfg := defaultConfig()
+	cfg.ImagesRoot = "mem"
+	cfg.CacheDir = t.TempDir()
+	srv, err := newServer(cfg, []*catalog{{Root: "mem", fs: mem}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		path, contains string
+	}{
+		{"/?tab=weekly", "images/weekly/week1.jpg"},
+		{"/?tab=daily&folder=2024-06-01", "card.jpg"},
+		{"/images/weekly/week1.jpg", buf.String()},
+		{"/thumb?src=images/weekly/week1.jpg", ""},
+	} {
+		rec := get(t, srv, http.MethodGet, tc.path)
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s: %d, want 200", tc.path, rec.Code)
+			continue
+		}
+		if !strings.Contains(rec.Body.String(), tc.contains) {
+			t.Errorf("GET %s: body lacks %q", tc.path, tc.contains)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// statsTTL is how long computed catalog stats are reused before the image
+// tree is walked again
+const statsTTL = time.Minute
+
+// catalogStats summarizes the image catalog for the /stats page
+type catalogStats struct {
+	SiteName     string
+	Prefix       string
+	DailyFolders int
+	TotalImages  int
+	TotalBytes   int64
+	ByExt        []extStats
+	Newest       time.Time
+	Oldest       time.Time
+	GeneratedAt  time.Time
+
+	// Search index size, read fresh on every request
+	IndexImages  int
+	IndexFolders int
+	IndexBuilt   time.Time
+
+	// Unreadable images, read fresh too so fixes show at once
+	BrokenImages int
+}
+
+type extStats struct {
+	Ext   string
+	Count int
+	Bytes int64
+}
+
+// currentStats returns the catalog's cached stats, recomputing them once
+// they are older than statsTTL
+func (c *catalog) currentStats() *catalogStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.stats == nil || time.Since(c.stats.GeneratedAt) > statsTTL {
+		c.stats = c.computeStats()
+	}
+	return c.stats
+}
+
+// computeStats walks the daily folders and categories using the same
+// listing functions as the gallery, so hidden folders and skipped files are
+// excluded here too. The result is cached, so it is not tied to the request
+// that happened to trigger it.
+func (c *catalog) computeStats() *catalogStats {
+	ctx := context.Background()
+	st := &catalogStats{SiteName: c.siteName(), Prefix: c.Prefix, GeneratedAt: time.Now()}
+	folders := c.listDailyFolders(ctx)
+	st.DailyFolders = len(folders)
+	var imgs []string
+	for _, f := range folders {
+		imgs = append(imgs, c.listImages(ctx, c.dir("daily", f.Name))...)
+	}
+	for _, cat := range c.categories() {
+		imgs = append(imgs, c.listImages(ctx, c.dir(cat.Name))...)
+	}
+
+	byExt := map[string]*extStats{}
+	for _, img := range imgs {
+		size, mt, err := c.imageStat(img)
+		if err != nil {
+			continue
+		}
+		st.TotalImages++
+		st.TotalBytes += size
+		ext := strings.ToLower(filepath.Ext(img))
+		if byExt[ext] == nil {
+			byExt[ext] = &extStats{Ext: ext}
+		}
+		byExt[ext].Count++
+		byExt[ext].Bytes += size
+		if st.Newest.IsZero() || mt.After(st.Newest) {
+			st.Newest = mt
+		}
+		if st.Oldest.IsZero() || mt.Before(st.Oldest) {
+			st.Oldest = mt
+		}
+	}
+	for _, e := range byExt {
+		st.ByExt = append(st.ByExt, *e)
+	}
+	sort.Slice(st.ByExt, func(i, j int) bool { return st.ByExt[i].Count > st.ByExt[j].Count })
+	return st
+}
+
+// statsHandler renders the catalog summary page
+func (c *catalog) statsHandler(w http.ResponseWriter, r *http.Request) {
+	st := *c.currentStats()
+	st.IndexImages, st.IndexFolders, st.IndexBuilt = c.indexSize()
+	st.BrokenImages = len(c.brokenImages(r.Context()))
+	w.Header().Set("Cache-Control", "no-store")
+	c.srv.render(w, http.StatusOK, "stats.gohtml", st)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// storage is how a catalog reads its image tree: listings, stats, sidecars,
+// folder settings and image bytes. Names are the on-disk paths the catalog
+// builds with dir, so handlers keep working with full paths, and ReadDir
+// sorts by name like os.ReadDir; osStorage, the default, reads them straight
+// from disk. What the server generates (the cache directory), what admin
+// endpoints and background jobs write, and what ffmpeg reads stay on disk.
+type storage interface {
+	Open(name string) (storageFile, error)
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	ReadFile(name string) ([]byte, error)
+}
+
+// storageFile is an open file of a storage. Serving ranges and sniffing
+// image headers both need to seek.
+type storageFile interface {
+	fs.File
+	io.ReadSeeker
+}
+
+// osStorage reads the local filesystem
+type osStorage struct{}
+
+func (osStorage) Open(name string) (storageFile, error) { return os.Open(name) }
+
+func (osStorage) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+
+func (osStorage) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+
+func (osStorage) ReadFile(name string) ([]byte, error) { return os.ReadFile(name) }
+
+// rootFS presents the tree below root in fsys as an fs.FS, for the
+// /images/ file server
+type rootFS struct {
+	fsys storage
+	root string
+}
+
+func (r rootFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return r.fsys.Open(filepath.Join(r.root, filepath.FromSlash(name)))
+}
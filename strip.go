@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stripMetadata (STRIP_METADATA, default 1) serves JPEG and PNG originals
+// without the metadata cameras and phones write into them: GPS position,
+// device make and serial, editing software and comments. The orientation
+// and colour profile are kept so the image still looks the same. Copies are
+// cached next to the thumbnails; the files themselves are never modified.
+type stripSettings struct {
+	stripMetadata bool
+}
+
+func (cfg *config) loadStripConfig() {
+	switch v := os.Getenv("STRIP_METADATA"); v {
+	case "", "1":
+	case "0":
+		cfg.stripMetadata = false
+	default:
+		log.Fatalf("invalid STRIP_METADATA %q: want 0 or 1", v)
+	}
+}
+
+// publicCopy returns the path of what visitors get for the image at
+// fullPath: the stamped copy while watermarking is on, else the stripped
+// copy, else the file itself
+func (c *catalog) publicCopy(fullPath string, info os.FileInfo) (string, error) {
+	if c.cfg.watermarkID != "" && isImageName(fullPath) {
+		// Stamped copies are re-encoded and carry no metadata
+		return c.watermarkedOriginal(fullPath, info)
+	}
+	if c.cfg.stripMetadata {
+		return c.strippedOriginal(fullPath, info)
+	}
+	return fullPath, nil
+}
+
+// publicFS is the storage holding public, a path publicCopy returned for
+// fullPath: the catalog's own when the original goes out as it is, the
+// local cache otherwise
+func (c *catalog) publicFS(fullPath, public string) storage {
+	if public == fullPath {
+		return c.fs
+	}
+	return osStorage{}
+}
+
+// servePublicCopy serves publicCopy of the image at fullPath. Its modtime is
+// the copy's, so a browser holding the file as it was served before
+// watermarking or stripping was turned on doesn't get a 304.
+func (c *catalog) servePublicCopy(w http.ResponseWriter, r *http.Request, fullPath string, info os.FileInfo) {
+	public, err := c.publicCopy(fullPath, info)
+	if err != nil {
+		// Never fall back to the untouched original
+		slog.Warn("public copy failed", "path", fullPath, "err", err)
+		http.Error(w, "image unavailable", http.StatusInternalServerError)
+		return
+	}
+	f, err := c.publicFS(fullPath, public).Open(public)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	publicInfo, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, public, publicInfo.ModTime(), f)
+}
+
+// strippedOriginal returns the path of the copy of the image at fullPath
+// without its metadata, generating it into the thumbnail cache on first
+// use. Images with nothing to strip, and formats other than JPEG and PNG,
+// are served as they are: fullPath is returned, and an empty cache file
+// remembers that.
+func (c *catalog) strippedOriginal(fullPath string, info os.FileInfo) (string, error) {
+	ext := strings.ToLower(filepath.Ext(fullPath))
+	var strip func([]byte) ([]byte, bool)
+	switch ext {
+	case ".jpg", ".jpeg":
+		strip = stripJPEG
+	case ".png":
+		strip = stripPNG
+	default:
+		return fullPath, nil
+	}
+	cachePath := c.cfg.cachePath(thumbCacheDir, c.thumbCacheKey(fullPath, info, 0, 0, fitContain)+".clean"+ext)
+	if cached, err := os.Stat(cachePath); err == nil {
+		if cached.Size() == 0 {
+			return fullPath, nil
+		}
+		return cachePath, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	data, err := c.fs.ReadFile(fullPath)
+	if err != nil {
+		return "", err
+	}
+	clean, changed := strip(data)
+	if !changed {
+		return fullPath, writeFileAtomic(cachePath, nil)
+	}
+	return cachePath, writeFileAtomic(cachePath, clean)
+}
+
+// stripJPEG drops the EXIF and XMP (APP1), maker (APP3-APP13, APP15) and
+// comment segments of a JPEG, and anything after its end, such as the
+// extra images of an MPF file. JFIF (APP0), the ICC profile (APP2) and
+// Adobe's colour transform (APP14) stay. An orientation other than 1 is
+// written back as an EXIF segment holding nothing else. changed is false
+// when data isn't a well-formed JPEG or had nothing to drop.
+func stripJPEG(data []byte) (clean []byte, changed bool) {
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return nil, false
+	}
+	orientation := readExif(bytes.NewReader(data), time.UTC).orientation
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	placed := orientation == 1
+	i := 2
+	for {
+		if i+2 > len(data) || data[i] != 0xFF {
+			return nil, false
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF: // fill byte
+			i++
+			continue
+		case marker == 0xD9: // end of image
+			if !placed {
+				return nil, false
+			}
+			out = append(out, 0xFF, 0xD9)
+			return out, changed || i+2 < len(data)
+		case marker >= 0xD0 && marker <= 0xD7, marker == 0x01: // no length
+			out = append(out, data[i:i+2]...)
+			i += 2
+			continue
+		}
+		if i+4 > len(data) {
+			return nil, false
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end < i+4 || end > len(data) {
+			return nil, false
+		}
+		if !placed && marker != 0xE0 {
+			// After JFIF, which must come first
+			out = append(out, exifOrientationSegment(orientation)...)
+			placed = true
+		}
+		switch {
+		case marker == 0xE1, marker >= 0xE3 && marker <= 0xED, marker == 0xEF, marker == 0xFE:
+			changed = true
+		case marker == 0xE2 && bytes.HasPrefix(data[i+4:end], []byte("MPF\x00")):
+			// Points at the extra images, which are dropped below
+			changed = true
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+		if marker == 0xDA {
+			// Entropy-coded data runs to the next marker that isn't a
+			// stuffed 0xFF00 or a restart
+			start := i
+			for i+1 < len(data) && (data[i] != 0xFF || data[i+1] == 0x00 || (data[i+1] >= 0xD0 && data[i+1] <= 0xD7)) {
+				i++
+			}
+			out = append(out, data[start:i]...)
+		}
+	}
+}
+
+// exifOrientationSegment is an APP1 segment whose only tag is orientation
+func exifOrientationSegment(orientation int) []byte {
+	return []byte{
+		0xFF, 0xE1, 0x00, 0x22, // APP1, 34 bytes
+		'E', 'x', 'i', 'f', 0x00, 0x00,
+		'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08, // big-endian TIFF, IFD0 at 8
+		0x00, 0x01, // one entry
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, byte(orientation), 0x00, 0x00, // SHORT orientation
+		0x00, 0x00, 0x00, 0x00, // no next IFD
+	}
+}
+
+// pngSignature starts every PNG file
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// stripPNG drops the EXIF, text and timestamp chunks of a PNG, and anything
+// after its end. changed is false when data isn't a well-formed PNG or had
+// nothing to drop.
+func stripPNG(data []byte) (clean []byte, changed bool) {
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return nil, false
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+	for i := len(pngSignature); ; {
+		if i+12 > len(data) {
+			return nil, false
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end < i+12 || end > len(data) {
+			return nil, false
+		}
+		switch kind := string(data[i+4 : i+8]); kind {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+			changed = true
+		default:
+			out = append(out, data[i:end]...)
+			if kind == "IEND" {
+				return out, changed || end < len(data)
+			}
+		}
+		i = end
+	}
+}
+
+// stripOriginals wraps the /images/ file server so JPEG and PNG originals
+// are served without their metadata; other files go to next
+func (c *catalog) stripOriginals(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.ToLower(path.Ext(r.URL.Path)) {
+		case ".jpg", ".jpeg", ".png":
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !c.cfg.stripMetadata {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fullPath := filepath.Join(c.Root, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		info, err := c.fs.Stat(fullPath)
+		if err != nil || !info.Mode().IsRegular() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		c.servePublicCopy(w, r, fullPath, info)
+	})
+}
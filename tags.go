@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// tagRe is what a tag may look like: letters (Thai too), digits, dots,
+// dashes and underscores, so it fits in a /tag/<name> URL unescaped by hand
+var tagRe = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{M}\p{N}._-]{0,39}$`)
+
+// normalizeTag trims t and reports whether it is a valid tag. Case is kept
+// for display; tags compare case-insensitively.
+func normalizeTag(t string) (string, bool) {
+	t = strings.TrimSpace(t)
+	return t, tagRe.MatchString(t)
+}
+
+// containsTag reports whether tags has tag, ignoring case
+func containsTag(tags []string, tag string) bool {
+	return slices.ContainsFunc(tags, func(t string) bool { return strings.EqualFold(t, tag) })
+}
+
+// tagCount is one entry of the tag list
+type tagCount struct {
+	Name  string
+	Count int
+}
+
+// tagListing is the data of the tags tab: every tag with its image count,
+// or the images of one tag grouped by folder
+type tagListing struct {
+	Name   string // the tag shown; empty on the tag list
+	Total  int
+	Groups []searchGroup
+	All    []tagCount
+}
+
+// tagCounts returns every tag used in c with its image count, most used
+// first. Tags that differ only in case count as one, under the spelling met
+// first.
+func (c *catalog) tagCounts(ctx context.Context) []tagCount {
+	var counts []tagCount
+	index := map[string]int{}
+	for _, img := range c.visibleImages(ctx) {
+		for _, tag := range c.tagsFor(img) {
+			key := strings.ToLower(tag)
+			i, ok := index[key]
+			if !ok {
+				i = len(counts)
+				index[key] = i
+				counts = append(counts, tagCount{Name: tag})
+			}
+			counts[i].Count++
+		}
+	}
+	sort.SliceStable(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return strings.ToLower(counts[i].Name) < strings.ToLower(counts[j].Name)
+	})
+	return counts
+}
+
+// taggedImages returns the src of every visible image tagged tag, in
+// listing order
+func (c *catalog) taggedImages(ctx context.Context, tag string) []string {
+	var srcs []string
+	for _, img := range c.visibleImages(ctx) {
+		if containsTag(c.tagsFor(img), tag) {
+			srcs = append(srcs, c.srcFor(img))
+		}
+	}
+	return srcs
+}
+
+// tagHandler renders /tag/ with every tag and /tag/<name> with the images
+// of one tag, grouped by folder like search results. Tags are read from
+// the sidecar files through dirIndex, so the pages follow edits at once.
+func (c *catalog) tagHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name, slash := folderFromPath(r.URL.Path, "/tag/")
+	if slash && c.cfg.trailingSlashRedirect {
+		redirectQuery(w, r, c.Prefix+"/tag/"+name, nil)
+		return
+	}
+	lang := detectLang(r)
+	t := translations[lang]
+	folders := c.listDailyFolders(ctx)
+	listing := &tagListing{}
+	if name == "" {
+		listing.All = c.tagCounts(ctx)
+	} else {
+		srcs := c.taggedImages(ctx, name)
+		if len(srcs) == 0 {
+			if ctx.Err() == nil {
+				c.srv.notFoundPage(w, r)
+			}
+			return
+		}
+		listing.Name, listing.Total = name, len(srcs)
+		// Show the tag as it is spelled in the files
+		tags := c.srcTags(srcs[0])
+		if i := slices.IndexFunc(tags, func(tag string) bool { return strings.EqualFold(tag, name) }); i >= 0 {
+			listing.Name = tags[i]
+		}
+		listing.Groups = c.groupByFolder(folders, srcs, t)
+	}
+	if ctx.Err() != nil {
+		return // client went away; the listing may be incomplete
+	}
+
+	data := PageData{
+		Prefix:       c.Prefix,
+		ActiveTab:    "tags",
+		DailyFolders: folders,
+		RecentImages: c.recentFromRequest(r),
+		SiteName:     c.siteName(),
+		Tags:         listing,
+	}
+	data.Lang = lang
+	data.T = t
+	data.Theme = themeFromRequest(r)
+	w.Header().Set("Vary", "Accept-Language, Cookie")
+	c.srv.render(w, http.StatusOK, "index.gohtml", data)
+}
+
+// imageTagsMu serializes sidecar edits so two requests can't lose each
+// other's tags
+var imageTagsMu sync.Mutex
+
+// imageTags is one image in the /admin/images/tags response
+type imageTags struct {
+	Src  string   `json:"src"`
+	Tags []string `json:"tags"` // the image's tags after the change
+}
+
+// adminImageTagsHandler adds the add values to and removes the remove
+// values from the tags of every src given, in one request. Tags are stored
+// in each image's .json sidecar, which is created when missing and deleted
+// again when nothing but an emptied tag list would be left. Everything is
+// validated before the first file is written. Like rename it requires
+// admin auth to be configured.
+func (s *Server) adminImageTagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.cfg.adminAuthEnabled() {
+		http.Error(w, "tagging images requires ADMIN_USER and ADMIN_PASSWORD", http.StatusForbidden)
+		return
+	}
+	c := s.adminCatalog(r)
+	if c == nil {
+		http.Error(w, "unknown catalog", http.StatusNotFound)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	srcs := r.Form["src"]
+	if len(srcs) == 0 {
+		http.Error(w, "give at least one src", http.StatusBadRequest)
+		return
+	}
+	var add, remove []string
+	for _, field := range []struct {
+		values []string
+		dst    *[]string
+	}{{r.Form["add"], &add}, {r.Form["remove"], &remove}} {
+		for _, v := range field.values {
+			tag, ok := normalizeTag(v)
+			if !ok {
+				http.Error(w, fmt.Sprintf("invalid tag %q", v), http.StatusBadRequest)
+				return
+			}
+			*field.dst = append(*field.dst, tag)
+		}
+	}
+	if len(add)+len(remove) == 0 {
+		http.Error(w, "give tags to add or remove", http.StatusBadRequest)
+		return
+	}
+	paths := make([]string, len(srcs))
+	for i, src := range srcs {
+		fullPath, err := c.resolveViewSrc(src)
+		if err != nil {
+			writeSrcError(w, r, err)
+			return
+		}
+		if reservedSidecar(sidecarName(fullPath)) {
+			http.Error(w, fmt.Sprintf("%s can't be tagged: its sidecar would be the folder's %s", src, sidecarName(fullPath)), http.StatusBadRequest)
+			return
+		}
+		paths[i] = fullPath
+	}
+
+	imageTagsMu.Lock()
+	defer imageTagsMu.Unlock()
+	resp := make([]imageTags, len(paths))
+	for i, fullPath := range paths {
+		tags, err := editSidecarTags(fullPath, add, remove)
+		if err != nil {
+			slog.Error("admin tags", "path", fullPath, "err", err)
+			http.Error(w, "writing tags failed", http.StatusInternalServerError)
+			return
+		}
+		// Don't wait for the watcher: the tag pages must show the change
+		invalidateDir(fsnotify.Event{Name: filepath.Join(filepath.Dir(fullPath), sidecarName(fullPath)), Op: fsnotify.Write})
+		resp[i] = imageTags{Src: c.srcFor(fullPath), Tags: tags}
+	}
+	slog.Info("admin tags", "catalog", c.Prefix, "images", len(paths), "add", add, "remove", remove)
+	// Searches find the new tags at once; the full-text index follows
+	// with the metadata sync of the round requested here
+	c.rebuildIndex()
+	requestIndexing()
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, resp)
+}
+
+// sidecarName is the .json sidecar file name of the image at path
+func sidecarName(path string) string {
+	name := filepath.Base(path)
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".json"
+}
+
+// editSidecarTags applies add and remove to the tags in the .json sidecar
+// of the image at path, keeping its other fields, and returns the new tags.
+// A tag in both add and remove ends up removed.
+func editSidecarTags(path string, add, remove []string) ([]string, error) {
+	p := filepath.Join(filepath.Dir(path), sidecarName(path))
+	fields := map[string]any{}
+	raw, err := os.ReadFile(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(p), err)
+		}
+	}
+	tags := []string{}
+	list, _ := fields["tags"].([]any)
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			if tag, ok := normalizeTag(s); ok && !containsTag(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	for _, tag := range add {
+		if !containsTag(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	tags = slices.DeleteFunc(tags, func(tag string) bool { return containsTag(remove, tag) })
+
+	if len(tags) > 0 {
+		fields["tags"] = tags
+	} else {
+		delete(fields, "tags")
+	}
+	if len(fields) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		return tags, nil
+	}
+	raw, err = json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return tags, writeFileAtomic(p, append(raw, '\n'))
+}
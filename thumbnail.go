@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// thumbCacheDir holds generated thumbnails, under the cache directory;
+// entries are never served stale because the cache key covers the source
+// modtime and thumbnail settings
+const thumbCacheDir = "thumbs"
+
+// thumbSettings are the thumbnail settings, overridable via
+// THUMB_MAX_WIDTH, THUMB_QUALITY and THUMB_MEMORY_CACHE_MB. The memory
+// cache in front of the disk cache is the server's thumbs.
+type thumbSettings struct {
+	thumbMaxWidth int
+	thumbQuality  int
+	thumbMemoryMB int
+}
+
+// loadThumbConfig reads and validates the thumbnail env vars. Bad values are
+// fatal so a typo doesn't silently fall back to defaults.
+func (cfg *config) loadThumbConfig() {
+	if v := os.Getenv("THUMB_MAX_WIDTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 16 || n > 4096 {
+			log.Fatalf("invalid THUMB_MAX_WIDTH %q: want an integer between 16 and 4096", v)
+		}
+		cfg.thumbMaxWidth = n
+	}
+	if v := os.Getenv("THUMB_QUALITY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			log.Fatalf("invalid THUMB_QUALITY %q: want an integer between 1 and 100", v)
+		}
+		cfg.thumbQuality = n
+	}
+	if v := os.Getenv("THUMB_MEMORY_CACHE_MB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid THUMB_MEMORY_CACHE_MB %q: want a non-negative integer", v)
+		}
+		cfg.thumbMemoryMB = n
+	}
+	slog.Info("thumbnails", "max_width", cfg.thumbMaxWidth, "quality", cfg.thumbQuality, "memory_cache_mb", cfg.thumbMemoryMB)
+}
+
+// thumbVersion is bumped whenever generation changes (v2: EXIF orientation)
+// so thumbnails cached by older builds are regenerated
+const thumbVersion = 2
+
+// thumbCacheKey identifies a thumbnail of src. Changing the source file or
+// the thumbnail settings produces a new key, so old thumbnails are never
+// served at the wrong size.
+func (c *catalog) thumbCacheKey(src string, info os.FileInfo, maxWidth, maxHeight int, fit string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%d|%d|w%d|q%d|v%d", filepath.ToSlash(src), info.Size(), info.ModTime().UnixNano(), maxWidth, c.cfg.thumbQuality, thumbVersion)
+	if maxHeight > 0 {
+		fmt.Fprintf(h, "|h%d", maxHeight)
+	}
+	if fit != fitContain {
+		fmt.Fprintf(h, "|%s", fit)
+	}
+	if c.cfg.watermarkID != "" {
+		fmt.Fprintf(h, "|wm=%s", c.cfg.watermarkID)
+	}
+	if isVideoName(src) && c.cfg.ffmpegPath == "" {
+		// Placeholder posters give way to real ones once ffmpeg is there
+		h.Write([]byte("|placeholder"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// How a resized image fills its bounds: contain scales it down to fit
+// inside them, cover crops it from the centre to their aspect ratio so it
+// fills them exactly
+const (
+	fitContain = "contain"
+	fitCover   = "cover"
+)
+
+// thumbHandler serves a JPEG thumbnail of an image, generating and caching
+// it on first request
+func (c *catalog) thumbHandler(w http.ResponseWriter, r *http.Request) {
+	c.serveResized(w, r, r.URL.Query().Get("src"), c.cfg.thumbMaxWidth, 0, fitContain, true)
+}
+
+// imgMaxDimension caps the w and h params of /img so clients can't request
+// arbitrarily large renders
+const imgMaxDimension = 2560
+
+// imgHandler serves the src image resized to the w and h params for
+// responsive srcset candidates. Results share the thumbnail caches.
+func (c *catalog) imgHandler(w http.ResponseWriter, r *http.Request) {
+	c.serveImg(w, r, r.URL.Query().Get("src"))
+}
+
+// imgPathHandler is /img/<path>, the form of /img for external consumers:
+// the image's /images/<path> URL with img in place of images, e.g.
+// /img/weekly/a.jpg?w=300&h=300&fit=cover
+func (c *catalog) imgPathHandler(w http.ResponseWriter, r *http.Request) {
+	c.serveImg(w, r, "images/"+strings.TrimPrefix(r.URL.Path, "/img/"))
+}
+
+// serveImg serves src resized to the w and h params (either may be omitted
+// with the default fit, contain) and the fit param
+func (c *catalog) serveImg(w http.ResponseWriter, r *http.Request, src string) {
+	query := r.URL.Query()
+	maxWidth, err := imgDimension(query.Get("w"))
+	if err != nil {
+		http.Error(w, "invalid w: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxHeight, err := imgDimension(query.Get("h"))
+	if err != nil {
+		http.Error(w, "invalid h: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if maxWidth == 0 && maxHeight == 0 {
+		http.Error(w, "w or h is required", http.StatusBadRequest)
+		return
+	}
+	fit := query.Get("fit")
+	switch fit {
+	case "":
+		fit = fitContain
+	case fitContain:
+	case fitCover:
+		if maxWidth == 0 || maxHeight == 0 {
+			http.Error(w, "fit=cover needs both w and h", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "invalid fit: want contain or cover", http.StatusBadRequest)
+		return
+	}
+	c.serveResized(w, r, src, maxWidth, maxHeight, fit, true)
+}
+
+// Srcset candidate widths served through /img, with the sizes hints that
+// match the layouts: grid cells are about 220px wide (half the screen on
+// phones), the view image spans the main column. Square tiles (strips,
+// carousels, folder covers) get centre-cropped squares; their sizes are set
+// per tile in the templates.
+var (
+	gridSrcsetWidths = []int{200, 400, 800}
+	viewSrcsetWidths = []int{800, 1600, 2560}
+	tileSrcsetWidths = []int{100, 200, 400}
+)
+
+const (
+	gridSizes = "(min-width: 640px) 220px, 50vw"
+	viewSizes = "(min-width: 1280px) 1248px, 100vw"
+)
+
+// srcset builds a srcset attribute value of /img candidates for src (the
+// images/... form) in the catalog under prefix
+func srcset(prefix, src string, widths []int) string {
+	candidates := make([]string, len(widths))
+	for i, w := range widths {
+		candidates[i] = fmt.Sprintf("%s/img?src=%s&w=%d %dw", prefix, url.QueryEscape(src), w, w)
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// tileSrcset builds a srcset attribute value of square /img crops of src
+// for tiles
+func tileSrcset(prefix, src string) string {
+	candidates := make([]string, len(tileSrcsetWidths))
+	for i, w := range tileSrcsetWidths {
+		candidates[i] = fmt.Sprintf("%s/img?src=%s&w=%d&h=%d&fit=cover %dw", prefix, url.QueryEscape(src), w, w, w)
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// imgDimension parses one /img bound; empty means unbounded (0)
+func imgDimension(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("want a positive integer")
+	}
+	if n > imgMaxDimension {
+		return 0, fmt.Errorf("max %d", imgMaxDimension)
+	}
+	return n, nil
+}
+
+// serveResized serves the src image scaled down to maxWidth x maxHeight
+// with the given fit as a cached JPEG or, with negotiate, in one of
+// imageFormats the client accepts once that variant is cached
+func (c *catalog) serveResized(w http.ResponseWriter, r *http.Request, src string, maxWidth, maxHeight int, fit string, negotiate bool) {
+	fullPath, err := c.resolveImageSrc(src)
+	if err != nil {
+		writeSrcError(w, r, err)
+		return
+	}
+	info, err := c.fs.Stat(fullPath)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	var variant string // the variant to queue once the JPEG's size is known
+	format := ""
+	if negotiate {
+		format = c.negotiateFormat(w, r)
+	}
+	if format != "" {
+		name := variantName(c.thumbCacheKey(fullPath, info, maxWidth, maxHeight, fit), format)
+		data, ok := c.cachedVariant(name)
+		if len(data) > 0 {
+			w.Header().Set("Cache-Control", "public, max-age=86400")
+			serveVariant(w, r, name, format, data)
+			return
+		}
+		if !ok {
+			variant = name
+		}
+	}
+	if r.Method == http.MethodHead && !c.thumbCached(fullPath, info, maxWidth, maxHeight, fit) {
+		// Don't generate a thumbnail just to report its headers
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		return
+	}
+	data, err := c.thumbnailFor(fullPath, info, maxWidth, maxHeight, fit)
+	if err != nil {
+		// Fall back to the original rather than a broken tile
+		slog.Warn("thumbnail failed", "path", fullPath, "err", err)
+		c.servePublicCopy(w, r, fullPath, info)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if variant != "" {
+		c.queueVariant(variantJob{c: c, name: variant, fullPath: fullPath, maxWidth: maxWidth, maxHeight: maxHeight, fit: fit, format: format, fallbackSize: len(data)})
+		// Come back soon for the smaller variant
+		w.Header().Set("Cache-Control", "public, max-age=60")
+	}
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(data))
+}
+
+// thumbnailFor returns the bytes of fullPath scaled to maxWidth x maxHeight
+// with fit from the memory cache, then the disk cache, generating them when
+// missing
+func (c *catalog) thumbnailFor(fullPath string, info os.FileInfo, maxWidth, maxHeight int, fit string) ([]byte, error) {
+	name := c.thumbCacheKey(fullPath, info, maxWidth, maxHeight, fit) + ".jpg"
+	if data, ok := c.srv.thumbs.Get(name); ok {
+		return data, nil
+	}
+	cachePath := c.cfg.cachePath(thumbCacheDir, name)
+	if data, err := os.ReadFile(cachePath); err == nil {
+		c.srv.thumbs.Add(name, data)
+		return data, nil
+	}
+	data, err := c.generateThumbnail(fullPath, maxWidth, maxHeight, fit)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(cachePath, data); err != nil {
+		slog.Warn("thumbnail cache write", "path", cachePath, "err", err)
+	}
+	c.srv.thumbs.Add(name, data)
+	return data, nil
+}
+
+// maxSourcePixels guards against decode bombs: a small file can declare
+// huge dimensions and make image.Decode allocate gigabytes
+const maxSourcePixels = 50_000_000
+
+// sourceDecodes counts full decodes by renderImage, the expensive part of
+// every cache miss, for /metrics
+var sourceDecodes atomic.Int64
+
+// decodeSlots bounds how many renderImage calls hold a decoded source at
+// once to GOMAXPROCS: a burst of cache misses queues here instead of
+// decoding every large original side by side and running out of memory
+var decodeSlots = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+// generateThumbnail encodes renderImage's result as a JPEG
+func (c *catalog) generateThumbnail(fullPath string, maxWidth, maxHeight int, fit string) ([]byte, error) {
+	dst, err := c.renderImage(fullPath, maxWidth, maxHeight, fit)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: c.cfg.thumbQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderImage decodes fullPath and returns it upright, scaled to fit within
+// maxWidth x maxHeight (0 leaves that side unbounded), or with fitCover
+// filling them, cropped. Smaller images are never upscaled. The original
+// size and wide renditions are watermarked when that is on. Clips are
+// rendered from their poster frame.
+func (c *catalog) renderImage(fullPath string, maxWidth, maxHeight int, fit string) (image.Image, error) {
+	if isVideoName(fullPath) {
+		info, err := c.fs.Stat(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		if fullPath, err = c.videoPoster(fullPath, info); err != nil {
+			return nil, err
+		}
+	}
+	f, err := c.fs.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxSourcePixels {
+		return nil, fmt.Errorf("source is %dx%d, over the %d pixel limit", cfg.Width, cfg.Height, maxSourcePixels)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	orientation := exifOrientation(f)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	decodeSlots <- struct{}{}
+	defer func() { <-decodeSlots }()
+	sourceDecodes.Add(1)
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	// Resize before rotating so only the small image is transformed. For
+	// quarter turns the displayed width is the source height.
+	resize := resizeToFit
+	if fit == fitCover {
+		resize = resizeToCover
+	}
+	var dst image.Image
+	if orientation >= 5 {
+		dst = applyOrientation(resize(src, maxHeight, maxWidth), orientation)
+	} else {
+		dst = applyOrientation(resize(src, maxWidth, maxHeight), orientation)
+	}
+	if c.cfg.watermarkID != "" && (maxWidth == 0 && maxHeight == 0 || dst.Bounds().Dx() >= watermarkMinWidth) {
+		dst = c.stampWatermark(dst)
+	}
+	return dst, nil
+}
+
+// resizeToFit scales src down to fit within maxWidth x maxHeight keeping its
+// aspect ratio; a bound of 0 is ignored
+func resizeToFit(src image.Image, maxWidth, maxHeight int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if maxWidth > 0 && w > maxWidth {
+		h = h * maxWidth / w
+		w = maxWidth
+	}
+	if maxHeight > 0 && h > maxHeight {
+		w = w * maxHeight / h
+		h = maxHeight
+	}
+	if w == b.Dx() && h == b.Dy() {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, max(w, 1), max(h, 1)))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+	return dst
+}
+
+// resizeToCover crops the centre of src to the aspect ratio of width x
+// height and scales it down to that size. A source too small for it keeps
+// the cropped size rather than being upscaled.
+func resizeToCover(src image.Image, width, height int) image.Image {
+	b := src.Bounds()
+	cw, ch := b.Dx(), b.Dy()
+	if cw*height > ch*width {
+		cw = max(ch*width/height, 1) // wider than the box: trim the sides
+	} else {
+		ch = max(cw*height/width, 1) // taller: trim top and bottom
+	}
+	x0 := b.Min.X + (b.Dx()-cw)/2
+	y0 := b.Min.Y + (b.Dy()-ch)/2
+	crop := image.Rect(x0, y0, x0+cw, y0+ch)
+	w, h := min(width, cw), min(height, ch)
+	if cw > width {
+		h = height
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Over, nil)
+	return dst
+}
+
+// writeFileAtomic writes data to a temp file and renames it into place so
+// concurrent readers never see a partial file
+func writeFileAtomic(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
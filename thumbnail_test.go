@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestJPEG writes a width x height JPEG to path
+func writeTestJPEG(t *testing.T, path string, width, height int) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0x80, 0xff})
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := jpeg.Encode(f, img, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestThumbnailCacheHitSkipsDecode(t *testing.T) {
+	srv, _ := newTestServer(t)
+	c := srv.Catalogs[0]
+	src := filepath.Join(t.TempDir(), "card.jpg")
+	writeTestJPEG(t, src, 300, 200)
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := sourceDecodes.Load()
+	first, err := c.thumbnailFor(src, info, 100, 100, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := sourceDecodes.Load() - before; n != 1 {
+		t.Fatalf("first request decoded %d times, want 1", n)
+	}
+	if cfg, err := jpeg.DecodeConfig(bytes.NewReader(first)); err != nil || cfg.Width != 100 || cfg.Height != 66 {
+		t.Fatalf("thumbnail %dx%d (%v), want 100x66", cfg.Width, cfg.Height, err)
+	}
+
+	// From memory, then from disk once memory has been dropped
+	for _, purge := range []bool{false, true} {
+		if purge {
+			srv.thumbs.Purge()
+		}
+		again, err := c.thumbnailFor(src, info, 100, 100, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(again) != string(first) {
+			t.Error("cached thumbnail differs from the first one")
+		}
+	}
+	if n := sourceDecodes.Load() - before; n != 1 {
+		t.Errorf("repeated requests decoded %d times in all, want 1", n)
+	}
+	if srv.thumbs.Len() != 1 {
+		t.Errorf("memory cache holds %d entries, want 1", srv.thumbs.Len())
+	}
+}
+
+func TestRenderImageWaitsForDecodeSlot(t *testing.T) {
+	srv, _ := newTestServer(t)
+	src := filepath.Join(t.TempDir(), "a.jpg")
+	writeTestJPEG(t, src, 64, 48)
+	for range cap(decodeSlots) {
+		decodeSlots <- struct{}{}
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := srv.Catalogs[0].renderImage(src, 32, 32, fitContain)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("renderImage decoded with every slot taken")
+	case <-time.After(50 * time.Millisecond):
+	}
+	for range cap(decodeSlots) {
+		<-decodeSlots
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("renderImage still waiting after the slots were freed")
+	}
+}
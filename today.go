@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	// Embedded zone database, so TIMEZONE works on hosts without one
+	// (Windows, scratch containers)
+	_ "time/tzdata"
+)
+
+// timezoneSettings: siteLocation (TIMEZONE, default Asia/Bangkok) decides
+// which day "today" is when the daily tab picks its folder
+type timezoneSettings struct {
+	siteLocation *time.Location
+}
+
+// defaultLocation is Asia/Bangkok, which the embedded zone database always
+// has
+func defaultLocation() *time.Location {
+	loc, err := time.LoadLocation("Asia/Bangkok")
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+func (cfg *config) loadTimezoneConfig() {
+	name := os.Getenv("TIMEZONE")
+	if name == "" {
+		return
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Fatalf("invalid TIMEZONE %q: %v", name, err)
+	}
+	cfg.siteLocation = loc
+}
+
+// folderNameDayRe finds a full date in a folder name like 2024-06-01a or
+// 20240601
+var folderNameDayRe = regexp.MustCompile(`(20\d{2})[-_.]?(0[1-9]|1[0-2])[-_.]?(0[1-9]|[12]\d|3[01])`)
+
+// folderDay returns the day a daily folder is for: its folder.json date,
+// else the date in its name. ok is false when it has neither.
+func folderDay(f DailyFolder) (day time.Time, ok bool) {
+	if !f.Date.IsZero() {
+		return f.Date, true
+	}
+	m := folderNameDayRe.FindStringSubmatch(f.Name)
+	if m == nil {
+		return time.Time{}, false
+	}
+	year, _ := strconv.Atoi(m[1])
+	month, _ := strconv.Atoi(m[2])
+	d, _ := strconv.Atoi(m[3])
+	day = time.Date(year, time.Month(month), d, 0, 0, 0, 0, time.UTC)
+	// The regexp allows the 31st of any month; reject what Date normalized
+	return day, day.Day() == d
+}
+
+// today returns midnight of the current day in siteLocation
+func (cfg *config) today() time.Time {
+	now := time.Now().In(cfg.siteLocation)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, cfg.siteLocation)
+}
+
+// defaultDailyFolder picks the daily folder shown when none is asked for:
+// the one dated today in siteLocation, else the one with the newest images.
+// Several folders for today (2024-06-01a, 2024-06-01b) are decided the same
+// newest-images way.
+func (c *catalog) defaultDailyFolder(folders []DailyFolder) string {
+	t := c.cfg.today()
+	var todays []DailyFolder
+	for _, f := range folders {
+		if day, ok := folderDay(f); ok && day.Year() == t.Year() && day.YearDay() == t.YearDay() {
+			todays = append(todays, f)
+		}
+	}
+	if len(todays) > 0 {
+		return c.newestDailyFolder(todays)
+	}
+	return c.newestDailyFolder(folders)
+}
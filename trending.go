@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trendingSettings: trendingSize (TRENDING, default 12) is how many images
+// each popular strip on the daily tab shows; 0 turns view counting off
+type trendingSettings struct {
+	trendingSize int
+}
+
+func (cfg *config) loadTrendingConfig() {
+	if v := os.Getenv("TRENDING"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 48 {
+			log.Fatalf("invalid TRENDING %q: want 0-48", v)
+		}
+		cfg.trendingSize = n
+	}
+}
+
+const (
+	// viewsFile, in the cache directory, keeps the view counts across
+	// restarts
+	viewsFile = "views.json"
+	// trendingDays is how many days of counts are kept, the "this week"
+	// strip's span
+	trendingDays = 7
+	viewsDay     = "2006-01-02"
+)
+
+// crawlerRe matches the User-Agent of bots and link previewers, whose
+// fetches aren't views
+var crawlerRe = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|preview|facebookexternalhit|curl|wget`)
+
+// viewCounts holds a server's per-day view counts of images by URL
+// (catalog prefix plus src), for the days in siteLocation
+type viewCounts struct {
+	sync.Mutex
+	days  map[string]map[string]int
+	dirty bool // changed since the last save
+}
+
+func newViewCounts() *viewCounts {
+	return &viewCounts{days: map[string]map[string]int{}}
+}
+
+// countView records a view of src in c, unless the request is a crawler, a
+// prefetch, or a reload of the image the visitor saw last
+func (c *catalog) countView(r *http.Request, src string) {
+	if c.cfg.trendingSize == 0 || crawlerRe.MatchString(r.UserAgent()) {
+		return
+	}
+	if r.Header.Get("Sec-Purpose") != "" || r.Header.Get("Purpose") == "prefetch" {
+		return
+	}
+	if recent := c.recentFromRequest(r); len(recent) > 0 && recent[0] == src {
+		return
+	}
+	today := c.cfg.today()
+	views := c.srv.views
+	views.Lock()
+	defer views.Unlock()
+	counts := views.days[today.Format(viewsDay)]
+	if counts == nil {
+		counts = map[string]int{}
+		views.days[today.Format(viewsDay)] = counts
+		views.prune(today)
+	}
+	counts[c.Prefix+"/"+src]++
+	views.dirty = true
+}
+
+// prune drops the days older than trendingDays before today; callers hold
+// the lock
+func (v *viewCounts) prune(today time.Time) {
+	oldest := today.AddDate(0, 0, -(trendingDays - 1)).Format(viewsDay)
+	for day := range v.days {
+		if day < oldest {
+			delete(v.days, day)
+		}
+	}
+}
+
+// popularImages returns up to trendingSize srcs of c with the most views
+// over the last days days (1 is today), most viewed first. Images that are
+// gone or hidden since are skipped.
+func (c *catalog) popularImages(days int) []string {
+	if c.cfg.trendingSize == 0 {
+		return nil
+	}
+	prefix := c.Prefix + "/"
+	totals := map[string]int{}
+	today := c.cfg.today()
+	views := c.srv.views
+	views.Lock()
+	for i := 0; i < days; i++ {
+		for url, n := range views.days[today.AddDate(0, 0, -i).Format(viewsDay)] {
+			if src, ok := strings.CutPrefix(url, prefix); ok && strings.HasPrefix(src, "images/") {
+				totals[src] += n
+			}
+		}
+	}
+	views.Unlock()
+
+	srcs := make([]string, 0, len(totals))
+	for src := range totals {
+		srcs = append(srcs, src)
+	}
+	sort.Slice(srcs, func(i, j int) bool {
+		if totals[srcs[i]] != totals[srcs[j]] {
+			return totals[srcs[i]] > totals[srcs[j]]
+		}
+		return srcs[i] < srcs[j]
+	})
+	var popular []string
+	for _, src := range srcs {
+		if len(popular) == c.cfg.trendingSize {
+			break
+		}
+		fullPath, err := c.resolveViewSrc(src)
+		if err != nil || c.folderHidden(filepath.Dir(fullPath)) {
+			continue
+		}
+		popular = append(popular, c.srcFor(fullPath))
+	}
+	return popular
+}
+
+// loadViewCounts reads viewsFile, if there is one, at startup
+func (s *Server) loadViewCounts() {
+	if s.cfg.trendingSize == 0 {
+		return
+	}
+	file := s.cfg.cachePath(viewsFile)
+	raw, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	views := s.views
+	views.Lock()
+	defer views.Unlock()
+	if err == nil {
+		err = json.Unmarshal(raw, &views.days)
+	}
+	if err != nil {
+		// Counts are a nicety; start over rather than refuse to start
+		slog.Warn("ignoring view counts", "file", file, "err", err)
+		views.days = map[string]map[string]int{}
+		return
+	}
+	if views.days == nil {
+		views.days = map[string]map[string]int{} // the file held null
+	}
+	views.prune(s.cfg.today())
+}
+
+// saveViewCounts writes viewsFile when the counts changed
+func (s *Server) saveViewCounts() {
+	views := s.views
+	views.Lock()
+	if !views.dirty {
+		views.Unlock()
+		return
+	}
+	raw, err := json.Marshal(views.days)
+	views.dirty = false
+	views.Unlock()
+	file := s.cfg.cachePath(viewsFile)
+	if err == nil {
+		err = writeFileAtomic(file, raw)
+	}
+	if err != nil {
+		slog.Error("saving view counts failed", "file", file, "err", err)
+	}
+}
+
+// saveViewsLoop saves the view counts every minute and once more when ctx
+// is cancelled
+func (s *Server) saveViewsLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.saveViewCounts()
+			return
+		case <-ticker.C:
+			s.saveViewCounts()
+		}
+	}
+}
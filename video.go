@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"log/slog"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Short clips (.mp4, .webm) are listed alongside the images of a folder and
+// play in a <video> element on view pages. Their tiles, link previews and
+// PDF pages show a poster frame that ffmpeg (FFMPEG, the ffmpeg binary;
+// default "ffmpeg" on the PATH, "off" to never run it) picks from the
+// clip's first seconds. Without ffmpeg, clips get a placeholder poster.
+// Posters are cached next to the thumbnails.
+type videoSettings struct {
+	ffmpegPath string
+}
+
+// videoTypes are the clip extensions listed in folders, with their MIME
+// types, which minimal systems may not know
+var videoTypes = map[string]string{".mp4": "video/mp4", ".webm": "video/webm"}
+
+func init() {
+	for ext, typ := range videoTypes {
+		if err := mime.AddExtensionType(ext, typ); err != nil {
+			log.Fatalf("video type %s: %v", ext, err)
+		}
+	}
+}
+
+func (cfg *config) loadVideoConfig() {
+	v := os.Getenv("FFMPEG")
+	switch v {
+	case "off":
+		return
+	case "":
+		// Optional: clips fall back to the placeholder poster
+		if p, err := exec.LookPath("ffmpeg"); err == nil {
+			cfg.ffmpegPath = p
+		}
+		return
+	}
+	p, err := exec.LookPath(v)
+	if err != nil {
+		log.Fatalf("invalid FFMPEG %q: %v", v, err)
+	}
+	cfg.ffmpegPath = p
+}
+
+// isVideoName reports whether name has a supported clip extension
+func isVideoName(name string) bool {
+	_, ok := videoTypes[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// isMediaName reports whether name is listed in galleries: an image or a
+// clip
+func isMediaName(name string) bool {
+	return isImageName(name) || isVideoName(name)
+}
+
+// posterTimeout bounds one ffmpeg run, so a broken file can't hold up the
+// thumbnails queued behind it
+const posterTimeout = 30 * time.Second
+
+// posterMu runs one ffmpeg at a time: tiles of a new folder all ask for
+// their posters at once
+var posterMu sync.Mutex
+
+// videoPoster returns the path of the poster JPEG of the clip at fullPath,
+// extracting it on first use. A clip ffmpeg can't read gets the placeholder.
+func (c *catalog) videoPoster(fullPath string, info os.FileInfo) (string, error) {
+	cachePath := c.cfg.cachePath(thumbCacheDir, c.thumbCacheKey(fullPath, info, 0, 0, "poster")+".poster.jpg")
+	if _, err := os.Stat(cachePath); err == nil {
+		return cachePath, nil
+	}
+	posterMu.Lock()
+	defer posterMu.Unlock()
+	if _, err := os.Stat(cachePath); err == nil {
+		return cachePath, nil // made while waiting
+	}
+	var data []byte
+	var err error
+	if c.cfg.ffmpegPath != "" {
+		start := time.Now()
+		if data, err = extractPoster(c.cfg.ffmpegPath, fullPath); err != nil {
+			slog.Warn("video poster failed", "path", fullPath, "err", err)
+		} else {
+			slog.Debug("video poster", "path", fullPath, "duration", time.Since(start).Round(time.Millisecond).String())
+		}
+	}
+	if data == nil {
+		if data, err = placeholderPoster(c.cfg.thumbQuality); err != nil {
+			return "", err
+		}
+	}
+	return cachePath, writeFileAtomic(cachePath, data)
+}
+
+// extractPoster has the ffmpeg binary pick a representative frame from the
+// first hundred of the clip, upright, and returns it as a JPEG
+func extractPoster(ffmpeg, fullPath string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), posterTimeout)
+	defer cancel()
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, "-nostdin", "-v", "error", "-i", fullPath,
+		"-vf", "thumbnail", "-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", "-q:v", "2", "pipe:1")
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("no frame: %w", err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxSourcePixels {
+		return nil, fmt.Errorf("frame is %dx%d, over the %d pixel limit", cfg.Width, cfg.Height, maxSourcePixels)
+	}
+	return out.Bytes(), nil
+}
+
+// placeholderPoster draws a 16:9 poster of a play button on the theme
+// colour, encoded at quality
+func placeholderPoster(quality int) ([]byte, error) {
+	const width, height = 1280, 720
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	base := color.RGBA{0x0d, 0x41, 0x3d, 0xff} // themeColor
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	cx, cy, r := width/2, height/2, 110
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dx, dy := x-cx, y-cy
+			c := base
+			if dx*dx+dy*dy <= r*r {
+				c = white
+				// The triangle, pointing right, cut out of the circle
+				if dx >= -35 && dx <= 55 && 2*dy <= 55-dx && -2*dy <= 55-dx {
+					c = base
+				}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// indexVideo fills in the facts of the clip at path from its poster frame:
+// the displayed size and the preview behind its tile. Placeholder posters
+// tell nothing about the clip and are skipped. Clips are never perceptually
+// hashed, as their posters are rarely what makes two clips the same.
+func (c *catalog) indexVideo(f *imageFacts, path string, info os.FileInfo) {
+	if c.cfg.ffmpegPath == "" {
+		return
+	}
+	poster, err := c.videoPoster(path, info)
+	if err != nil {
+		return
+	}
+	src, _, err := decodeSource(osStorage{}, poster)
+	if err != nil {
+		return
+	}
+	b := src.Bounds()
+	f.width, f.height = b.Dx(), b.Dy()
+	f.preview = previewDataURI(src, 1)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Watermarking (WATERMARK_TEXT and/or WATERMARK_LOGO, a PNG) stamps the
+// full-size images visitors can take away: /images/ originals, /download
+// and selection ZIPs, and renditions watermarkMinWidth px wide or more.
+// Thumbnails and tiles stay clean. The admin gets unmarked originals from
+// /download?original=1. WATERMARK_FONT is a TTF/OTF file for text the
+// bundled Go font has no glyphs for, such as Thai.
+type watermarkSettings struct {
+	watermarkText string
+	watermarkLogo image.Image
+	watermarkFont *opentype.Font
+	// watermarkID identifies the settings in cache keys; "" when
+	// watermarking is off
+	watermarkID string
+}
+
+// watermarkMinWidth is the width from which resized renditions are stamped
+const watermarkMinWidth = 1024
+
+func (cfg *config) loadWatermarkConfig() {
+	cfg.watermarkText = strings.TrimSpace(os.Getenv("WATERMARK_TEXT"))
+	logoFile := os.Getenv("WATERMARK_LOGO")
+	if cfg.watermarkText == "" && logoFile == "" {
+		return
+	}
+	h := sha256.New()
+	h.Write([]byte(cfg.watermarkText))
+	if logoFile != "" {
+		raw, err := os.ReadFile(logoFile)
+		if err != nil {
+			log.Fatalf("invalid WATERMARK_LOGO: %v", err)
+		}
+		cfg.watermarkLogo, err = png.Decode(bytes.NewReader(raw))
+		if err != nil {
+			log.Fatalf("invalid WATERMARK_LOGO %q: want a PNG: %v", logoFile, err)
+		}
+		h.Write(raw)
+	}
+	fontData := gobold.TTF
+	if v := os.Getenv("WATERMARK_FONT"); v != "" {
+		raw, err := os.ReadFile(v)
+		if err != nil {
+			log.Fatalf("invalid WATERMARK_FONT: %v", err)
+		}
+		fontData = raw
+	}
+	var err error
+	cfg.watermarkFont, err = opentype.Parse(fontData)
+	if err != nil {
+		log.Fatalf("invalid WATERMARK_FONT: %v", err)
+	}
+	h.Write(fontData)
+	cfg.watermarkID = hex.EncodeToString(h.Sum(nil))[:16]
+	slog.Info("watermark", "text", cfg.watermarkText, "logo", logoFile)
+}
+
+// stampWatermark returns img with the logo and, above it, the text in its
+// bottom right corner, both half transparent and sized to the image
+func (c *catalog) stampWatermark(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	margin := max(b.Dx()/40, 4)
+	right, bottom := dst.Bounds().Max.X-margin, dst.Bounds().Max.Y-margin
+	if c.cfg.watermarkLogo != nil {
+		lb := c.cfg.watermarkLogo.Bounds()
+		w := max(b.Dx()/5, 1)
+		h := max(lb.Dy()*w/lb.Dx(), 1)
+		logo := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.CatmullRom.Scale(logo, logo.Bounds(), c.cfg.watermarkLogo, lb, draw.Src, nil)
+		draw.DrawMask(dst, image.Rect(right-w, bottom-h, right, bottom), logo, image.Point{}, image.NewUniform(color.Alpha{128}), image.Point{}, draw.Over)
+		bottom -= h + margin/2
+	}
+	if c.cfg.watermarkText != "" {
+		face, err := opentype.NewFace(c.cfg.watermarkFont, &opentype.FaceOptions{Size: float64(max(b.Dx()/25, 12)), DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			slog.Warn("watermark font", "err", err)
+			return dst
+		}
+		defer face.Close()
+		d := font.Drawer{Dst: dst, Face: face}
+		dot := fixed.P(right-d.MeasureString(c.cfg.watermarkText).Ceil(), bottom-face.Metrics().Descent.Ceil())
+		// A dark offset copy keeps the text legible on light images
+		shadow := fixed.I(max(b.Dx()/500, 1))
+		d.Src, d.Dot = image.NewUniform(color.NRGBA{0, 0, 0, 96}), dot.Add(fixed.Point26_6{X: shadow, Y: shadow})
+		d.DrawString(c.cfg.watermarkText)
+		d.Src, d.Dot = image.NewUniform(color.NRGBA{255, 255, 255, 160}), dot
+		d.DrawString(c.cfg.watermarkText)
+	}
+	return dst
+}
+
+// watermarkedExt is the extension of the stamped copy of the image at
+// fullPath: JPEGs stay JPEG, everything else becomes PNG
+func watermarkedExt(fullPath string) string {
+	if e := strings.ToLower(filepath.Ext(fullPath)); e == ".jpg" || e == ".jpeg" {
+		return ".jpg"
+	}
+	return ".png"
+}
+
+// watermarkedOriginal returns the path of the stamped full-size copy of
+// the image at fullPath, generating it into the thumbnail cache on first
+// use
+func (c *catalog) watermarkedOriginal(fullPath string, info os.FileInfo) (string, error) {
+	ext := watermarkedExt(fullPath)
+	cachePath := c.cfg.cachePath(thumbCacheDir, c.thumbCacheKey(fullPath, info, 0, 0, fitContain)+".wm"+ext)
+	if _, err := os.Stat(cachePath); err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return cachePath, err
+	}
+	img, err := c.renderImage(fullPath, 0, 0, fitContain)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if ext == ".jpg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return "", err
+	}
+	return cachePath, writeFileAtomic(cachePath, buf.Bytes())
+}
+
+// watermarkOriginals wraps the /images/ file server so images are served
+// stamped while watermarking is on; other files go to next
+func (c *catalog) watermarkOriginals(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.cfg.watermarkID == "" || !isImageName(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fullPath := filepath.Join(c.Root, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		info, err := c.fs.Stat(fullPath)
+		if err != nil || !info.Mode().IsRegular() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		c.servePublicCopy(w, r, fullPath, info)
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A .webp file next to another image with the same base name (card.png and
+// card.webp) is a hand-optimized variant of it rather than an image of its
+// own: listings show only the original, and /images/ serves the variant
+// under the original's URL to clients that accept WebP.
+
+// isWebPVariant reports whether the image at p is a .webp whose original
+// sits in the same directory
+func (c *catalog) isWebPVariant(p string) bool {
+	ext := filepath.Ext(p)
+	if !strings.EqualFold(ext, ".webp") {
+		return false
+	}
+	base := strings.TrimSuffix(p, ext)
+	for e := range imageExts {
+		if e == ".webp" {
+			continue
+		}
+		if _, err := c.fs.Stat(base + e); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts reports whether the request's Accept header lists mediaType
+// (image/webp, ...) with a non-zero quality
+func accepts(r *http.Request, mediaType string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mt != mediaType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// webpVariants wraps the /images/ file server of root so a request for an
+// original is answered with its .webp variant when one exists and the client
+// accepts it. Responses for such URLs vary on Accept so caches keep both.
+func webpVariants(root http.FileSystem, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ext := path.Ext(r.URL.Path)
+		if !imageExts[strings.ToLower(ext)] || strings.EqualFold(ext, ".webp") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		variant := strings.TrimSuffix(r.URL.Path, ext) + ".webp"
+		f, err := root.Open(variant)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info, err := f.Stat()
+		f.Close()
+		if err != nil || info.IsDir() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		varyAccept(w.Header())
+		if accepts(r, "image/webp") {
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = variant
+			next.ServeHTTP(w, r2)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
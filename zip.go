@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maxSelectionFiles caps how many images one selection ZIP may contain
+const maxSelectionFiles = 200
+
+// selectionZipHandler streams a ZIP of the images named in a JSON array of
+// src paths (as used by /view). Every path must be valid; one bad entry
+// rejects the whole request rather than producing a partial archive.
+func (c *catalog) selectionZipHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var srcs []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&srcs); err != nil {
+		http.Error(w, "body must be a JSON array of src paths", http.StatusBadRequest)
+		return
+	}
+	if len(srcs) == 0 {
+		http.Error(w, "no files selected", http.StatusBadRequest)
+		return
+	}
+	if len(srcs) > maxSelectionFiles {
+		http.Error(w, fmt.Sprintf("too many files: max %d", maxSelectionFiles), http.StatusBadRequest)
+		return
+	}
+
+	var files []zipFile
+	seen := make(map[string]bool, len(srcs))
+	for _, src := range srcs {
+		// accept URL paths as returned by /api/related as well
+		fullPath, err := c.resolveImageSrc(strings.TrimPrefix(strings.TrimPrefix(src, c.Prefix), "/"))
+		if err == nil {
+			if info, statErr := c.fs.Stat(fullPath); statErr != nil || info.IsDir() {
+				err = os.ErrNotExist
+			}
+		}
+		if err != nil {
+			http.Error(w, "invalid src: "+src, http.StatusBadRequest)
+			return
+		}
+		if !seen[fullPath] {
+			seen[fullPath] = true
+			files = append(files, zipFile{FS: c.fs, Path: fullPath, Name: strings.TrimPrefix(c.srcFor(fullPath), "images/")})
+		}
+	}
+	if err := c.usePublicCopies(files); err != nil {
+		slog.Warn("selection zip: public copy failed", "err", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	serveZip(w, files, "selection.zip")
+}
+
+// usePublicCopies points the image entries of files at the stamped or
+// stripped copies visitors get, generating them up front: the archive size
+// must be known before the first byte
+func (c *catalog) usePublicCopies(files []zipFile) error {
+	if c.cfg.watermarkID == "" && !c.cfg.stripMetadata {
+		return nil
+	}
+	for i, f := range files {
+		if !isImageName(f.Path) {
+			continue
+		}
+		info, err := c.fs.Stat(f.Path)
+		if err == nil {
+			files[i].Path, err = c.publicCopy(f.Path, info)
+			files[i].FS = c.publicFS(f.Path, files[i].Path)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Path, err)
+		}
+		if c.cfg.watermarkID != "" {
+			files[i].Name = strings.TrimSuffix(f.Name, path.Ext(f.Name)) + watermarkedExt(f.Path)
+		}
+	}
+	return nil
+}
+
+// serveZip streams files as an attachment called name
+func serveZip(w http.ResponseWriter, files []zipFile, name string) {
+	size, err := zipSize(files)
+	if err != nil {
+		slog.Warn("zip download", "name", name, "err", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	// FormatMediaType switches to RFC 2231 encoding for non-ASCII names
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": name})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if err := writeZip(w, files); err != nil {
+		// Headers are gone by now; all we can do is log and cut the stream
+		slog.Warn("zip download", "name", name, "err", err)
+	}
+}
+
+// zipFile is one archive entry: the file, read from FS, and its name in the
+// ZIP. Names are paths below the image root so same-named files from
+// different folders don't collide.
+type zipFile struct {
+	FS   storage
+	Path string
+	Name string
+}
+
+// writeZip writes files into a ZIP stream
+func writeZip(w io.Writer, files []zipFile) error {
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		if err := addZipFile(zw, f.FS, f.Path, f.Name); err != nil {
+			return fmt.Errorf("%s: %w", f.Path, err)
+		}
+	}
+	return zw.Close()
+}
+
+func addZipFile(zw *zip.Writer, fsys storage, fullPath, name string) error {
+	f, err := fsys.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := createZipEntry(zw, info, name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// createZipEntry starts a stored (uncompressed) entry. Images are already
+// compressed, so deflating them again costs CPU for next to no savings, and
+// storing keeps the archive size a pure function of the file sizes.
+func createZipEntry(zw *zip.Writer, info os.FileInfo, name string) (io.Writer, error) {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = name
+	hdr.Method = zip.Store
+	return zw.CreateHeader(hdr)
+}
+
+// zipSize returns the exact byte length writeZip will produce for files, so
+// downloads can send Content-Length for accurate progress and truncation
+// detection. Because entries are stored, only the sizes matter: it runs the
+// same writer over zeros into a counter instead of reading the files.
+func zipSize(files []zipFile) (int64, error) {
+	var cw countingWriter
+	zw := zip.NewWriter(&cw)
+	for _, f := range files {
+		info, err := f.FS.Stat(f.Path)
+		if err != nil {
+			return 0, err
+		}
+		dst, err := createZipEntry(zw, info, f.Name)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(dst, zeroReader{}, info.Size()); err != nil {
+			return 0, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	return cw.n, nil
+}
+
+type countingWriter struct{ n int64 }
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}